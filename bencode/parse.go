@@ -226,6 +226,65 @@ func Parse(reader io.Reader) (BencodeValue, error) {
 	return parse(bReader)
 }
 
+// DictValueBytes returns the value of the key in the bencoded dictionary as the bytes it was encoded with
+// Hashes must be computed on these bytes, encoding the parsed value again may not reproduce them
+func DictValueBytes(data []byte, key string) ([]byte, error) {
+
+	source := bytes.NewReader(data)
+	reader := bufio.NewReader(source)
+
+	// What the parser consumed, the bytes still buffered were not parsed yet
+	offset := func() int {
+		return len(data) - source.Len() - reader.Buffered()
+	}
+
+	c, err := reader.ReadByte()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c != 'd' {
+		return nil, fmt.Errorf("not a dictionary")
+	}
+
+	for {
+		c, err := reader.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c == 'e' {
+			break
+		}
+
+		err = reader.UnreadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := decodeString(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		start := offset()
+
+		if _, err := parse(reader); err != nil {
+			return nil, err
+		}
+
+		if current == key {
+			return data[start:offset()], nil
+		}
+	}
+
+	return nil, fmt.Errorf("missing key %q", key)
+}
+
 // Read until the delimiter byte is found in the reader.
 func readUntil(reader *bufio.Reader, delim byte) ([]byte, error) {
 	data, err := reader.ReadSlice(delim)
@@ -245,33 +304,6 @@ func readUntil(reader *bufio.Reader, delim byte) ([]byte, error) {
 	return data, nil
 }
 
-// Read exactly len(buffer) bytes from the reader into the buffer.
-func readFull(reader *bufio.Reader, buffer []byte) (int, error) {
-	return readAtLeast(reader, buffer, len(buffer))
-}
-
-// Read at least min bytes from the reader into the buffer.
-func readAtLeast(reader *bufio.Reader, buffer []byte, min int) (n int, err error) {
-	if len(buffer) < min {
-		return 0, fmt.Errorf("buffer too small")
-	}
-
-	// Read at least min bytes.
-	for n < min && err == nil {
-		var nn int
-		nn, err = reader.Read(buffer[n:])
-		n += nn
-	}
-
-	if n == min {
-		err = nil
-	} else if n > 0 && err == io.EOF {
-		err = io.ErrUnexpectedEOF
-	}
-
-	return
-}
-
 func decodeString(reader *bufio.Reader) (string, error) {
 
 	log.Debug().Msg("getting length of content before ':' character")
@@ -305,14 +337,19 @@ func decodeString(reader *bufio.Reader) (string, error) {
 
 	log.Error().Msg("could not peek content, will try to read full content")
 
-	buffer := make([]byte, length)
+	// The length is only declared by the input, reading it in chunks allocates no more than the input actually holds
+	buffer := bytes.Buffer{}
+
+	if _, err := io.CopyN(&buffer, reader, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 
-	if _, err := readFull(reader, buffer); err != nil {
 		log.Error().Err(err).Msg("could not read content")
 		return "", err
 	}
 
-	data := string(buffer)
+	data := buffer.String()
 	log.Debug().Str("data", data).Msg("attempted to read content successfully")
 	return data, nil
 }
@@ -338,6 +375,8 @@ func decodeInt64(reader *bufio.Reader, delim byte) (int64, error) {
 	return 0, fmt.Errorf("invalid integer")
 }
 
+// Encode writes the value exactly as given, empty and zero values included
+// Optional dictionary keys that are unset must be left out of the dictionary by the caller
 func (v *BencodeValue) Encode(buffer *bytes.Buffer) error {
 
 	var err error
@@ -360,7 +399,7 @@ func (v *BencodeValue) Encode(buffer *bytes.Buffer) error {
 	case DictType:
 		buffer.WriteByte('d')
 
-		keys := make([]string, len(v.Dict))
+		keys := make([]string, 0, len(v.Dict))
 
 		for k := range v.Dict {
 			keys = append(keys, k)
@@ -370,16 +409,11 @@ func (v *BencodeValue) Encode(buffer *bytes.Buffer) error {
 
 		for i, key := range keys {
 			bencodeDictPairSlice[i] = BencodeDictPair{key, v.Dict[key]}
-			bencodeDictPairSlice[i] = BencodeDictPair{key, v.Dict[key]}
 		}
 
 		sort.Sort(bencodeDictPairSlice)
 
 		for _, sv := range bencodeDictPairSlice {
-			if sv.value.IsValueEmpty() {
-				continue
-			}
-
 			_, err = fmt.Fprintf(buffer, "%d:%s", len(sv.key), sv.key)
 
 			if err != nil {
@@ -1,5 +1,7 @@
 package client
 
+import "fmt"
+
 // Bitfield is a data structure that peers use to efficiently encode which pieces they are able to send us
 // To check the pieces we just need to check the bits in the bitfield
 // By working with bits instead of bytes makes it more efficient
@@ -26,3 +28,23 @@ func (bf Bitfield) SetPiece(index int) {
 
 	bf[byteIndex] |= 1 << bitIndex
 }
+
+// NewBitfield creates an empty bitfield large enough to hold the given number of pieces
+func NewBitfield(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+// Validate checks a bitfield received from a peer against the number of pieces of the torrent
+// It must have exactly the bytes to hold them, and the spare bits of the last byte must be cleared
+func (bf Bitfield) Validate(pieces int) error {
+
+	if len(bf) != (pieces+7)/8 {
+		return fmt.Errorf("bitfield of %d bytes for %d pieces", len(bf), pieces)
+	}
+
+	if spare := pieces % 8; spare != 0 && bf[len(bf)-1]&(0xff>>spare) != 0 {
+		return fmt.Errorf("bitfield has spare bits set")
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// How often the upload slots are handed out again
+const rechokeInterval = 10 * time.Second
+
+// Peers unchoked for their rates, the optimistic unchoke comes on top of them
+const uploadSlots = 4
+
+// The optimistic unchoke moves to another peer every third rechoke, every 30 seconds
+const optimisticUnchokeRounds = 3
+
+// Tit-for-tat choker
+// Every rechoke the interested peers sending us the most data get the upload slots, when seeding the ones we upload to the fastest
+// One more interested peer is unchoked at random so newcomers get a chance to show their rate
+type choker struct {
+	session    *Session
+	round      int
+	optimistic *Client
+
+	// Counters of each peer at the previous rechoke, the difference is the rate of the round
+	last map[*Client]int64
+}
+
+func newChoker(session *Session) *choker {
+	return &choker{
+		session: session,
+		last:    make(map[*Client]int64),
+	}
+}
+
+// Rechokes at every interval and fills free slots whenever the peers change, until the context is cancelled
+func (c *choker) run(ctx context.Context) {
+
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	c.rechoke()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.rechoke()
+		case <-c.session.chokerWake:
+			c.fillSlots()
+		}
+	}
+}
+
+func (c *choker) rechoke() {
+
+	clients := c.session.connectedClients()
+	seeding := c.session.Complete()
+	rates := make(map[*Client]int64, len(clients))
+	last := make(map[*Client]int64, len(clients))
+
+	for _, client := range clients {
+		counter := client.downloaded.Load()
+
+		if seeding {
+			counter = client.uploaded.Load()
+		}
+
+		rates[client] = counter - c.last[client]
+		last[client] = counter
+	}
+
+	// Peers that disconnected are forgotten
+	c.last = last
+
+	interested := make([]*Client, 0, len(clients))
+
+	for _, client := range clients {
+		if client.peerInterested.Load() {
+			interested = append(interested, client)
+		}
+	}
+
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	unchoked := make(map[*Client]bool, uploadSlots+1)
+
+	for _, client := range interested[:min(uploadSlots, len(interested))] {
+		unchoked[client] = true
+	}
+
+	if c.round%optimisticUnchokeRounds == 0 || !c.keepsOptimistic(unchoked) {
+		c.optimistic = pickOptimistic(interested, unchoked)
+	}
+
+	if c.optimistic != nil {
+		unchoked[c.optimistic] = true
+	}
+
+	c.round++
+
+	for _, client := range clients {
+		c.setChoked(client, !unchoked[client])
+	}
+
+	log.Debug().Str("name", c.session.torrent.Name).Int("peers", len(clients)).Int("interested", len(interested)).Int("unchoked", len(unchoked)).Bool("seeding", seeding).Msg("rechoked peers")
+}
+
+// Whether the optimistic unchoke can stay on its peer until its rotation, it must still be connected,
+// interested and not already holding a regular slot
+func (c *choker) keepsOptimistic(unchoked map[*Client]bool) bool {
+
+	if c.optimistic == nil || unchoked[c.optimistic] || !c.optimistic.peerInterested.Load() {
+		return false
+	}
+
+	_, connected := c.last[c.optimistic]
+
+	return connected
+}
+
+// Unchokes interested peers while regular slots are free, between two rechokes
+// Peers leaving or losing interest release their slot, the next rechoke rebalances by rate
+func (c *choker) fillSlots() {
+
+	clients := c.session.connectedClients()
+	used := 0
+
+	for _, client := range clients {
+		if client == c.optimistic {
+			continue
+		}
+
+		if !client.amChoking.Load() && client.peerInterested.Load() {
+			used++
+		}
+	}
+
+	for _, client := range clients {
+		if used >= uploadSlots {
+			return
+		}
+
+		if client.amChoking.Load() && client.peerInterested.Load() {
+			c.setChoked(client, false)
+			used++
+		}
+	}
+}
+
+func (c *choker) setChoked(client *Client, choked bool) {
+
+	if client.amChoking.Load() == choked {
+		return
+	}
+
+	var err error
+
+	if choked {
+		err = client.SendChoke()
+	} else {
+		err = client.SendUnchoke()
+	}
+
+	if err != nil {
+		log.Debug().Err(err).Str("peer", client.peer.Address()).Bool("choked", choked).Msg("failed to change choke state")
+	}
+}
+
+// Picks a random interested peer among those without a regular slot
+func pickOptimistic(interested []*Client, unchoked map[*Client]bool) *Client {
+
+	candidates := make([]*Client, 0, len(interested))
+
+	for _, client := range interested {
+		if !unchoked[client] {
+			candidates = append(candidates, client)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
@@ -1,50 +1,107 @@
 package client
 
 import (
-	"fmt"
+	"Torrent-Client/mse"
+	"context"
 	"github.com/rs/zerolog/log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const maxBlockSize = 16384
-const maxRequests = 5
 const defaultPeerTimeout = 3 * time.Second
 
 type Client struct {
 	name       string
-	conn       net.Conn
+	conn       *PeerConn
 	choked     bool
 	interested bool
 	bitfield   Bitfield
 	peer       Peer
 	infoHash   [20]byte
 	peerID     [20]byte
+
+	// State of our side, whether we refuse the requests of the peer and whether it wants our pieces
+	// They are read by the choker while the connection goroutine updates them
+	amChoking      atomic.Bool
+	peerInterested atomic.Bool
+
+	// Payload bytes received from and sent to the peer, the choker ranks peers by how fast they grow
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+
+	// Reserved bytes of the handshake of the peer, the protocol extensions it supports
+	reserved Reserved
+
+	// Whether we dialed the peer, its address is then one it accepts connections on
+	outbound bool
+
+	// Pieces the peer has, counted by the connection goroutine, and whether that is all of them
+	pieces int
+	seed   atomic.Bool
+
+	// Extensions we support and the extended handshake of the peer, nil until it arrives
+	extensions     *ExtensionRegistry
+	extensionMutex sync.Mutex
+	peerExtensions *ExtendedHandshake
+
+	// Fast extension, the pieces the peer lets us request while choked and those we let it request
+	allowedFast []int
+	grantedFast Bitfield
 }
 
-func NewClient(peer Peer, infoHash [20]byte, peerID [20]byte) (*Client, error) {
+// Builds the client of a connection that completed its handshake, both sides start choked
+func newClient(conn *PeerConn, peer Peer, infoHash [20]byte, peerID [20]byte, bitfield Bitfield) *Client {
+
+	client := &Client{
+		conn:     conn,
+		peer:     peer,
+		infoHash: infoHash,
+		peerID:   peerID,
+		bitfield: bitfield,
+		choked:   true,
+	}
+
+	client.amChoking.Store(true)
+
+	return client
+}
+
+func NewClient(peer Peer, infoHash [20]byte, peerID [20]byte, pieces int, encryption mse.Policy) (*Client, error) {
+	return NewClientContext(context.Background(), peer, infoHash, peerID, pieces, encryption)
+}
+
+// NewClientContext connects to the peer and handshakes, the connection is closed when the context is cancelled
+// The connection is obfuscated with MSE as the encryption policy says
+// The peer starts with none of the given number of pieces, the bitfield is optional and peers without a piece
+// skip it, so it is handled with the messages that follow like have and unchoke
+func NewClientContext(ctx context.Context, peer Peer, infoHash [20]byte, peerID [20]byte, pieces int, encryption mse.Policy) (*Client, error) {
 
 	log.Debug().Str("peer", peer.Address()).Msg("connecting to peer")
 
-	// Dial is a function that connects to the address on the named network
-	// The network must be "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "ip", "ip4", "ip6"
-	conn, err := net.DialTimeout("tcp", peer.Address(), defaultPeerTimeout)
+	conn, err := dialPeer(ctx, peer, infoHash, encryption)
 
 	if err != nil {
 		log.Debug().Err(err).Str("peer", peer.Address()).Msg("failed to connect to peer")
 		return nil, err
 	}
 
+	// The connection is handed over to the client on success, so it is only closed here if the setup fails
 	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
+		if err == nil {
+			return
+		}
+
+		if err := conn.Close(); err != nil {
 			log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to close connection")
 		}
 	}(conn)
 
 	log.Debug().Str("peer", peer.Address()).Msg("handshaking with peer")
 
-	err = handshake(conn, peer, infoHash, peerID)
+	response, err := handshake(conn, peer, infoHash, peerID)
 
 	if err != nil {
 		log.Debug().Err(err).Str("peer", peer.Address()).Msg("failed to do handshake")
@@ -53,84 +110,120 @@ func NewClient(peer Peer, infoHash [20]byte, peerID [20]byte) (*Client, error) {
 
 	log.Debug().Str("peer", peer.Address()).Msg("handshake successful")
 
-	bitfield, err := ReadBitfieldMessage(conn)
+	wire := NewPeerConn(conn)
+	wire.Start(ctx)
 
-	if err != nil {
-		log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to read bitfield message")
-		return nil, err
-	}
+	client := newClient(wire, peer, infoHash, peerID, NewBitfield(pieces))
+	client.reserved = response.Reserved
+	client.outbound = true
 
-	return &Client{
-		peer:     peer,
-		infoHash: infoHash,
-		bitfield: bitfield,
-		peerID:   peerID,
-		conn:     conn,
-		choked:   true,
-	}, nil
+	return client, nil
 }
 
+// ReadMessage waits for the next message of the peer, keep-alives are not returned
 func (c *Client) ReadMessage() (*Message, error) {
 
-	if c.conn == nil {
-		log.Error().Str("peer", c.peer.Address()).Msg("connection is nil")
-		return nil, fmt.Errorf("connection is nil")
+	message, ok := <-c.conn.Messages()
+
+	if !ok {
+		return nil, c.conn.Err()
 	}
 
-	return ReadMessage(c.conn)
+	return message, nil
 }
 
-func (c *Client) SendRequest(index, begin, length int) error {
-	message := NewRequestMessage(index, begin, length)
-	_, err := c.conn.Write(message.Serialize())
+// Waits for the next message of the peer, errMessageTimeout when none arrives in time
+func (c *Client) readMessageWithin(timeout time.Duration) (*Message, error) {
 
-	if err != nil {
-		log.Error().Err(err).Str("peer", c.peer.Address()).Str("message", message.String()).Msg("failed to write message")
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message, ok := <-c.conn.Messages():
+		if !ok {
+			return nil, c.conn.Err()
+		}
+
+		return message, nil
+	case <-timer.C:
+		return nil, errMessageTimeout
 	}
+}
 
-	return err
+// Close closes the connection to the peer
+func (c *Client) Close() error {
+	return c.conn.Close()
 }
 
-func (c *Client) SendHave(index int) error {
-	message := NewHaveMessage(index)
-	_, err := c.conn.Write(message.Serialize())
+// Queues the message for the writer of the connection, it is safe to call from any goroutine
+func (c *Client) send(message *Message) error {
+
+	err := c.conn.Send(message)
 
 	if err != nil {
-		log.Error().Err(err).Str("peer", c.peer.Address()).Str("message", message.String()).Msg("failed to write message")
+		log.Debug().Err(err).Str("peer", c.peer.Address()).Str("message", message.Type()).Msg("failed to send message")
 	}
 
 	return err
 }
 
-func (c *Client) SendInterested() error {
-	message := NewInterestedMessage()
-	_, err := c.conn.Write(message.Serialize())
+// Queues the message without waiting, a peer too slow to take it is disconnected
+func (c *Client) trySend(message *Message) error {
+
+	err := c.conn.TrySend(message)
 
 	if err != nil {
-		log.Error().Err(err).Str("peer", c.peer.Address()).Str("message", message.String()).Msg("failed to write message")
+		log.Debug().Err(err).Str("peer", c.peer.Address()).Str("message", message.Type()).Msg("failed to send message")
 	}
 
 	return err
 }
 
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.send(NewRequestMessage(index, begin, length))
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.send(NewCancelMessage(index, begin, length))
+}
+
+// SendHave never waits, it is broadcast to every peer when a piece completes
+func (c *Client) SendHave(index int) error {
+	return c.trySend(NewHaveMessage(index))
+}
+
+func (c *Client) SendInterested() error {
+	return c.send(NewInterestedMessage())
+}
+
 func (c *Client) SendNotInterested() error {
-	message := NewNotInterestedMessage()
-	_, err := c.conn.Write(message.Serialize())
+	return c.send(NewNotInterestedMessage())
+}
 
-	if err != nil {
-		log.Error().Err(err).Str("peer", c.peer.Address()).Str("message", message.String()).Msg("failed to write message")
+func (c *Client) SendUnchoke() error {
+	err := c.send(NewUnchokeMessage())
+
+	if err == nil {
+		c.amChoking.Store(false)
 	}
 
 	return err
 }
 
-func (c *Client) SendUnchoke() error {
-	message := NewUnchokeMessage()
-	_, err := c.conn.Write(message.Serialize())
+func (c *Client) SendChoke() error {
+	err := c.send(NewChokeMessage())
 
-	if err != nil {
-		log.Error().Err(err).Str("peer", c.peer.Address()).Str("message", message.String()).Msg("failed to write message")
+	if err == nil {
+		c.amChoking.Store(true)
 	}
 
 	return err
 }
+
+func (c *Client) SendBitfield(bitfield Bitfield) error {
+	return c.send(NewBitfieldMessage(bitfield))
+}
+
+func (c *Client) SendPiece(index, begin int, data []byte) error {
+	return c.send(NewPieceMessage(index, begin, data))
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peers close connections that stay silent for two minutes, a keep-alive is sent before that
+const defaultKeepAliveInterval = 90 * time.Second
+
+// A peer that sends nothing, not even a keep-alive, for so long is disconnected
+const defaultIdleTimeout = 3 * time.Minute
+
+// Messages waiting to be written before Send blocks and TrySend disconnects the peer
+const outboxSize = 64
+
+// How long closing the connection may take to write the messages still queued
+const closeFlushTimeout = time.Second
+
+// errMessageTimeout is returned when no message arrived in time, the connection stays open
+var errMessageTimeout = errors.New("no message received in time")
+
+// errSlowPeer closes a connection whose queue is full when a message cannot wait
+var errSlowPeer = errors.New("peer does not read its messages")
+
+// PeerConn is a peer wire connection driven by a reader and a writer goroutine
+// Messages sent are queued and written in order, so a slow write never blocks reading
+// Messages received are delivered on a channel, keep-alives are only used to keep the connection alive
+// The connection closes when its context is cancelled or on Close, once the queued messages are written,
+// and right away when reading or writing fails
+type PeerConn struct {
+	// KeepAliveInterval is how long the writer may stay idle before sending a keep-alive
+	KeepAliveInterval time.Duration
+	// IdleTimeout is how long the peer may stay silent before the connection is closed
+	IdleTimeout time.Duration
+
+	conn   net.Conn
+	outbox chan *Message
+	inbox  chan *Message
+	done   chan struct{}
+
+	// Closed to ask the writer to flush the queue and close the connection
+	closing      chan struct{}
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	closeOnce sync.Once
+	err       error
+}
+
+// NewPeerConn wraps a connection that completed its handshake, Start runs it once configured
+func NewPeerConn(conn net.Conn) *PeerConn {
+	return &PeerConn{
+		KeepAliveInterval: defaultKeepAliveInterval,
+		IdleTimeout:       defaultIdleTimeout,
+		conn:              conn,
+		outbox:            make(chan *Message, outboxSize),
+		inbox:             make(chan *Message),
+		done:              make(chan struct{}),
+		closing:           make(chan struct{}),
+	}
+}
+
+// Start runs the reader and the writer until the context is cancelled or the connection fails
+func (c *PeerConn) Start(ctx context.Context) {
+
+	stop := context.AfterFunc(ctx, func() {
+		c.shutdown(ctx.Err())
+	})
+
+	go func() {
+		<-c.done
+		stop()
+	}()
+
+	go c.readLoop()
+	go c.writeLoop()
+}
+
+// Send queues the message, it fails once the connection is closed
+func (c *PeerConn) Send(message *Message) error {
+
+	select {
+	case <-c.done:
+		return c.Err()
+	case <-c.closing:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case c.outbox <- message:
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-c.closing:
+		return net.ErrClosed
+	}
+}
+
+// TrySend queues the message without waiting, for messages sent to every peer from a loop that cannot stall
+// A peer whose queue is full does not keep up and is disconnected
+func (c *PeerConn) TrySend(message *Message) error {
+
+	select {
+	case <-c.done:
+		return c.Err()
+	case <-c.closing:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case c.outbox <- message:
+		return nil
+	default:
+		c.closeWithError(errSlowPeer)
+		return errSlowPeer
+	}
+}
+
+// Messages delivers the messages of the peer, it is closed when the connection closes
+func (c *PeerConn) Messages() <-chan *Message {
+	return c.inbox
+}
+
+// Done is closed when the connection closes
+func (c *PeerConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection closed, nil while it is open
+func (c *PeerConn) Err() error {
+
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *PeerConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the connection once the messages already queued are written, the reader and the writer stop
+func (c *PeerConn) Close() error {
+	c.shutdown(net.ErrClosed)
+	return nil
+}
+
+func (c *PeerConn) shutdown(err error) {
+	c.shutdownOnce.Do(func() {
+		c.shutdownErr = err
+		close(c.closing)
+	})
+}
+
+// Records the first reason the connection closed and closes it
+func (c *PeerConn) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+
+		if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Debug().Err(err).Msg("failed to close connection")
+		}
+	})
+}
+
+func (c *PeerConn) readLoop() {
+	defer close(c.inbox)
+
+	for {
+		err := c.conn.SetReadDeadline(time.Now().Add(c.IdleTimeout))
+
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+
+		message, err := ReadMessage(c.conn)
+
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+
+		if message.ID == MessageKeepAlive {
+			continue
+		}
+
+		select {
+		case c.inbox <- message:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *PeerConn) writeLoop() {
+
+	keepAlive := time.NewTimer(c.KeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var message *Message
+
+		select {
+		case <-c.done:
+			return
+		case <-c.closing:
+			c.flush()
+			c.closeWithError(c.shutdownErr)
+			return
+		case message = <-c.outbox:
+		case <-keepAlive.C:
+			message = &Message{ID: MessageKeepAlive}
+		}
+
+		// A peer that stopped reading would block the writer forever
+		err := c.conn.SetWriteDeadline(time.Now().Add(c.IdleTimeout))
+
+		if err == nil {
+			_, err = c.conn.Write(message.Serialize())
+		}
+
+		if err != nil {
+			log.Debug().Err(err).Str("message", message.Type()).Msg("failed to write message")
+			c.closeWithError(err)
+			return
+		}
+
+		keepAlive.Reset(c.KeepAliveInterval)
+	}
+}
+
+// Writes the messages left in the queue, giving up on a peer that does not read them in time
+func (c *PeerConn) flush() {
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout)); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case message := <-c.outbox:
+			if _, err := c.conn.Write(message.Serialize()); err != nil {
+				log.Debug().Err(err).Str("message", message.Type()).Msg("failed to flush message")
+				return
+			}
+		default:
+			return
+		}
+	}
+}
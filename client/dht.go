@@ -0,0 +1,67 @@
+package client
+
+import (
+	"Torrent-Client/dht"
+	"context"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// How often the DHT is asked again for the peers of the torrent, announcing us again on the way
+const dhtAnnounceInterval = 15 * time.Minute
+
+// Delay before trying again when a lookup found no peer, the table may still be filling up
+const dhtRetryInterval = time.Minute
+
+// Looks up the peers of the torrent on the DHT until the context is cancelled and sends them on the channel
+// With a port the nodes closest to the info hash are told we listen on it, without one we only look
+func lookupDHTPeers(ctx context.Context, node *dht.Node, infoHash [20]byte, port uint16, found chan<- []Peer) {
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	bootstrap := true
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		// Joins the network on the first lookup and whenever the nodes known stopped answering
+		if bootstrap {
+			if err := node.Bootstrap(ctx); err != nil {
+				log.Debug().Err(err).Msg("dht bootstrap failed")
+			}
+		}
+
+		var peers []Peer
+		var err error
+
+		if port != 0 {
+			peers, err = node.Announce(ctx, infoHash, port)
+		} else {
+			peers, err = node.GetPeers(ctx, infoHash)
+		}
+
+		if err != nil {
+			log.Debug().Err(err).Int("peers", len(peers)).Msg("dht lookup failed")
+		}
+
+		bootstrap = err != nil
+
+		if len(peers) == 0 {
+			timer.Reset(dhtRetryInterval)
+			continue
+		}
+
+		timer.Reset(dhtAnnounceInterval)
+
+		select {
+		case found <- peers:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,19 +1,52 @@
 package client
 
 import (
+	"Torrent-Client/dht"
+	"Torrent-Client/lsd"
+	"Torrent-Client/mse"
+	"Torrent-Client/storage"
 	"Torrent-Client/torrent"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"net"
-	"os"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Port is the default port announced to the trackers
 const Port uint16 = 6881
 
+// How long a peer may take to send a block we asked for
+const blockTimeout = 30 * time.Second
+
+// Bounds of the request queue of a peer, in between it follows the rate of the peer
+const minRequestQueue = 4
+const maxRequestQueue = 250
+
+// The request queue of a peer holds what it sends in this time at its measured rate
+const requestQueueTime = 2 * time.Second
+
+// How long a worker whose peer has no piece we miss waits before asking the picker again
+const pieceWaitInterval = 5 * time.Second
+
+// How often peers waiting after a failed dial are looked at again
+const peerRetryInterval = 5 * time.Second
+
+// How often the resume file is written while downloading
+const resumeSaveInterval = 10 * time.Second
+
+// How long a download with no peer connected or left to dial waits for the trackers, the DHT or the local network to find one
+const defaultPeerWaitTimeout = 2 * time.Minute
+
+// ErrNoPeers is returned when no peer could be found to finish the download
+var ErrNoPeers = errors.New("no peers")
+
 type PieceWork struct {
 	index  int
 	hash   [20]byte
@@ -25,25 +58,49 @@ type PieceResult struct {
 	data  []byte
 }
 
-type PieceProgress struct {
-	index      int
-	client     *Client
-	buffer     []byte
-	downloaded int
-	requested  int
-	backlog    int
-}
-
 type DownloadOptions struct {
-	path string
+	// Path is the directory where the torrent content is written
+	Path string
+	// Port is the port we listen on for peers and announce to the trackers, defaults to Port
+	Port uint16
+	// Seed keeps serving the torrent to other peers once it is complete, until the context is cancelled
+	Seed bool
+	// Peers are dialed before the trackers answer, the peers of a magnet link for example
+	Peers []Peer
+	// DHT looks up peers besides the trackers and announces our port to the nodes, nil leaves the DHT out
+	DHT *dht.Node
+	// LSD announces the torrent to the local network, the peers announcing it there are dialed first, nil leaves it out
+	LSD *lsd.Service
+	// Encryption obfuscates the connections with MSE, incoming and outgoing, the zero value leaves it out
+	Encryption mse.Policy
+	// PeerWaitTimeout is how long the download, or the metadata fetch, waits for new peers once it has none left, defaults to two minutes
+	PeerWaitTimeout time.Duration
+	// PeerExchangeInterval is how often the connected peers are sent the peers we know, defaults to a minute
+	PeerExchangeInterval time.Duration
 }
 
 type DownloadInfo struct {
-	peerID       [20]byte
-	peers        []Peer
-	pieceWork    chan *PieceWork
+	session      *Session
+	peers        *peerManager
 	pieceResults chan *PieceResult
-	torrent      *torrent.TorrentFile
+	// Workers report the peer they were given when they stop, so a replacement can be dialed
+	workerExits chan Peer
+	encryption  mse.Policy
+}
+
+// Counters reported to the trackers, updated while transferring and read by the announcer
+type transferStats struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	left       atomic.Int64
+}
+
+func (s *transferStats) snapshot() torrent.TransferStats {
+	return torrent.TransferStats{
+		Uploaded:   s.uploaded.Load(),
+		Downloaded: s.downloaded.Load(),
+		Left:       s.left.Load(),
+	}
 }
 
 func (pw *PieceWork) validate(data []byte) error {
@@ -59,39 +116,28 @@ func (pw *PieceWork) validate(data []byte) error {
 	return nil
 }
 
-func (pieceProgress *PieceProgress) readMessage() error {
-	message, err := pieceProgress.client.ReadMessage()
+// Handles the messages a download connection receives besides the pieces it asked for
+func handleWorkerMessage(session *Session, client *Client, message *Message) error {
 
-	if err != nil {
-		return err
-	}
-
-	if message.ID == MessageKeepAlive {
+	if session.handlePeerMessage(client, message) {
 		return nil
 	}
 
 	switch message.ID {
-	case MessageChoke:
-		pieceProgress.client.choked = true
-	case MessageUnchoke:
-		pieceProgress.client.choked = false
-	case MessageHave:
-		index, err := ParseHave(*message)
+	case MessageRequest:
+		index, begin, length, err := ParseRequest(*message)
 
 		if err != nil {
-			log.Error().Err(err).Msg("could not parse have message")
+			return nil
 		}
 
-		pieceProgress.client.bitfield.SetPiece(index)
+		// Requests are answered right away, so there is nothing left to cancel
+		return session.serveRequest(client, blockRequest{index, begin, length})
+	case MessageCancel:
+	case MessageReject:
+		session.handleReject(client, message)
 	case MessagePiece:
-		index, _, err := ParsePiece(pieceProgress.index, pieceProgress.buffer, *message)
-
-		if err != nil {
-			log.Error().Err(err).Msg("could not parse piece message")
-		}
-
-		pieceProgress.downloaded += index
-		pieceProgress.backlog--
+		log.Debug().Str("peer", client.peer.Address()).Msg("ignoring unrequested piece")
 	default:
 		log.Warn().Int("id", int(message.ID)).Msg("unexpected message")
 	}
@@ -99,236 +145,591 @@ func (pieceProgress *PieceProgress) readMessage() error {
 	return nil
 }
 
-func DownloadTorrent(t *torrent.TorrentFile, opts DownloadOptions) error {
+// Reads one message while the peer has nothing for us to request, a have or unchoke message may change that
+// Timing out is not an error, it lets the worker look for blocks other peers gave back
+func waitForPieces(session *Session, client *Client) error {
 
-	downloadInfo := &DownloadInfo{
-		torrent: t,
-		peerID:  [20]byte{},
+	message, err := client.readMessageWithin(pieceWaitInterval)
+
+	if errors.Is(err, errMessageTimeout) {
+		return nil
 	}
 
-	log.Debug().Str("n ame", t.Name).Msg("starting download for torrent")
+	if err != nil {
+		return err
+	}
+
+	return handleWorkerMessage(session, client, message)
+}
+
+func DownloadTorrent(t *torrent.TorrentFile, opts DownloadOptions) error {
+	return DownloadTorrentContext(context.Background(), t, opts)
+}
+
+// DownloadTorrentContext downloads the torrent until it completes or the context is cancelled
+// The trackers are announced to for the whole download and told when it completes and when it stops
+// Peers connecting to us are served the pieces already on disk, with the Seed option until the context is cancelled
+func DownloadTorrentContext(ctx context.Context, t *torrent.TorrentFile, opts DownloadOptions) error {
 
-	_, err := rand.Read(downloadInfo.peerID[:])
+	log.Debug().Str("name", t.Name).Msg("starting download for torrent")
+
+	peerID, err := newPeerID()
 
 	if err != nil {
-		log.Error().Err(err).Msg("failed to generate peer ID")
 		return err
 	}
 
-	peers, err := t.RequestPeers(downloadInfo.peerID, Port)
+	log.Debug().Str("name", t.Name).Str("path", opts.Path).Msg("opening files to save data from torrent")
+
+	// Checked before opening the storage, which creates the missing files
+	existing := hasExistingFiles(t, opts.Path)
+
+	store, err := storage.NewStorage(t, opts.Path)
 
 	if err != nil {
-		log.Error().Err(err).Msg("failed to request peers")
+		log.Error().Err(err).Str("name", t.Name).Msg("failed to open storage")
 		return err
 	}
 
-	downloadInfo.peers = peers
+	defer func(store *storage.Storage) {
+		err := store.Close()
+		if err != nil {
+			log.Error().Err(err).Str("name", t.Name).Msg("failed to close files")
+		} else {
+			log.Debug().Str("name", t.Name).Msg("files closed")
+		}
+	}(store)
 
-	// Piece work channel is used to send work to workers, each worker will download a piece
-	// Results channel is used to send the downloaded piece back to the main thread
-	downloadInfo.pieceWork = make(chan *PieceWork, len(t.PiecesHash))
-	downloadInfo.pieceResults = make(chan *PieceResult)
+	resumePath := ResumePath(t, opts.Path)
+	session := NewSession(t, store, loadCompletedPieces(t, store, resumePath, existing), peerID)
+	session.PeerExchangeInterval = opts.PeerExchangeInterval
 
-	// Create work for each piece
-	for index, hash := range t.PiecesHash {
-		length := int(t.CalculatePieceSize(index))
-		downloadInfo.pieceWork <- &PieceWork{index, hash, length}
+	downloadInfo := &DownloadInfo{
+		session:    session,
+		encryption: opts.Encryption,
 	}
 
-	// Start workers to download pieces
-	// Each worker will download a piece and send the result back to the main thread
-	for _, _ = range peers {
-		go startDownloadWorker(downloadInfo)
+	// Flushes the files before recording the completed pieces, so the resume file never claims data that is not on disk
+	saveResume := func() {
+		if err := store.Sync(); err != nil {
+			log.Error().Err(err).Str("name", t.Name).Msg("failed to flush files")
+			return
+		}
+
+		if err := SaveResume(resumePath, ResumeData{InfoHash: t.InfoHash, Bitfield: session.Bitfield()}); err != nil {
+			log.Error().Err(err).Str("name", t.Name).Msg("failed to save resume file")
+		}
 	}
 
-	// Save data into a buffer till all pieces are downloaded
+	defer saveResume()
 
-	buffer := make([]byte, t.Length)
 	piecesFinished := 0
+	left := t.Length
+
+	for index := range t.PiecesHash {
+		if session.HasPiece(index) {
+			piecesFinished++
+			left -= t.CalculatePieceSize(index)
+		}
+	}
+
+	session.stats.left.Store(left)
+
+	if piecesFinished == len(t.PiecesHash) && !opts.Seed {
+		log.Info().Str("name", t.Name).Msg("all pieces already on disk")
+		return nil
+	}
+
+	port := opts.Port
+
+	if port == 0 {
+		port = Port
+	}
+
+	// Downloading works without a listener, seeding does not
+	server, err := NewServer(port)
+	listenPort := uint16(0)
+
+	if err != nil && opts.Seed {
+		return err
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Uint16("port", port).Msg("not accepting peers, downloading only")
+	} else {
+		session.extensions.SetPort(server.Port())
+		server.SetEncryption(opts.Encryption)
+		server.AddSession(session)
+		listenPort = server.Port()
+
+		defer func(server *Server) {
+			if err := server.Close(); err != nil {
+				log.Error().Err(err).Msg("failed to close listener")
+			}
+		}(server)
+	}
+
+	// The announcer keeps running until the download returns, cancelling the context sends the stopped event
+	ctx, cancel := context.WithCancel(ctx)
+	announcer := torrent.NewAnnouncer(t.AnnounceTiers())
+	announcedPeers := make(chan []Peer)
+	announcerDone := make(chan struct{})
+
+	request := torrent.AnnounceRequest{
+		InfoHash: t.InfoHash,
+		PeerID:   peerID,
+		Port:     port,
+		Key:      binary.BigEndian.Uint32(peerID[16:]),
+		IPv6:     globalIPv6Address(),
+	}
+
+	go func() {
+		defer close(announcerDone)
+		announcer.Run(ctx, request, session.stats.snapshot, announcedPeers)
+	}()
+
+	// The choker decides which of the connected peers we upload to
+	go session.Run(ctx)
+
+	// Peers of the DHT come on their own channel, nil when the DHT is left out
+	var dhtPeers chan []Peer
+
+	if opts.DHT != nil {
+		dhtPeers = make(chan []Peer)
+		go lookupDHTPeers(ctx, opts.DHT, t.InfoHash, listenPort, dhtPeers)
+	}
+
+	// Peers of the local network are dialed ahead of the others, nil when LSD is left out
+	var localPeers chan []Peer
+
+	if opts.LSD != nil {
+		localPeers = make(chan []Peer)
+		go discoverLocalPeers(ctx, opts.LSD, t.InfoHash, listenPort, localPeers)
+	}
+
+	defer func(announcer *torrent.Announcer) {
+		cancel()
+		<-announcerDone
+
+		if err := announcer.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close trackers")
+		}
+	}(announcer)
+
+	if piecesFinished == len(t.PiecesHash) {
+		announcer.Complete()
+		return seed(ctx, session, announcedPeers, dhtPeers, localPeers)
+	}
+
+	log.Info().Str("name", t.Name).Int("completed", piecesFinished).Int("pieces", len(t.PiecesHash)).Msg("resuming download")
+
+	// Workers ask the picker of the session which piece to download
+	// Results channel is used to send the downloaded piece back to the main thread
+	downloadInfo.peers = newPeerManager(maxConnections)
+	downloadInfo.pieceResults = make(chan *PieceResult)
+	downloadInfo.workerExits = make(chan Peer)
+
+	// Start a worker for every peer the manager hands out, each one downloads pieces from its own peer
+	// and sends them back to the main thread
+	workers := 0
+	var workerGroup sync.WaitGroup
+
+	// Workers read and write the storage, they are stopped and waited for before it closes
+	defer func() {
+		cancel()
+		workerGroup.Wait()
+	}()
+
+	startWorkers := func() {
+		for {
+			peer, ok := downloadInfo.peers.next()
+
+			if !ok {
+				return
+			}
+
+			workers++
+			workerGroup.Add(1)
+
+			go func() {
+				defer workerGroup.Done()
+				startDownloadWorker(ctx, downloadInfo, peer)
+			}()
+		}
+	}
+
+	downloadInfo.peers.addPeers(opts.Peers)
+	startWorkers()
+
+	// Peers that failed to dial become ready again after their retry delay
+	retryTicker := time.NewTicker(peerRetryInterval)
+	defer retryTicker.Stop()
+
+	lastSave := time.Now()
+
+	peerWait := opts.PeerWaitTimeout
+
+	if peerWait <= 0 {
+		peerWait = defaultPeerWaitTimeout
+	}
+
+	// Armed while no peer is connected or left to dial, the download fails when no new peer showed up in time
+	var noPeersTimer *time.Timer
+	var noPeers <-chan time.Time
 
 	// Wait for all pieces to be downloaded
 	for piecesFinished < len(t.PiecesHash) {
 
+		starving := workers == 0 && !downloadInfo.peers.hasPeers()
+
+		if starving && noPeers == nil {
+			log.Debug().Str("name", t.Name).Dur("timeout", peerWait).Msg("no peer left, waiting for new ones")
+			noPeersTimer = time.NewTimer(peerWait)
+			noPeers = noPeersTimer.C
+		} else if !starving && noPeers != nil {
+			noPeersTimer.Stop()
+			noPeers = nil
+		}
+
+		var res *PieceResult
+
 		// Get the downloaded piece
-		res := <-downloadInfo.pieceResults
+		select {
+		case res = <-downloadInfo.pieceResults:
+		case peers := <-announcedPeers:
+			added := downloadInfo.peers.addPeers(peers)
+			log.Debug().Str("name", t.Name).Int("peers", len(peers)).Int("new", added).Msg("received peers from tracker")
+			startWorkers()
+			continue
+		case peers := <-localPeers:
+			added := downloadInfo.peers.addPreferredPeers(peers)
+			log.Debug().Str("name", t.Name).Int("peers", len(peers)).Int("new", added).Msg("received peers from the local network")
+			startWorkers()
+			continue
+		case peers := <-dhtPeers:
+			added := downloadInfo.peers.addPeers(peers)
+			log.Debug().Str("name", t.Name).Int("peers", len(peers)).Int("new", added).Msg("received peers from the dht")
+			startWorkers()
+			continue
+		case peers := <-session.discovered:
+			added := downloadInfo.peers.addPeers(peers)
+			log.Debug().Str("name", t.Name).Int("peers", len(peers)).Int("new", added).Msg("received peers from other peers")
+			startWorkers()
+			continue
+		case <-retryTicker.C:
+			startWorkers()
+			continue
+		case <-downloadInfo.workerExits:
+			workers--
+			startWorkers()
+			continue
+		case <-noPeers:
+			log.Error().Str("name", t.Name).Int("finished", piecesFinished).Dur("timeout", peerWait).Msg("no peer found to finish the download")
+			return fmt.Errorf("%w found in %s: %d of %d pieces finished", ErrNoPeers, peerWait, piecesFinished, len(t.PiecesHash))
+		case <-ctx.Done():
+			log.Info().Str("name", t.Name).Int("finished", piecesFinished).Msg("download stopped")
+			return ctx.Err()
+		}
+
+		// Endgame downloads the last pieces from several peers, only the first copy counts
+		if session.HasPiece(res.index) {
+			continue
+		}
 
-		// Calculate the begin and end of the piece in the buffer
-		begin, end := t.CalculateBoundsForPiece(res.index)
+		// Write the verified piece straight to its place on disk
+		err := store.WritePiece(res.index, res.data)
 
-		// Copy the downloaded piece into the buffer
-		copy(buffer[begin:end], res.data)
+		if err != nil {
+			log.Error().Err(err).Str("name", t.Name).Int("index", res.index).Msg("failed to write piece")
+			return err
+		}
 
+		// Only announced to the peers once it can be read back from disk
+		session.completePiece(res.index)
 		piecesFinished++
 
+		session.stats.downloaded.Add(int64(len(res.data)))
+		session.stats.left.Add(-int64(len(res.data)))
+
+		if time.Since(lastSave) > resumeSaveInterval {
+			saveResume()
+			lastSave = time.Now()
+		}
+
 		percent := float64(piecesFinished) / float64(len(t.PiecesHash)) * 100
-		totalWorkers := runtime.NumGoroutine() - 1
 
-		log.Info().Str("name", t.Name).Float64("percent", percent).Int("workers", totalWorkers).Msg("download progress")
+		log.Info().Str("name", t.Name).Float64("percent", percent).Int("workers", workers).Msg("download progress")
 	}
 
-	// Close the piece work channel to signal workers to stop
-	close(downloadInfo.pieceWork)
+	announcer.Complete()
 
-	log.Debug().Str("name", t.Name).Msg("creating file to save data from torrent")
+	log.Info().Str("name", t.Name).Msg("download completed")
+
+	if opts.Seed {
+		saveResume()
+		return seed(ctx, session, announcedPeers, dhtPeers, localPeers)
+	}
+
+	return nil
+}
+
+// Peer IDs are random, a new one for every download
+func newPeerID() ([20]byte, error) {
 
-	output, err := os.Create(opts.path)
+	peerID := [20]byte{}
+
+	_, err := rand.Read(peerID[:])
 
 	if err != nil {
-		log.Error().Err(err).Str("name", t.Name).Msg("failed to create file")
-		return err
+		log.Error().Err(err).Msg("failed to generate peer ID")
+		return peerID, err
 	}
 
-	defer func(output *os.File) {
-		err := output.Close()
-		if err != nil {
-			log.Error().Err(err).Str("name", t.Name).Msg("failed to close file")
-		} else {
-			log.Debug().Str("name", t.Name).Msg("file closed")
+	return peerID, nil
+}
+
+// Serves the complete torrent until the context is cancelled
+// Peers from the re-announces, the DHT and the local network are not dialed, seeders wait for leechers to connect
+func seed(ctx context.Context, session *Session, announcedPeers <-chan []Peer, dhtPeers <-chan []Peer, localPeers <-chan []Peer) error {
+
+	log.Info().Str("name", session.torrent.Name).Msg("seeding")
+
+	for {
+		select {
+		case <-announcedPeers:
+		case <-dhtPeers:
+		case <-localPeers:
+		case <-ctx.Done():
+			log.Info().Str("name", session.torrent.Name).Int64("uploaded", session.Uploaded()).Msg("seeding stopped")
+			return ctx.Err()
 		}
-	}(output)
+	}
+}
 
-	log.Debug().Str("name", t.Name).Msg("writing data to file")
+// Finds a global IPv6 address of this host to advertise to the trackers, nil when the host has none
+// Link-local and unique local addresses are skipped since remote peers cannot reach them
+func globalIPv6Address() net.IP {
 
-	_, err = output.Write(buffer)
+	addresses, err := net.InterfaceAddrs()
 
 	if err != nil {
-		log.Error().Err(err).Str("name", t.Name).Msg("failed to write file")
-		return err
+		log.Debug().Err(err).Msg("could not list interface addresses")
+		return nil
 	}
 
-	log.Info().Str("name", t.Name).Msg("download completed")
+	for _, address := range addresses {
+		network, ok := address.(*net.IPNet)
+
+		if !ok || network.IP.To4() != nil {
+			continue
+		}
+
+		if network.IP.IsGlobalUnicast() && !network.IP.IsPrivate() {
+			return network.IP
+		}
+	}
 
 	return nil
 }
 
-func startDownloadWorker(dwInfo *DownloadInfo) {
+// Downloads pieces from a single peer until the work runs out, the connection fails or the download returns
+// The peer manager learns how the peer behaved, a peer sending corrupt data is banned
+func startDownloadWorker(ctx context.Context, dwInfo *DownloadInfo, peer Peer) {
 
-	if len(dwInfo.peers) == 0 {
-		log.Error().Msg("no peers available")
-		return
-	}
+	defer func() {
+		select {
+		case dwInfo.workerExits <- peer:
+		case <-ctx.Done():
+		}
+	}()
+
+	session := dwInfo.session
 
-	client, err := NewClient(dwInfo.peers[0], dwInfo.torrent.InfoHash, dwInfo.peerID)
+	client, err := NewClientContext(ctx, peer, session.torrent.InfoHash, session.peerID, len(session.torrent.PiecesHash), dwInfo.encryption)
 
 	if err != nil {
-		log.Error().Err(err).Msg("failed to create client")
+		log.Debug().Err(err).Str("peer", peer.Address()).Msg("failed to create client")
+		dwInfo.peers.dialFailed(peer)
 		return
 	}
 
-	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
+	banned := false
+
+	defer func(client *Client) {
+		// Blocks received make the connection useful, a peer with nothing we need is not redialed right away
+		if !banned {
+			dwInfo.peers.disconnected(peer, client.downloaded.Load() > 0)
+		}
+
+		if err := client.Close(); err != nil {
 			log.Error().Err(err).Msg("failed to close connection")
 		} else {
 			log.Debug().Msg("connection closed")
 		}
-	}(client.conn)
+	}(client)
+
+	if err := session.addClient(client); err != nil {
+		return
+	}
 
-	err = client.SendUnchoke()
+	defer session.removeClient(client)
 
-	if err != nil {
-		log.Error().Err(err).Msg("failed to send unchoke message")
+	if err := client.startExtensions(session.extensions); err != nil {
 		return
 	}
 
 	err = client.SendInterested()
 
-	for pieceWork := range dwInfo.pieceWork {
+	if err != nil {
+		log.Error().Err(err).Msg("failed to send interested message")
+		return
+	}
 
-		// If bitfield does not have the piece, put it back in the queue
-		if !client.bitfield.HasPiece(pieceWork.index) {
-			dwInfo.pieceWork <- pieceWork
-			continue
+	// Requests left on the connection are given back so other peers can complete their pieces
+	defer session.picker.releaseRequests(client)
+
+	rate := newRateMeter()
+
+	// Workers stop once the last piece is on disk
+	for !session.Complete() {
+
+		// Keep the queue of the peer full, the requests may span several pieces
+		// While choked only the allowed fast pieces of the peer may be requested
+		pieces := client.bitfield
+
+		if client.choked {
+			pieces = client.allowedFastPieces()
 		}
 
-		buffer, err := downloadPiece(client, pieceWork)
+		if hasAnyPiece(pieces) {
+			missing := rate.queueDepth() - session.picker.outstanding(client)
 
-		// If fails to download piece, put it back in the queue
-		if err != nil {
-			log.Error().Err(err).Msg("failed to download piece")
-			dwInfo.pieceWork <- pieceWork
-			continue
+			for _, request := range session.picker.pickBlocks(client, pieces, max(missing, 0)) {
+				if err := client.SendRequest(request.index, request.begin, request.length); err != nil {
+					return
+				}
+			}
 		}
 
-		// Validate the piece, if it fails, put it back in the queue
-		if err := pieceWork.validate(buffer); err != nil {
-			log.Error().Err(err).Msg("failed to validate piece")
-			dwInfo.pieceWork <- pieceWork
+		if session.picker.outstanding(client) == 0 {
+			if err := waitForPieces(session, client); err != nil {
+				log.Debug().Err(err).Str("peer", peer.Address()).Msg("peer disconnected while waiting for pieces")
+				return
+			}
+
 			continue
 		}
 
-		err = client.SendHave(pieceWork.index)
+		// A peer that does not answer for so long is dropped, its requests go to the others
+		message, err := client.readMessageWithin(blockTimeout)
 
 		if err != nil {
-			log.Error().Err(err).Msg("failed to send have message")
+			log.Debug().Err(err).Str("peer", peer.Address()).Msg("failed to read message")
+			return
 		}
 
-		dwInfo.pieceResults <- &PieceResult{pieceWork.index, buffer}
-	}
-}
+		switch message.ID {
+		case MessagePiece:
+			piece, err := receiveBlock(session, client, rate, message)
 
-func downloadPiece(client *Client, pieceWork *PieceWork) ([]byte, error) {
-
-	pieceProgress := PieceProgress{
-		index:  pieceWork.index,
-		client: client,
-		buffer: make([]byte, pieceWork.length),
-	}
-
-	err := client.conn.SetDeadline(time.Now().Add(defaultPeerTimeout))
+			if err != nil {
+				return
+			}
 
-	if err != nil {
-		log.Error().Err(err).Msg("failed to set deadline")
-		return nil, err
-	}
+			if piece == nil {
+				continue
+			}
 
-	defer func(conn net.Conn, t time.Time) {
-		err := conn.SetDeadline(t)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to reset deadline")
-		}
-	}(client.conn, time.Time{})
+			work := PieceWork{piece.index, session.torrent.PiecesHash[piece.index], len(piece.data)}
 
-	for pieceProgress.downloaded < pieceWork.length {
+			// Download the piece again from scratch, the peer is banned when it sent every block
+			if err := work.validate(piece.data); err != nil {
+				session.picker.pieceFailed(piece.index)
 
-		if pieceProgress.client.choked {
+				if len(piece.contributors) == 1 && piece.contributors[0] == client {
+					log.Warn().Err(err).Str("peer", peer.Address()).Msg("banning peer after a piece failed validation")
+					dwInfo.peers.ban(peer)
+					banned = true
+					return
+				}
 
-			err := pieceProgress.readMessage()
+				log.Warn().Err(err).Int("peers", len(piece.contributors)).Msg("piece from several peers failed validation")
+				continue
+			}
 
-			if err != nil {
-				log.Error().Err(err).Msg("failed to read message")
-				return nil, err
+			select {
+			case dwInfo.pieceResults <- &PieceResult{piece.index, piece.data}:
+			case <-ctx.Done():
+				return
+			}
+		case MessageChoke:
+			// The peer drops our requests when it chokes us, with the fast extension it rejects the ones it drops
+			if err := handleWorkerMessage(session, client, message); err != nil {
+				return
 			}
 
-			continue
+			if !client.fast() {
+				session.picker.releaseRequests(client)
+			}
+		default:
+			if err := handleWorkerMessage(session, client, message); err != nil {
+				return
+			}
 		}
+	}
+}
 
-		if pieceProgress.backlog < maxRequests && pieceProgress.requested < pieceWork.length {
+// Stores a block in its piece, the other peers asked for the same block during the endgame get a cancel
+// Returns the piece when this block completed it
+func receiveBlock(session *Session, client *Client, rate *rateMeter, message *Message) (*assembledPiece, error) {
 
-			blockSize := maxBlockSize
+	index, begin, data, err := ParseBlock(*message)
 
-			if pieceWork.length-pieceProgress.requested < blockSize {
-				blockSize = pieceWork.length - pieceProgress.requested
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			err := client.SendRequest(pieceWork.index, pieceProgress.requested, blockSize)
+	client.downloaded.Add(int64(len(data)))
+	rate.add(len(data))
 
-			if err != nil {
-				log.Error().Err(err).Msg("failed to send request")
-				return nil, err
-			}
+	others, piece := session.picker.blockReceived(client, index, begin, data)
 
-			pieceProgress.requested += blockSize
-			pieceProgress.backlog++
+	for _, other := range others {
+		if err := other.SendCancel(index, begin, len(data)); err != nil {
+			log.Debug().Err(err).Str("peer", other.peer.Address()).Msg("failed to send cancel")
 		}
+	}
 
-		err := pieceProgress.readMessage()
+	return piece, nil
+}
 
-		if err != nil {
-			log.Error().Err(err).Msg("failed to read message")
-			return nil, err
-		}
+// Measures how fast a peer sends us data, as a moving average updated every second
+type rateMeter struct {
+	rate  float64
+	bytes int
+	since time.Time
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{since: time.Now()}
+}
+
+func (m *rateMeter) add(bytes int) {
+
+	m.bytes += bytes
+
+	elapsed := time.Since(m.since)
+
+	if elapsed < time.Second {
+		return
 	}
 
-	return pieceProgress.buffer, nil
+	m.rate = (m.rate + float64(m.bytes)/elapsed.Seconds()) / 2
+	m.bytes = 0
+	m.since = time.Now()
+}
+
+// Requests to keep in flight so the peer always has something to send during the time a request takes
+func (m *rateMeter) queueDepth() int {
+	return min(minRequestQueue+int(m.rate*requestQueueTime.Seconds())/maxBlockSize, maxRequestQueue)
 }
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"Torrent-Client/mse"
+	"context"
+	"github.com/rs/zerolog/log"
+	"net"
+	"time"
+)
+
+// Dials the peer and runs the MSE handshake the policy asks for, the BitTorrent handshake follows on the connection
+// Many clients do not support MSE, with Prefer a peer that fails it is dialed again for a plain connection
+func dialPeer(ctx context.Context, peer Peer, infoHash [20]byte, policy mse.Policy) (net.Conn, error) {
+
+	// Dial is a function that connects to the address on the named network
+	// The network must be "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "ip", "ip4", "ip6"
+	// IPv6 peers are dialed on tcp6, the address is bracketed by Address
+	dialer := net.Dialer{Timeout: defaultPeerTimeout}
+
+	conn, err := dialer.DialContext(ctx, peer.Network(), peer.Address())
+
+	if err != nil || policy == mse.Disabled {
+		return conn, err
+	}
+
+	encrypted, err := initiateEncryption(conn, infoHash, policy)
+
+	if err == nil {
+		return encrypted, nil
+	}
+
+	if err := conn.Close(); err != nil {
+		log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to close connection")
+	}
+
+	if policy == mse.Require {
+		log.Debug().Err(err).Str("peer", peer.Address()).Msg("encrypted handshake failed")
+		return nil, err
+	}
+
+	log.Debug().Err(err).Str("peer", peer.Address()).Msg("encrypted handshake failed, dialing a plain connection")
+
+	return dialer.DialContext(ctx, peer.Network(), peer.Address())
+}
+
+func initiateEncryption(conn net.Conn, infoHash [20]byte, policy mse.Policy) (net.Conn, error) {
+
+	err := conn.SetDeadline(time.Now().Add(defaultPeerTimeout))
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := mse.Initiate(conn, infoHash, policy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+// SetEncryption sets the policy of the peers connecting to us, Prefer accepts both encrypted and plain handshakes
+func (s *Server) SetEncryption(policy mse.Policy) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.encryption = policy
+}
+
+// Runs the MSE handshake of an incoming connection as the policy asks, the info hashes of the sessions are its keys
+// Returns the connection the BitTorrent handshake follows on
+func (s *Server) acceptEncryption(conn net.Conn) (net.Conn, error) {
+
+	s.mutex.Lock()
+	policy := s.encryption
+	infoHashes := make([][20]byte, 0, len(s.sessions))
+
+	for infoHash := range s.sessions {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	s.mutex.Unlock()
+
+	if policy == mse.Disabled {
+		return conn, nil
+	}
+
+	return mse.Accept(conn, infoHashes, policy)
+}
@@ -0,0 +1,418 @@
+package client
+
+import (
+	"Torrent-Client/bencode"
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+)
+
+// Extension protocol (BEP 10)
+// Peers that set the reserved bit exchange an extended handshake right after the bitfield
+// Its m dictionary maps the name of each extension the sender supports to the extended message ID it wants to receive
+// its messages with, so the ID of a message depends on who receives it
+const extendedHandshakeID uint8 = 0
+
+// Client name advertised in the extended handshake
+const clientVersion = "Torrent-Client"
+
+// ExtendedHandshake is the bencoded dictionary sent with the extended message ID 0
+type ExtendedHandshake struct {
+	// Extensions maps the extension names to the extended message IDs the sender receives them with (m)
+	Extensions map[string]uint8
+	// Version is the name and version of the client (v)
+	Version string
+	// Port is the port the sender listens on, zero when unknown (p)
+	Port uint16
+	// RequestQueue is how many requests the sender queues before dropping them (reqq)
+	RequestQueue int
+	// MetadataSize is the size of the info dictionary, for ut_metadata (metadata_size)
+	MetadataSize int
+}
+
+// Extension is a protocol extension plugged into the extension protocol under its name
+type Extension interface {
+	// PeerHandshake is called when the extended handshake of a peer supporting the extension arrives
+	PeerHandshake(client *Client, handshake *ExtendedHandshake)
+	// HandleMessage handles a message of the extension, the payload follows the extended message ID
+	HandleMessage(client *Client, payload []byte) error
+}
+
+// ExtensionRegistry holds the extensions we support, the order of registration gives their extended message IDs
+type ExtensionRegistry struct {
+	mutex        sync.RWMutex
+	names        []string
+	extensions   map[string]Extension
+	port         uint16
+	metadataSize int
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		extensions: make(map[string]Extension),
+	}
+}
+
+// Register plugs the extension in, peers learn about it from the extended handshakes sent afterwards
+func (r *ExtensionRegistry) Register(name string, extension Extension) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.extensions[name]; ok {
+		return fmt.Errorf("extension %q already registered", name)
+	}
+
+	// The extended message IDs fit a byte and zero is the handshake
+	if len(r.names) == 255 {
+		return fmt.Errorf("too many extensions")
+	}
+
+	r.names = append(r.names, name)
+	r.extensions[name] = extension
+
+	return nil
+}
+
+// SetPort sets the listen port advertised in the extended handshake
+func (r *ExtensionRegistry) SetPort(port uint16) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.port = port
+}
+
+// SetMetadataSize sets the size of the info dictionary advertised in the extended handshake
+func (r *ExtensionRegistry) SetMetadataSize(size int) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metadataSize = size
+}
+
+// Handshake builds the extended handshake we send to peers
+func (r *ExtensionRegistry) Handshake() *ExtendedHandshake {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	handshake := &ExtendedHandshake{
+		Extensions:   make(map[string]uint8, len(r.names)),
+		Version:      clientVersion,
+		Port:         r.port,
+		RequestQueue: maxQueuedRequests,
+		MetadataSize: r.metadataSize,
+	}
+
+	for i, name := range r.names {
+		handshake.Extensions[name] = uint8(i + 1)
+	}
+
+	return handshake
+}
+
+// Returns the extension peers send us messages of with the extended message ID
+func (r *ExtensionRegistry) lookup(id uint8) (string, Extension, bool) {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if id == extendedHandshakeID || int(id) > len(r.names) {
+		return "", nil, false
+	}
+
+	name := r.names[id-1]
+
+	return name, r.extensions[name], true
+}
+
+// Returns the registered extensions the peer supports according to its handshake
+func (r *ExtensionRegistry) supportedBy(handshake *ExtendedHandshake) map[string]Extension {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	supported := make(map[string]Extension)
+
+	for name, extension := range r.extensions {
+		if _, ok := handshake.Extensions[name]; ok {
+			supported[name] = extension
+		}
+	}
+
+	return supported
+}
+
+func (h *ExtendedHandshake) Serialize() ([]byte, error) {
+
+	extensions := make(map[string]bencode.BencodeValue, len(h.Extensions))
+
+	for name, id := range h.Extensions {
+		extensions[name] = bencode.BencodeValue{Type: bencode.IntegerType, Int: int64(id)}
+	}
+
+	// m must be present even when we support no extension, the other keys only when they are set
+	dict := map[string]bencode.BencodeValue{
+		"m": {Type: bencode.DictType, Dict: extensions},
+	}
+
+	if h.Version != "" {
+		dict["v"] = bencode.BencodeValue{Type: bencode.StringType, Str: h.Version}
+	}
+
+	if h.Port != 0 {
+		dict["p"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: int64(h.Port)}
+	}
+
+	if h.RequestQueue != 0 {
+		dict["reqq"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: int64(h.RequestQueue)}
+	}
+
+	if h.MetadataSize != 0 {
+		dict["metadata_size"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: int64(h.MetadataSize)}
+	}
+
+	value := bencode.BencodeValue{Type: bencode.DictType, Dict: dict}
+
+	buffer := bytes.Buffer{}
+
+	if err := value.Encode(&buffer); err != nil {
+		log.Error().Err(err).Msg("failed to encode extended handshake")
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ParseExtendedHandshake decodes the extended handshake of a peer
+// Unknown keys and values of the wrong type are ignored, an extension mapped to zero is disabled
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+
+	handshake, _, err := parseExtendedHandshake(payload)
+
+	return handshake, err
+}
+
+// Also returns the extensions the handshake disables with ID 0, for a later handshake to update the previous one
+func parseExtendedHandshake(payload []byte) (*ExtendedHandshake, []string, error) {
+
+	result, err := bencode.Parse(bytes.NewReader(payload))
+
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to parse extended handshake")
+		return nil, nil, err
+	}
+
+	if result.Type != bencode.DictType {
+		return nil, nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	handshake := &ExtendedHandshake{
+		Extensions: make(map[string]uint8),
+	}
+
+	var disabled []string
+
+	if m, ok := result.Dict["m"]; ok && m.Type == bencode.DictType {
+		for name, id := range m.Dict {
+			if id.Type != bencode.IntegerType {
+				continue
+			}
+
+			if id.Int == 0 {
+				disabled = append(disabled, name)
+			} else if id.Int > 0 && id.Int <= 255 {
+				handshake.Extensions[name] = uint8(id.Int)
+			}
+		}
+	}
+
+	if v, ok := result.Dict["v"]; ok && v.Type == bencode.StringType {
+		handshake.Version = v.Str
+	}
+
+	if p, ok := result.Dict["p"]; ok && p.Type == bencode.IntegerType && p.Int > 0 && p.Int <= 65535 {
+		handshake.Port = uint16(p.Int)
+	}
+
+	if reqq, ok := result.Dict["reqq"]; ok && reqq.Type == bencode.IntegerType && reqq.Int > 0 {
+		handshake.RequestQueue = int(reqq.Int)
+	}
+
+	if size, ok := result.Dict["metadata_size"]; ok && size.Type == bencode.IntegerType && size.Int > 0 {
+		handshake.MetadataSize = int(size.Int)
+	}
+
+	return handshake, disabled, nil
+}
+
+// Applies a later handshake of the peer to the previous one, BEP 10 makes them additive
+// Extensions it leaves out are kept and the ones sent with ID 0 are disabled, the fields it leaves out keep their value
+func (h *ExtendedHandshake) update(later *ExtendedHandshake, disabled []string) *ExtendedHandshake {
+
+	merged := *h
+	merged.Extensions = make(map[string]uint8, len(h.Extensions)+len(later.Extensions))
+
+	for name, id := range h.Extensions {
+		merged.Extensions[name] = id
+	}
+
+	for name, id := range later.Extensions {
+		merged.Extensions[name] = id
+	}
+
+	for _, name := range disabled {
+		delete(merged.Extensions, name)
+	}
+
+	if later.Version != "" {
+		merged.Version = later.Version
+	}
+
+	if later.Port != 0 {
+		merged.Port = later.Port
+	}
+
+	if later.RequestQueue != 0 {
+		merged.RequestQueue = later.RequestQueue
+	}
+
+	if later.MetadataSize != 0 {
+		merged.MetadataSize = later.MetadataSize
+	}
+
+	return &merged
+}
+
+// Sends our extended handshake when the peer supports the extension protocol
+// Extended messages of the peer are dispatched to the extensions of the registry from then on
+func (c *Client) startExtensions(registry *ExtensionRegistry) error {
+
+	c.extensions = registry
+
+	if registry == nil || !c.reserved.Has(ReservedExtensionProtocol) {
+		return nil
+	}
+
+	payload, err := registry.Handshake().Serialize()
+
+	if err != nil {
+		return err
+	}
+
+	return c.send(NewExtendedMessage(extendedHandshakeID, payload))
+}
+
+// PeerExtensions returns the extended handshake of the peer, nil until it arrives
+func (c *Client) PeerExtensions() *ExtendedHandshake {
+
+	c.extensionMutex.Lock()
+	defer c.extensionMutex.Unlock()
+
+	return c.peerExtensions
+}
+
+// SupportsExtension tells whether the peer advertised the extension in its extended handshake
+func (c *Client) SupportsExtension(name string) bool {
+	_, ok := c.peerExtensionID(name)
+	return ok
+}
+
+func (c *Client) peerExtensionID(name string) (uint8, bool) {
+
+	c.extensionMutex.Lock()
+	defer c.extensionMutex.Unlock()
+
+	if c.peerExtensions == nil {
+		return 0, false
+	}
+
+	id, ok := c.peerExtensions.Extensions[name]
+
+	return id, ok
+}
+
+// SendExtended sends a message of the extension with the extended message ID the peer chose for it
+func (c *Client) SendExtended(name string, payload []byte) error {
+
+	id, ok := c.peerExtensionID(name)
+
+	if !ok {
+		return fmt.Errorf("peer does not support extension %q", name)
+	}
+
+	return c.send(NewExtendedMessage(id, payload))
+}
+
+// Handles an extended message, the handshake is recorded and the other messages go to their extension
+// Messages of extensions we do not support are dropped
+func (c *Client) handleExtended(message *Message) {
+
+	id, payload, err := ParseExtended(*message)
+
+	if err != nil {
+		return
+	}
+
+	if id == extendedHandshakeID {
+		c.handleExtendedHandshake(payload)
+		return
+	}
+
+	if c.extensions == nil {
+		return
+	}
+
+	name, extension, ok := c.extensions.lookup(id)
+
+	if !ok {
+		log.Debug().Str("peer", c.peer.Address()).Int("id", int(id)).Msg("ignoring message of unknown extension")
+		return
+	}
+
+	if err := extension.HandleMessage(c, payload); err != nil {
+		log.Debug().Err(err).Str("peer", c.peer.Address()).Str("extension", name).Msg("failed to handle extended message")
+	}
+}
+
+func (c *Client) handleExtendedHandshake(payload []byte) {
+
+	handshake, disabled, err := parseExtendedHandshake(payload)
+
+	if err != nil {
+		log.Debug().Err(err).Str("peer", c.peer.Address()).Msg("ignoring invalid extended handshake")
+		return
+	}
+
+	// The copy read by the other goroutines is replaced, never changed in place
+	c.extensionMutex.Lock()
+
+	if c.peerExtensions != nil {
+		handshake = c.peerExtensions.update(handshake, disabled)
+	}
+
+	c.peerExtensions = handshake
+	c.extensionMutex.Unlock()
+
+	names := make([]string, 0, len(handshake.Extensions))
+
+	for name := range handshake.Extensions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	log.Debug().Str("peer", c.peer.Address()).Str("client", handshake.Version).Strs("extensions", names).Msg("received extended handshake")
+
+	if c.extensions == nil {
+		return
+	}
+
+	for _, extension := range c.extensions.supportedBy(handshake) {
+		extension.PeerHandshake(c, handshake)
+	}
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/rs/zerolog/log"
+	"net"
+)
+
+// Fast extension (BEP 6), enabled when both peers set the reserved bit
+// Have all and have none replace a full or empty bitfield, requests that will not be served are rejected instead of
+// dropped, and each peer grants the other a few pieces it may request while choked so a new peer gets going sooner
+const allowedFastCount = 10
+
+// Allowed fast pieces kept from a peer, the ones it grants past this are ignored
+const maxAllowedFast = 4 * allowedFastCount
+
+// AllowedFastSet computes the allowed fast set of a peer, the pieces it may request while choked
+// The set only depends on the /24 network of the peer and the torrent, so reconnecting does not earn another one
+// The BEP defines it for IPv4 only, IPv6 peers get none
+func AllowedFastSet(ip net.IP, infoHash [20]byte, pieces int, count int) []int {
+
+	ip4 := ip.To4()
+
+	if ip4 == nil || pieces <= 0 {
+		return nil
+	}
+
+	count = min(count, pieces)
+
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash[:]...)
+	set := make([]int, 0, count)
+	seen := make(map[int]bool, count)
+
+	for len(set) < count {
+		sum := sha1.Sum(x)
+		x = sum[:]
+
+		for i := 0; i < 5 && len(set) < count; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(pieces))
+
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+// Whether the fast extension is enabled on the connection, we always advertise it so the bit of the peer decides
+func (c *Client) fast() bool {
+	return c.reserved.Has(ReservedFast)
+}
+
+func (c *Client) SendReject(index, begin, length int) error {
+	return c.send(NewRejectMessage(index, begin, length))
+}
+
+func (c *Client) SendAllowedFast(index int) error {
+	return c.send(NewAllowedFastMessage(index))
+}
+
+// Tells the peer a request will not be served, without the fast extension it is dropped silently
+func (c *Client) rejectRequest(request blockRequest) error {
+
+	if !c.fast() {
+		return nil
+	}
+
+	return c.SendReject(request.index, request.begin, request.length)
+}
+
+// Records a piece the peer lets us request while it chokes us
+func (c *Client) addAllowedFast(index int) {
+
+	if !c.fast() || len(c.allowedFast) >= maxAllowedFast {
+		return
+	}
+
+	for _, allowed := range c.allowedFast {
+		if allowed == index {
+			return
+		}
+	}
+
+	c.allowedFast = append(c.allowedFast, index)
+}
+
+// Forgets an allowed fast piece, once the peer rejected a request for it while choking us
+func (c *Client) removeAllowedFast(index int) {
+
+	for i, allowed := range c.allowedFast {
+		if allowed == index {
+			c.allowedFast = append(c.allowedFast[:i], c.allowedFast[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pieces we may request while choked, the allowed fast pieces the peer has
+func (c *Client) allowedFastPieces() Bitfield {
+
+	pieces := make(Bitfield, len(c.bitfield))
+
+	for _, index := range c.allowedFast {
+		if c.bitfield.HasPiece(index) {
+			pieces.SetPiece(index)
+		}
+	}
+
+	return pieces
+}
+
+// The first message after the handshake, telling the peer which pieces we have, nil when there is nothing to tell
+// With the fast extension a complete or empty bitfield becomes have all or have none
+func availabilityMessage(client *Client, bitfield Bitfield, complete bool) *Message {
+
+	switch {
+	case !client.fast():
+		if hasAnyPiece(bitfield) {
+			return NewBitfieldMessage(bitfield)
+		}
+
+		return nil
+	case complete:
+		return NewHaveAllMessage()
+	case !hasAnyPiece(bitfield):
+		return NewHaveNoneMessage()
+	default:
+		return NewBitfieldMessage(bitfield)
+	}
+}
+
+// Grants the pieces of the allowed fast set of the peer we have, without the fast extension there is nothing to grant
+func (s *Session) grantAllowedFast(client *Client, bitfield Bitfield) error {
+
+	if !client.fast() {
+		return nil
+	}
+
+	pieces := len(s.torrent.PiecesHash)
+	client.grantedFast = NewBitfield(pieces)
+
+	for _, index := range AllowedFastSet(client.peer.IP, s.torrent.InfoHash, pieces, allowedFastCount) {
+		if !bitfield.HasPiece(index) {
+			continue
+		}
+
+		client.grantedFast.SetPiece(index)
+
+		if err := client.SendAllowedFast(index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handles the reject of one of our requests, the block goes back to the picker for another peer or a later request
+// A rejected allowed fast piece is not asked for again while choked, or the peer would reject it forever
+func (s *Session) handleReject(client *Client, message *Message) {
+
+	index, begin, length, err := ParseRequest(*message)
+
+	if err != nil || !client.fast() {
+		return
+	}
+
+	log.Debug().Str("peer", client.peer.Address()).Int("index", index).Int("begin", begin).Msg("request rejected")
+
+	s.picker.releaseRequest(client, blockRequest{index, begin, length})
+
+	if client.choked {
+		client.removeAllowedFast(index)
+	}
+}
+
+// Builds the bitfield of a peer that has every piece
+func fullBitfield(pieces int) Bitfield {
+
+	bitfield := NewBitfield(pieces)
+
+	for index := 0; index < pieces; index++ {
+		bitfield.SetPiece(index)
+	}
+
+	return bitfield
+}
@@ -9,21 +9,57 @@ import (
 	"time"
 )
 
+// Protocol string sent at the start of every handshake
+const protocolIdentifier = "BitTorrent protocol"
+
+// Reserved holds the eight reserved bytes of the handshake, each bit advertises a protocol extension
+type Reserved [8]byte
+
+// ReservedBit numbers the bits of the reserved bytes from the last bit of the last byte, as the BEPs do
+type ReservedBit uint
+
+const (
+	// ReservedFast advertises the fast extension (BEP 6), 0x04 in the last byte
+	ReservedFast ReservedBit = 2
+	// ReservedExtensionProtocol advertises the extension protocol (BEP 10), 0x10 in the sixth byte
+	ReservedExtensionProtocol ReservedBit = 20
+)
+
+func (r *Reserved) Set(bit ReservedBit) {
+	r[7-bit/8] |= 1 << (bit % 8)
+}
+
+func (r Reserved) Has(bit ReservedBit) bool {
+	return r[7-bit/8]&(1<<(bit%8)) != 0
+}
+
+// Reserved bits of the protocol extensions we support, sent in every handshake
+func supportedExtensions() Reserved {
+
+	var reserved Reserved
+	reserved.Set(ReservedFast)
+	reserved.Set(ReservedExtensionProtocol)
+
+	return reserved
+}
+
 type Handshake struct {
 	Pstr     string
+	Reserved Reserved
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
 func NewHandshake(peerID [20]byte, infoHash [20]byte) *Handshake {
 	return &Handshake{
-		Pstr:     "BitTorrent protocol",
+		Pstr:     protocolIdentifier,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
 }
 
-func handshake(conn net.Conn, peer Peer, infoHash [20]byte, peerID [20]byte) error {
+// Handshakes on the connection we dialed, returns the handshake of the peer
+func handshake(conn net.Conn, peer Peer, infoHash [20]byte, peerID [20]byte) (*Handshake, error) {
 
 	log.Debug().Str("peer", peer.Address()).Msg("setting deadline")
 
@@ -31,7 +67,7 @@ func handshake(conn net.Conn, peer Peer, infoHash [20]byte, peerID [20]byte) err
 
 	if err != nil {
 		log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to set deadline")
-		return err
+		return nil, err
 	}
 
 	defer func(conn net.Conn, t time.Time) {
@@ -45,6 +81,7 @@ func handshake(conn net.Conn, peer Peer, infoHash [20]byte, peerID [20]byte) err
 	}(conn, time.Time{})
 
 	handshakeRequest := NewHandshake(peerID, infoHash)
+	handshakeRequest.Reserved = supportedExtensions()
 
 	log.Debug().Str("peer", peer.Address()).Msg("writing handshake")
 
@@ -52,24 +89,30 @@ func handshake(conn net.Conn, peer Peer, infoHash [20]byte, peerID [20]byte) err
 
 	if err != nil {
 		log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to write handshake")
-		return err
+		return nil, err
 	}
 
 	handshakeResponse, err := ReadResponse(conn)
 
 	if err != nil {
 		log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to read handshake")
-		return err
+		return nil, err
 	}
 
 	log.Debug().Str("peer", peer.Address()).Msg("read handshake with success, checking info hash")
 
 	if !bytes.Equal(handshakeResponse.InfoHash[:], infoHash[:]) {
 		log.Error().Str("peer", peer.Address()).Str("InfoHash", string(handshakeResponse.InfoHash[:])).Str("expected", string(infoHash[:])).Msg("info hash mismatch")
-		return fmt.Errorf("info hash mismatch")
+		return nil, fmt.Errorf("info hash mismatch")
+	}
+
+	// Trackers often hand our own address back
+	if handshakeResponse.PeerID == peerID {
+		log.Debug().Str("peer", peer.Address()).Msg("connected to ourselves")
+		return nil, fmt.Errorf("connected to ourselves")
 	}
 
-	return nil
+	return handshakeResponse, nil
 }
 
 func ReadResponse(r io.Reader) (*Handshake, error) {
@@ -100,6 +143,7 @@ func ReadResponse(r io.Reader) (*Handshake, error) {
 
 	return &Handshake{
 		Pstr:     string(handshakeBuffer[0:protocolStringLen]),
+		Reserved: [8]byte(handshakeBuffer[protocolStringLen : protocolStringLen+8]),
 		InfoHash: [20]byte(handshakeBuffer[protocolStringLen+8 : protocolStringLen+20+8]),
 		PeerID:   [20]byte(handshakeBuffer[protocolStringLen+20+8 : protocolStringLen+20+8+20]),
 	}, nil
@@ -112,7 +156,7 @@ func (h *Handshake) Serialize() []byte {
 	buffer := make([]byte, len(h.Pstr)+20+20+8+1)
 	curr := copy(buffer[0:], string(rune(len(h.Pstr))))
 	curr += copy(buffer[1:], h.Pstr)
-	curr += copy(buffer[curr:], make([]byte, 8))
+	curr += copy(buffer[curr:], h.Reserved[:])
 	curr += copy(buffer[curr:], h.InfoHash[:])
 	curr += copy(buffer[curr:], h.PeerID[:])
 	return buffer
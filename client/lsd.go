@@ -0,0 +1,37 @@
+package client
+
+import (
+	"Torrent-Client/lsd"
+	"context"
+	"time"
+)
+
+// Announces the torrent to the local network every interval of the service and sends the local peers announcing it on the channel
+// Without a port we only listen for them
+func discoverLocalPeers(ctx context.Context, service *lsd.Service, infoHash [20]byte, port uint16, found chan<- []Peer) {
+
+	peers, unsubscribe := service.Subscribe(infoHash)
+	defer unsubscribe()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if port != 0 {
+				_ = service.Announce(infoHash, port)
+			}
+
+			timer.Reset(service.Interval)
+		case peer := <-peers:
+			select {
+			case found <- []Peer{peer}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -23,6 +23,27 @@ const (
 	MessageCancel                             // Cancel is a message that tells the peer that the client no longer wants a piece
 )
 
+// Fast extension (BEP 6), only exchanged when both peers set its reserved bit
+const (
+	MessageSuggest     MessageID = 13 // Suggest is a message that tells the peer a piece it would be good to download
+	MessageHaveAll     MessageID = 14 // HaveAll replaces the bitfield of a peer that has every piece
+	MessageHaveNone    MessageID = 15 // HaveNone replaces the bitfield of a peer that has no piece
+	MessageReject      MessageID = 16 // Reject is a message that tells the peer its request will not be served
+	MessageAllowedFast MessageID = 17 // AllowedFast is a message that tells the peer it may request a piece even when choked
+)
+
+// Extended carries the messages of the extension protocol (BEP 10), the payload starts with the extended message ID
+const MessageExtended MessageID = 20
+
+// Longest message with a fixed payload, a request, cancel or reject carries three integers
+const maxFixedMessageLength = 1 + 12
+
+// Longest piece message, the index and the offset then one block
+const maxPieceMessageLength = 1 + 8 + maxBlockSize
+
+// Longest message of another kind, the bitfield of a torrent of two million pieces or an extended message fit
+const maxVariableMessageLength = 256 * 1024
+
 type Message struct {
 	ID      MessageID
 	Payload []byte
@@ -40,6 +61,13 @@ func NewRequestMessage(index, begin, length int) *Message {
 	}
 }
 
+func NewCancelMessage(index, begin, length int) *Message {
+	message := NewRequestMessage(index, begin, length)
+	message.ID = MessageCancel
+
+	return message
+}
+
 func NewHaveMessage(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
@@ -71,23 +99,79 @@ func NewUnchokeMessage() *Message {
 	}
 }
 
-func ReadBitfieldMessage(reader io.Reader) (Bitfield, error) {
+func NewChokeMessage() *Message {
+	return &Message{
+		ID:      MessageChoke,
+		Payload: nil,
+	}
+}
+
+func NewBitfieldMessage(bitfield Bitfield) *Message {
+	payload := make([]byte, len(bitfield))
+	copy(payload, bitfield)
 
-	log.Debug().Msg("reading bitfield message")
+	return &Message{
+		ID:      MessageBitfield,
+		Payload: payload,
+	}
+}
 
-	msg, err := ReadMessage(reader)
+func NewPieceMessage(index, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
 
-	if err != nil {
-		log.Error().Err(err).Msg("failed to read message")
-		return nil, err
+	return &Message{
+		ID:      MessagePiece,
+		Payload: payload,
 	}
+}
+
+func NewSuggestMessage(index int) *Message {
+	message := NewHaveMessage(index)
+	message.ID = MessageSuggest
+
+	return message
+}
 
-	if msg.ID != MessageBitfield {
-		log.Error().Msg("expected bitfield message")
-		return nil, fmt.Errorf("expected bitfield message, got %v", msg.ID)
+func NewHaveAllMessage() *Message {
+	return &Message{
+		ID:      MessageHaveAll,
+		Payload: nil,
 	}
+}
 
-	return msg.Payload, nil
+func NewHaveNoneMessage() *Message {
+	return &Message{
+		ID:      MessageHaveNone,
+		Payload: nil,
+	}
+}
+
+func NewRejectMessage(index, begin, length int) *Message {
+	message := NewRequestMessage(index, begin, length)
+	message.ID = MessageReject
+
+	return message
+}
+
+func NewAllowedFastMessage(index int) *Message {
+	message := NewHaveMessage(index)
+	message.ID = MessageAllowedFast
+
+	return message
+}
+
+func NewExtendedMessage(id uint8, payload []byte) *Message {
+	buffer := make([]byte, 1+len(payload))
+	buffer[0] = id
+	copy(buffer[1:], payload)
+
+	return &Message{
+		ID:      MessageExtended,
+		Payload: buffer,
+	}
 }
 
 func ReadMessage(reader io.Reader) (*Message, error) {
@@ -117,9 +201,26 @@ func ReadMessage(reader io.Reader) (*Message, error) {
 		}, nil
 	}
 
-	messageBuffer := make([]byte, length)
+	idBuffer := make([]byte, 1)
 
-	_, err = io.ReadFull(reader, messageBuffer)
+	_, err = io.ReadFull(reader, idBuffer)
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read message ID")
+		return nil, err
+	}
+
+	id := MessageID(idBuffer[0])
+
+	// The length comes from the peer, it is checked before allocating the buffer
+	if length > maxMessageLength(id) {
+		log.Error().Int("id", int(id)).Uint32("length", length).Msg("message too long")
+		return nil, fmt.Errorf("message %d of %d bytes is too long", id, length)
+	}
+
+	payload := make([]byte, length-1)
+
+	_, err = io.ReadFull(reader, payload)
 
 	if err != nil {
 		log.Error().Err(err).Msg("failed to read message")
@@ -127,14 +228,27 @@ func ReadMessage(reader io.Reader) (*Message, error) {
 	}
 
 	data := &Message{
-		ID:      MessageID(messageBuffer[0]),
-		Payload: messageBuffer[1:],
+		ID:      id,
+		Payload: payload,
 	}
 
 	log.Debug().Int("id", int(data.ID)).Bytes("payload", data.Payload).Str("summary", data.Type()).Msg("read message")
 	return data, nil
 }
 
+// The longest length a message with the ID may announce, unknown messages get the variable cap
+func maxMessageLength(id MessageID) uint32 {
+	switch id {
+	case MessageChoke, MessageUnchoke, MessageInterested, MessageNotInterested, MessageHave, MessageRequest, MessageCancel,
+		MessageSuggest, MessageHaveAll, MessageHaveNone, MessageReject, MessageAllowedFast:
+		return maxFixedMessageLength
+	case MessagePiece:
+		return maxPieceMessageLength
+	default:
+		return maxVariableMessageLength
+	}
+}
+
 func (m *Message) Serialize() []byte {
 
 	if m.ID == MessageKeepAlive {
@@ -177,14 +291,27 @@ func (m *Message) Type() string {
 		return "piece"
 	case MessageCancel:
 		return "cancel"
+	case MessageSuggest:
+		return "suggest"
+	case MessageHaveAll:
+		return "have all"
+	case MessageHaveNone:
+		return "have none"
+	case MessageReject:
+		return "reject"
+	case MessageAllowedFast:
+		return "allowed fast"
+	case MessageExtended:
+		return "extended"
 	default:
 		return "unknown"
 	}
 }
 
+// ParseHave returns the piece index of a have, suggest or allowed fast message, they share the same payload
 func ParseHave(message Message) (int, error) {
 
-	if message.ID != MessageHave {
+	if message.ID != MessageHave && message.ID != MessageSuggest && message.ID != MessageAllowedFast {
 		log.Error().Int("id", int(message.ID)).Int("expected", int(MessageHave)).Msg("unexpected message")
 		return 0, fmt.Errorf("unexpected message")
 	}
@@ -198,6 +325,45 @@ func ParseHave(message Message) (int, error) {
 	return index, nil
 }
 
+// ParseRequest returns the index, begin and length of a request, cancel or reject message, they share the same payload
+func ParseRequest(message Message) (int, int, int, error) {
+
+	if message.ID != MessageRequest && message.ID != MessageCancel && message.ID != MessageReject {
+		log.Error().Int("id", int(message.ID)).Int("expected", int(MessageRequest)).Msg("unexpected message")
+		return 0, 0, 0, fmt.Errorf("unexpected message")
+	}
+
+	if len(message.Payload) != 12 {
+		log.Error().Int("length", len(message.Payload)).Int("expected", 12).Msg("unexpected payload length")
+		return 0, 0, 0, fmt.Errorf("unexpected payload length")
+	}
+
+	index := int(binary.BigEndian.Uint32(message.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(message.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(message.Payload[8:12]))
+
+	return index, begin, length, nil
+}
+
+// ParseBlock returns the index, begin and data of a piece message
+func ParseBlock(message Message) (int, int, []byte, error) {
+
+	if message.ID != MessagePiece {
+		log.Error().Int("id", int(message.ID)).Int("expected", int(MessagePiece)).Msg("unexpected message")
+		return 0, 0, nil, fmt.Errorf("unexpected message")
+	}
+
+	if len(message.Payload) < 8 {
+		log.Error().Int("length", len(message.Payload)).Int("expected", 8).Msg("unexpected payload length")
+		return 0, 0, nil, fmt.Errorf("unexpected payload length")
+	}
+
+	index := int(binary.BigEndian.Uint32(message.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(message.Payload[4:8]))
+
+	return index, begin, message.Payload[8:], nil
+}
+
 func ParsePiece(index int, buffer []byte, message Message) (int, []byte, error) {
 
 	if message.ID != MessagePiece {
@@ -239,3 +405,19 @@ func ParsePiece(index int, buffer []byte, message Message) (int, []byte, error)
 	copy(buffer[begin:], data)
 	return len(data), data, nil
 }
+
+// ParseExtended returns the extended message ID and the payload that follows it
+func ParseExtended(message Message) (uint8, []byte, error) {
+
+	if message.ID != MessageExtended {
+		log.Error().Int("id", int(message.ID)).Int("expected", int(MessageExtended)).Msg("unexpected message")
+		return 0, nil, fmt.Errorf("unexpected message")
+	}
+
+	if len(message.Payload) < 1 {
+		log.Error().Int("length", len(message.Payload)).Msg("extended message without ID")
+		return 0, nil, fmt.Errorf("unexpected payload length")
+	}
+
+	return message.Payload[0], message.Payload[1:], nil
+}
@@ -0,0 +1,541 @@
+package client
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/mse"
+	"Torrent-Client/torrent"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// Metadata exchange (BEP 9), the info dictionary is sent over the extension protocol in pieces of 16 KiB
+// Each message is a bencoded dictionary, data messages carry the piece right after it
+const utMetadata = "ut_metadata"
+
+const metadataBlockSize = 16 * 1024
+
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// Larger info dictionaries are refused, a peer must not make us allocate without bound
+const maxMetadataSize = 16 * 1024 * 1024
+
+// How long a peer may take to send the whole info dictionary
+const metadataPeerTimeout = 30 * time.Second
+
+// Connections kept open at once while fetching the info dictionary
+const maxMetadataConnections = 10
+
+// metadataExchange serves the info dictionary once we know it and fetches it from the peers until then
+// Every peer sends its own copy, the first one matching the info hash is kept
+type metadataExchange struct {
+	infoHash [20]byte
+
+	mutex    sync.Mutex
+	metadata []byte
+	fetches  map[*Client]*metadataFetch
+
+	// Closed once the metadata is known
+	done chan struct{}
+}
+
+// The pieces of the info dictionary a peer sent so far
+type metadataFetch struct {
+	buffer   []byte
+	received []bool
+	count    int
+}
+
+type metadataMessage struct {
+	msgType   int
+	piece     int
+	totalSize int
+	data      []byte
+}
+
+func newMetadataExchange(infoHash [20]byte, metadata []byte) *metadataExchange {
+
+	exchange := &metadataExchange{
+		infoHash: infoHash,
+		metadata: metadata,
+		fetches:  make(map[*Client]*metadataFetch),
+		done:     make(chan struct{}),
+	}
+
+	if metadata != nil {
+		close(exchange.done)
+	}
+
+	return exchange
+}
+
+// Returns the verified info dictionary, nil until it is known
+func (e *metadataExchange) Metadata() []byte {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.metadata
+}
+
+// Requests every piece of the info dictionary from a peer that advertised its size
+func (e *metadataExchange) PeerHandshake(client *Client, handshake *ExtendedHandshake) {
+
+	e.mutex.Lock()
+
+	if e.metadata != nil || e.fetches[client] != nil {
+		e.mutex.Unlock()
+		return
+	}
+
+	size := handshake.MetadataSize
+
+	if size <= 0 || size > maxMetadataSize {
+		e.mutex.Unlock()
+		log.Debug().Str("peer", client.peer.Address()).Int("size", size).Msg("peer does not offer usable metadata")
+		return
+	}
+
+	pieces := (size + metadataBlockSize - 1) / metadataBlockSize
+
+	e.fetches[client] = &metadataFetch{
+		buffer:   make([]byte, size),
+		received: make([]bool, pieces),
+	}
+
+	e.mutex.Unlock()
+
+	log.Debug().Str("peer", client.peer.Address()).Int("size", size).Int("pieces", pieces).Msg("requesting metadata")
+
+	for piece := 0; piece < pieces; piece++ {
+		if err := client.SendExtended(utMetadata, encodeMetadataMessage(metadataRequest, piece, 0)); err != nil {
+			return
+		}
+	}
+}
+
+func (e *metadataExchange) HandleMessage(client *Client, payload []byte) error {
+
+	message, err := parseMetadataMessage(payload)
+
+	if err != nil {
+		return err
+	}
+
+	switch message.msgType {
+	case metadataRequest:
+		return e.serve(client, message.piece)
+	case metadataData:
+		return e.receive(client, message)
+	case metadataReject:
+		e.forget(client)
+		return fmt.Errorf("peer rejected metadata piece %d", message.piece)
+	}
+
+	// Unknown message types are ignored, as the extension asks
+	return nil
+}
+
+// Sends a piece of the info dictionary, or rejects the request while we do not know it
+func (e *metadataExchange) serve(client *Client, piece int) error {
+
+	e.mutex.Lock()
+	metadata := e.metadata
+	e.mutex.Unlock()
+
+	begin := piece * metadataBlockSize
+
+	if metadata == nil || piece < 0 || begin >= len(metadata) {
+		return client.SendExtended(utMetadata, encodeMetadataMessage(metadataReject, piece, 0))
+	}
+
+	data := metadata[begin:min(begin+metadataBlockSize, len(metadata))]
+	message := append(encodeMetadataMessage(metadataData, piece, len(metadata)), data...)
+
+	return client.SendExtended(utMetadata, message)
+}
+
+// Stores a piece sent by the peer, the dictionary is checked against the info hash once complete
+func (e *metadataExchange) receive(client *Client, message metadataMessage) error {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	fetch := e.fetches[client]
+
+	// Pieces we did not ask for, or that arrive after the metadata is known, are dropped
+	if fetch == nil || e.metadata != nil {
+		return nil
+	}
+
+	size := len(fetch.buffer)
+	begin := message.piece * metadataBlockSize
+
+	if message.totalSize != size || message.piece < 0 || message.piece >= len(fetch.received) {
+		delete(e.fetches, client)
+		return fmt.Errorf("invalid metadata piece %d of %d bytes", message.piece, message.totalSize)
+	}
+
+	if len(message.data) != min(metadataBlockSize, size-begin) {
+		delete(e.fetches, client)
+		return fmt.Errorf("metadata piece %d has %d bytes", message.piece, len(message.data))
+	}
+
+	if !fetch.received[message.piece] {
+		copy(fetch.buffer[begin:], message.data)
+		fetch.received[message.piece] = true
+		fetch.count++
+	}
+
+	if fetch.count < len(fetch.received) {
+		return nil
+	}
+
+	delete(e.fetches, client)
+
+	if sha1.Sum(fetch.buffer) != e.infoHash {
+		return fmt.Errorf("metadata does not match the info hash")
+	}
+
+	log.Debug().Str("peer", client.peer.Address()).Int("size", size).Msg("metadata received")
+
+	e.metadata = fetch.buffer
+	e.fetches = make(map[*Client]*metadataFetch)
+	close(e.done)
+
+	return nil
+}
+
+// Whether pieces of the info dictionary are still expected from the peer
+func (e *metadataExchange) fetching(client *Client) bool {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.fetches[client] != nil
+}
+
+func (e *metadataExchange) forget(client *Client) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delete(e.fetches, client)
+}
+
+// Only data messages carry the total size of the info dictionary
+func encodeMetadataMessage(msgType, piece, totalSize int) []byte {
+
+	dict := map[string]bencode.BencodeValue{
+		"msg_type": {Type: bencode.IntegerType, Int: int64(msgType)},
+		"piece":    {Type: bencode.IntegerType, Int: int64(piece)},
+	}
+
+	if msgType == metadataData {
+		dict["total_size"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: int64(totalSize)}
+	}
+
+	value := bencode.BencodeValue{Type: bencode.DictType, Dict: dict}
+	buffer := bytes.Buffer{}
+
+	// Integers and strings always encode
+	_ = value.Encode(&buffer)
+
+	return buffer.Bytes()
+}
+
+// Parses the dictionary of a metadata message, the bytes left after it are the data of the piece
+func parseMetadataMessage(payload []byte) (metadataMessage, error) {
+
+	reader := bytes.NewReader(payload)
+	buffered := bufio.NewReader(reader)
+
+	value, err := bencode.Parse(buffered)
+
+	if err != nil {
+		return metadataMessage{}, err
+	}
+
+	if value.Type != bencode.DictType {
+		return metadataMessage{}, fmt.Errorf("metadata message is not a dictionary")
+	}
+
+	msgType, ok := value.Dict["msg_type"]
+
+	if !ok || msgType.Type != bencode.IntegerType {
+		return metadataMessage{}, fmt.Errorf("metadata message without msg_type")
+	}
+
+	piece, ok := value.Dict["piece"]
+
+	if !ok || piece.Type != bencode.IntegerType {
+		return metadataMessage{}, fmt.Errorf("metadata message without piece")
+	}
+
+	message := metadataMessage{
+		msgType: int(msgType.Int),
+		piece:   int(piece.Int),
+	}
+
+	if totalSize, ok := value.Dict["total_size"]; ok && totalSize.Type == bencode.IntegerType {
+		message.totalSize = int(totalSize.Int)
+	}
+
+	consumed := len(payload) - reader.Len() - buffered.Buffered()
+	message.data = payload[consumed:]
+
+	return message, nil
+}
+
+// FetchMetadata fetches the info dictionary of the magnet link from its peers and those of its trackers, the DHT and the local network
+// The dictionary is checked against the info hash, the torrent returned can then be downloaded
+// Only the DHT node, the LSD service, the encryption and the peer wait timeout of the options are used, the trackers are
+// announced port 0 since nothing listens yet
+func FetchMetadata(ctx context.Context, magnet torrent.Magnet, opts DownloadOptions) (torrent.TorrentFile, error) {
+
+	log.Info().Str("name", magnet.Name).Int("peers", len(magnet.Peers)).Int("trackers", len(magnet.Trackers)).Msg("fetching metadata")
+
+	peerID, err := newPeerID()
+
+	if err != nil {
+		return torrent.TorrentFile{}, err
+	}
+
+	exchange := newMetadataExchange(magnet.InfoHash, nil)
+	registry := NewExtensionRegistry()
+
+	if err := registry.Register(utMetadata, exchange); err != nil {
+		return torrent.TorrentFile{}, err
+	}
+
+	peers := newPeerManager(maxMetadataConnections)
+	peers.addPeers(magnet.Peers)
+
+	// Workers and the announcer stop with the context, they are waited for before returning
+	ctx, cancel := context.WithCancel(ctx)
+	waitGroup := sync.WaitGroup{}
+	announcer := torrent.NewAnnouncer(magnet.AnnounceTiers())
+	announcedPeers := make(chan []Peer)
+
+	defer func(announcer *torrent.Announcer) {
+		cancel()
+		waitGroup.Wait()
+
+		if err := announcer.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close trackers")
+		}
+	}(announcer)
+
+	if len(magnet.Trackers) > 0 {
+		// We do not listen while fetching, a port would have the trackers hand out an address refusing connections
+		request := torrent.AnnounceRequest{
+			InfoHash: magnet.InfoHash,
+			PeerID:   peerID,
+			Port:     0,
+			Key:      binary.BigEndian.Uint32(peerID[16:]),
+			IPv6:     globalIPv6Address(),
+		}
+
+		// The size is unknown until the metadata arrives, something left keeps the trackers from taking us for a seeder
+		stats := func() torrent.TransferStats {
+			return torrent.TransferStats{Left: metadataBlockSize}
+		}
+
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+			announcer.Run(ctx, request, stats, announcedPeers)
+		}()
+	}
+
+	// We do not listen while fetching, the DHT and the local network are only asked for peers
+	var dhtPeers chan []Peer
+
+	if opts.DHT != nil {
+		dhtPeers = make(chan []Peer)
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+			lookupDHTPeers(ctx, opts.DHT, magnet.InfoHash, 0, dhtPeers)
+		}()
+	}
+
+	var localPeers chan []Peer
+
+	if opts.LSD != nil {
+		localPeers = make(chan []Peer)
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+			discoverLocalPeers(ctx, opts.LSD, magnet.InfoHash, 0, localPeers)
+		}()
+	}
+
+	workerExits := make(chan Peer)
+	workers := 0
+
+	startWorkers := func() {
+		for {
+			peer, ok := peers.next()
+
+			if !ok {
+				return
+			}
+
+			workers++
+			waitGroup.Add(1)
+
+			go func() {
+				defer waitGroup.Done()
+
+				fetchMetadataFrom(ctx, registry, exchange, peers, peer, magnet.InfoHash, peerID, opts.Encryption)
+
+				select {
+				case workerExits <- peer:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+
+	startWorkers()
+
+	retryTicker := time.NewTicker(peerRetryInterval)
+	defer retryTicker.Stop()
+
+	peerWait := opts.PeerWaitTimeout
+
+	if peerWait <= 0 {
+		peerWait = defaultPeerWaitTimeout
+	}
+
+	// Armed while no peer is connected or left to dial, the fetch fails when no new peer showed up in time
+	var noPeersTimer *time.Timer
+	var noPeers <-chan time.Time
+
+	for {
+		starving := workers == 0 && !peers.hasPeers()
+
+		if starving && noPeers == nil {
+			log.Debug().Str("name", magnet.Name).Dur("timeout", peerWait).Msg("no peer left, waiting for new ones")
+			noPeersTimer = time.NewTimer(peerWait)
+			noPeers = noPeersTimer.C
+		} else if !starving && noPeers != nil {
+			noPeersTimer.Stop()
+			noPeers = nil
+		}
+
+		select {
+		case <-exchange.done:
+			return torrent.NewTorrentFromMetadata(exchange.Metadata(), magnet)
+		case list := <-announcedPeers:
+			added := peers.addPeers(list)
+			log.Debug().Str("name", magnet.Name).Int("peers", len(list)).Int("new", added).Msg("received peers from tracker")
+			startWorkers()
+		case list := <-localPeers:
+			added := peers.addPreferredPeers(list)
+			log.Debug().Str("name", magnet.Name).Int("peers", len(list)).Int("new", added).Msg("received peers from the local network")
+			startWorkers()
+		case list := <-dhtPeers:
+			added := peers.addPeers(list)
+			log.Debug().Str("name", magnet.Name).Int("peers", len(list)).Int("new", added).Msg("received peers from the dht")
+			startWorkers()
+		case <-retryTicker.C:
+			startWorkers()
+		case <-workerExits:
+			workers--
+			startWorkers()
+		case <-noPeers:
+			log.Error().Str("name", magnet.Name).Dur("timeout", peerWait).Msg("no peer found to send the metadata")
+			return torrent.TorrentFile{}, fmt.Errorf("%w sent the metadata in %s", ErrNoPeers, peerWait)
+		case <-ctx.Done():
+			return torrent.TorrentFile{}, ctx.Err()
+		}
+	}
+}
+
+// Fetches the info dictionary from one peer, until it arrives, the peer fails to send it or its time is up
+// Peers that cannot send it, send a bad piece or reject our requests are not asked again, the ones that only timed
+// out or dropped the connection are retried after the usual backoff
+func fetchMetadataFrom(ctx context.Context, registry *ExtensionRegistry, exchange *metadataExchange, peers *peerManager, peer Peer, infoHash [20]byte, peerID [20]byte, encryption mse.Policy) {
+
+	// The number of pieces is in the info dictionary we are after, the pieces of the peer do not matter here
+	client, err := NewClientContext(ctx, peer, infoHash, peerID, 0, encryption)
+
+	if err != nil {
+		peers.dialFailed(peer)
+		return
+	}
+
+	delivered := false
+	banned := false
+
+	defer func(client *Client) {
+		exchange.forget(client)
+
+		if banned {
+			peers.ban(peer)
+		} else {
+			peers.disconnected(peer, delivered)
+		}
+
+		if err := client.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close connection")
+		}
+	}(client)
+
+	if !client.reserved.Has(ReservedExtensionProtocol) {
+		log.Debug().Str("peer", peer.Address()).Msg("peer does not support the extension protocol")
+		banned = true
+		return
+	}
+
+	// We have no piece, the fast extension wants it said
+	if client.fast() {
+		if err := client.send(NewHaveNoneMessage()); err != nil {
+			return
+		}
+	}
+
+	if err := client.startExtensions(registry); err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(metadataPeerTimeout)
+
+	for {
+		message, err := client.readMessageWithin(time.Until(deadline))
+
+		if err != nil {
+			log.Debug().Err(err).Str("peer", peer.Address()).Msg("stopped fetching metadata from peer")
+			return
+		}
+
+		if message.ID != MessageExtended {
+			continue
+		}
+
+		client.handleExtended(message)
+
+		// Once the peer answered our handshake it is either sending the pieces, done or of no help
+		// Without ut_metadata, or after a bad piece or a reject, the fetch of the peer is gone
+		if client.PeerExtensions() != nil && !exchange.fetching(client) {
+			delivered = exchange.Metadata() != nil
+			banned = !delivered
+			return
+		}
+	}
+}
@@ -1,44 +1,17 @@
 package client
 
-import (
-	"encoding/binary"
-	"fmt"
-	"net"
-	"strconv"
-)
+import "Torrent-Client/torrent"
 
-const peerSize = 6
-
-type Peer struct {
-	IP   net.IP
-	Port uint16
-}
+// Peer is the address of a remote peer, as handed out by the trackers
+// The type lives in the torrent package so the tracker code does not depend on the client
+type Peer = torrent.Peer
 
+// DecodePeers decodes a compact peer list, see torrent.DecodePeers
 func DecodePeers(bytes []byte) ([]Peer, error) {
-
-	if len(bytes) == 0 {
-		return nil, fmt.Errorf("received empty peers")
-	}
-
-	numPeers := len(bytes) / peerSize
-
-	if len(bytes)%peerSize != 0 {
-		return nil, fmt.Errorf("received malformed peers")
-	}
-
-	peers := make([]Peer, numPeers)
-
-	for i := 0; i < numPeers; i++ {
-		offset := i * peerSize
-		peers[i] = Peer{
-			IP:   net.IP(bytes[offset : offset+4]),
-			Port: binary.BigEndian.Uint16(bytes[offset+4 : offset+6]),
-		}
-	}
-
-	return peers, nil
+	return torrent.DecodePeers(bytes)
 }
 
-func (p Peer) Address() string {
-	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+// DecodePeers6 decodes a compact IPv6 peer list, see torrent.DecodePeers6
+func DecodePeers6(bytes []byte) ([]Peer, error) {
+	return torrent.DecodePeers6(bytes)
 }
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// Outbound connections kept open at once
+const maxConnections = 30
+
+// Failed dials and failed connections after which a peer is given up
+const maxDialFailures = 3
+
+// First wait before dialing a peer that failed again, doubled on every failure
+const dialRetryDelay = 30 * time.Second
+
+// Peers known at once, new ones are dropped once the pool is full and no peer given up can make room
+const maxKnownPeers = 1000
+
+// Connections closed sooner than this count as failures, useful or not, so a peer that drops us is not redialed in a loop
+const minConnectionTime = 10 * time.Second
+
+// peerManager is the pool of peers known for a torrent
+// It hands each worker a distinct peer, keeps the connections under the cap and backs off from peers that fail
+// Peers keep coming from the trackers, the DHT and peer exchange, so the pool itself is capped too
+type peerManager struct {
+	mutex     sync.Mutex
+	peers     map[string]*peerState
+	order     []string
+	connected int
+	limit     int
+}
+
+type peerState struct {
+	peer        Peer
+	connected   bool
+	connectedAt time.Time
+	failures    int
+	retryAt     time.Time
+	banned      bool
+}
+
+func newPeerManager(limit int) *peerManager {
+	return &peerManager{
+		peers: make(map[string]*peerState),
+		limit: limit,
+	}
+}
+
+// Adds the peers not known yet to the pool, returns how many were new
+func (m *peerManager) addPeers(peers []Peer) int {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	added := 0
+
+	for _, peer := range peers {
+		address := peer.Address()
+
+		if _, ok := m.peers[address]; ok {
+			continue
+		}
+
+		if !m.makeRoom() {
+			break
+		}
+
+		m.peers[address] = &peerState{peer: peer}
+		m.order = append(m.order, address)
+		added++
+	}
+
+	return added
+}
+
+// Adds the peers ahead of the others, they are dialed first
+// Known peers move to the front too, returns how many were new
+func (m *peerManager) addPreferredPeers(peers []Peer) int {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	added := 0
+	front := make([]string, 0, len(peers))
+	moved := make(map[string]bool, len(peers))
+
+	for _, peer := range peers {
+		address := peer.Address()
+
+		if moved[address] {
+			continue
+		}
+
+		if _, ok := m.peers[address]; !ok {
+			if !m.makeRoom() {
+				continue
+			}
+
+			m.peers[address] = &peerState{peer: peer}
+			added++
+		}
+
+		front = append(front, address)
+		moved[address] = true
+	}
+
+	for _, address := range m.order {
+		if !moved[address] {
+			front = append(front, address)
+		}
+	}
+
+	// Making room may have dropped a peer moved to the front before
+	m.order = front[:0]
+
+	for _, address := range front {
+		if _, ok := m.peers[address]; ok {
+			m.order = append(m.order, address)
+		}
+	}
+
+	return added
+}
+
+// Returns a peer to connect to and counts it as connected, false when the cap is reached or no peer is ready
+// Peers are tried in the order they were learned
+func (m *peerManager) next() (Peer, bool) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.connected >= m.limit {
+		return Peer{}, false
+	}
+
+	now := time.Now()
+
+	for _, address := range m.order {
+		state := m.peers[address]
+
+		if state.connected || !state.usable() || now.Before(state.retryAt) {
+			continue
+		}
+
+		state.connected = true
+		state.connectedAt = now
+		m.connected++
+
+		return state.peer, true
+	}
+
+	return Peer{}, false
+}
+
+// The dial or the handshake failed, the peer is retried later and given up after too many failures
+func (m *peerManager) dialFailed(peer Peer) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if state := m.release(peer); state != nil {
+		state.failed()
+	}
+}
+
+// The connection was established and is now closed
+// A peer that was useful for long enough may be dialed again right away, one that dropped us quickly or sent
+// nothing we needed backs off like a failed dial and is given up after too many such connections
+func (m *peerManager) disconnected(peer Peer, useful bool) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state := m.release(peer)
+
+	if state == nil {
+		return
+	}
+
+	if useful && time.Since(state.connectedAt) >= minConnectionTime {
+		state.failures = 0
+		return
+	}
+
+	state.failed()
+}
+
+// The peer misbehaved, it is never dialed again
+func (m *peerManager) ban(peer Peer) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if state := m.release(peer); state != nil {
+		state.banned = true
+	}
+}
+
+// Whether some peer is connected or may still be dialed, now or after its retry delay
+func (m *peerManager) hasPeers() bool {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.connected > 0 {
+		return true
+	}
+
+	for _, state := range m.peers {
+		if state.usable() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether a new peer fits in the pool, when it is full the peers given up after too many failures are dropped
+// Banned peers are kept, so they are not dialed again when they are announced again
+func (m *peerManager) makeRoom() bool {
+
+	if len(m.peers) < maxKnownPeers {
+		return true
+	}
+
+	order := m.order[:0]
+
+	for _, address := range m.order {
+		state := m.peers[address]
+
+		if !state.connected && !state.banned && state.failures >= maxDialFailures {
+			delete(m.peers, address)
+			continue
+		}
+
+		order = append(order, address)
+	}
+
+	m.order = order
+
+	return len(m.peers) < maxKnownPeers
+}
+
+func (m *peerManager) release(peer Peer) *peerState {
+
+	state, ok := m.peers[peer.Address()]
+
+	if !ok {
+		return nil
+	}
+
+	if state.connected {
+		state.connected = false
+		m.connected--
+	}
+
+	return state
+}
+
+func (s *peerState) failed() {
+	s.failures++
+	s.retryAt = time.Now().Add(dialRetryDelay << (s.failures - 1))
+}
+
+func (s *peerState) usable() bool {
+	return !s.banned && s.failures < maxDialFailures
+}
@@ -0,0 +1,407 @@
+package client
+
+import (
+	"Torrent-Client/bencode"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer exchange (BEP 11), connected peers tell each other about the peers they are connected to
+// A message lists the peers connected since the previous one and those that left, as compact peers with one byte of flags each
+const utPex = "ut_pex"
+
+// How often the peers are exchanged, the BEP asks for no more than one message a minute
+const pexInterval = time.Minute
+
+// How often the connections are checked for a message due, so each one gets it soon after its own interval
+const pexTicks = 6
+
+// Peers added or dropped in one message, the BEP caps both at 50
+const maxPexPeers = 50
+
+// Flags of an added peer
+const (
+	pexPrefersEncryption byte = 0x01
+	pexSeed              byte = 0x02
+	pexSupportsUTP       byte = 0x04
+	pexSupportsHolepunch byte = 0x08
+	pexReachable         byte = 0x10
+)
+
+// Peers waiting to be handed to the download loop, more are dropped until it catches up
+const discoveredBacklog = 16
+
+// peerExchange sends the peers of the session to the connected peers and hands the peers they send to the download loop
+type peerExchange struct {
+	session *Session
+
+	mutex sync.Mutex
+	// Peers last advertised on each connection, by address
+	sent map[*Client]map[string]pexPeer
+	// When the last message of each connection was sent and accepted
+	lastSent map[*Client]time.Time
+	received map[*Client]time.Time
+}
+
+type pexPeer struct {
+	peer  Peer
+	flags byte
+}
+
+func newPeerExchange(session *Session) *peerExchange {
+	return &peerExchange{
+		session:  session,
+		sent:     make(map[*Client]map[string]pexPeer),
+		lastSent: make(map[*Client]time.Time),
+		received: make(map[*Client]time.Time),
+	}
+}
+
+// How often a connection is sent a message, the session may shorten it
+func (p *peerExchange) interval() time.Duration {
+
+	if p.session.PeerExchangeInterval > 0 {
+		return p.session.PeerExchangeInterval
+	}
+
+	return pexInterval
+}
+
+// Messages arriving sooner after the previous one are dropped, a quarter of the interval covers timer jitter
+func (p *peerExchange) minInterval() time.Duration {
+	return p.interval() * 3 / 4
+}
+
+// Sends the peers we are connected to as soon as the peer tells us it supports the extension
+func (p *peerExchange) PeerHandshake(client *Client, _ *ExtendedHandshake) {
+	p.update(client, p.connectedPeers())
+}
+
+// Ingests the peers of a message, once per interval and up to the cap of the BEP
+func (p *peerExchange) HandleMessage(client *Client, payload []byte) error {
+
+	p.mutex.Lock()
+
+	if last, ok := p.received[client]; ok && time.Since(last) < p.minInterval() {
+		p.mutex.Unlock()
+		return fmt.Errorf("peer exchange message sent too soon")
+	}
+
+	p.received[client] = time.Now()
+	p.mutex.Unlock()
+
+	added, err := parsePexMessage(payload)
+
+	if err != nil {
+		return err
+	}
+
+	complete := p.session.Complete()
+	peers := make([]Peer, 0, len(added))
+
+	for _, candidate := range added {
+		// Seeds have nothing for us once we have everything
+		if complete && candidate.flags&pexSeed != 0 {
+			continue
+		}
+
+		if validPexPeer(candidate.peer, client.peer) {
+			peers = append(peers, candidate.peer)
+		}
+	}
+
+	log.Debug().Str("peer", client.peer.Address()).Int("added", len(added)).Int("usable", len(peers)).Msg("received peer exchange")
+
+	if len(peers) > 0 {
+		p.session.addDiscoveredPeers(peers)
+	}
+
+	return nil
+}
+
+// Sends the peers that connected and left since the last message to every connection supporting the extension
+func (p *peerExchange) run(ctx context.Context) {
+
+	ticker := time.NewTicker(p.interval() / pexTicks)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		clients := p.session.connectedClients()
+		current := p.connectedPeers()
+
+		p.forgetDisconnected(clients)
+
+		for _, client := range clients {
+			if client.SupportsExtension(utPex) {
+				p.update(client, current)
+			}
+		}
+	}
+}
+
+// Sends the difference between the peers last advertised on the connection and the current ones
+// Nothing is sent sooner than the interval after the previous message, peers over the cap are left for the next one
+func (p *peerExchange) update(client *Client, current map[string]pexPeer) {
+
+	p.mutex.Lock()
+
+	if last, ok := p.lastSent[client]; ok && time.Since(last) < p.interval() {
+		p.mutex.Unlock()
+		return
+	}
+
+	sent := p.sent[client]
+
+	if sent == nil {
+		sent = make(map[string]pexPeer)
+		p.sent[client] = sent
+	}
+
+	var added, dropped []pexPeer
+	self, _ := client.listenPeer()
+
+	for address, peer := range current {
+		if _, ok := sent[address]; !ok && address != self.Address() && len(added) < maxPexPeers {
+			added = append(added, peer)
+			sent[address] = peer
+		}
+	}
+
+	for address, peer := range sent {
+		if _, ok := current[address]; !ok && len(dropped) < maxPexPeers {
+			dropped = append(dropped, peer)
+			delete(sent, address)
+		}
+	}
+
+	if len(added) > 0 || len(dropped) > 0 {
+		p.lastSent[client] = time.Now()
+	}
+
+	p.mutex.Unlock()
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+
+	payload, err := encodePexMessage(added, dropped)
+
+	if err != nil {
+		return
+	}
+
+	if err := client.SendExtended(utPex, payload); err != nil {
+		log.Debug().Err(err).Str("peer", client.peer.Address()).Msg("failed to send peer exchange")
+	}
+}
+
+// Forgets the state of the connections that closed
+func (p *peerExchange) forgetDisconnected(clients []*Client) {
+
+	connected := make(map[*Client]bool, len(clients))
+
+	for _, client := range clients {
+		connected[client] = true
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for client := range p.sent {
+		if !connected[client] {
+			delete(p.sent, client)
+		}
+	}
+
+	for client := range p.lastSent {
+		if !connected[client] {
+			delete(p.lastSent, client)
+		}
+	}
+
+	for client := range p.received {
+		if !connected[client] {
+			delete(p.received, client)
+		}
+	}
+}
+
+// The peers of the session other peers can connect to, by address
+func (p *peerExchange) connectedPeers() map[string]pexPeer {
+
+	peers := make(map[string]pexPeer)
+
+	for _, client := range p.session.connectedClients() {
+		listen, ok := client.listenPeer()
+
+		if !ok {
+			continue
+		}
+
+		peer := pexPeer{peer: listen}
+
+		if client.outbound {
+			peer.flags |= pexReachable
+		}
+
+		if client.seed.Load() {
+			peer.flags |= pexSeed
+		}
+
+		peers[listen.Address()] = peer
+	}
+
+	return peers
+}
+
+// Address other peers can reach the peer at
+// Inbound connections come from an ephemeral port, the peer listens on the port of its extended handshake if it told it
+func (c *Client) listenPeer() (Peer, bool) {
+
+	if c.outbound {
+		return c.peer, true
+	}
+
+	extensions := c.PeerExtensions()
+
+	if extensions == nil || extensions.Port == 0 {
+		return Peer{}, false
+	}
+
+	return Peer{IP: c.peer.IP, Port: extensions.Port}, true
+}
+
+// Rejects addresses no peer can be reached at
+// Loopback addresses are only believed from a peer on the same host, others would make us dial ourselves
+func validPexPeer(peer Peer, from Peer) bool {
+
+	if peer.Port == 0 || peer.IP.IsUnspecified() || peer.IP.IsMulticast() || peer.IP.Equal(net.IPv4bcast) {
+		return false
+	}
+
+	if peer.IP.IsLoopback() && !from.IP.IsLoopback() {
+		return false
+	}
+
+	return true
+}
+
+func encodePexMessage(added, dropped []pexPeer) ([]byte, error) {
+
+	var added4, flags4, dropped4, added6, flags6, dropped6 []byte
+
+	for _, peer := range added {
+		if ip := peer.peer.IP.To4(); ip != nil {
+			added4 = appendCompactPeer(added4, ip, peer.peer.Port)
+			flags4 = append(flags4, peer.flags)
+		} else {
+			added6 = appendCompactPeer(added6, peer.peer.IP.To16(), peer.peer.Port)
+			flags6 = append(flags6, peer.flags)
+		}
+	}
+
+	for _, peer := range dropped {
+		if ip := peer.peer.IP.To4(); ip != nil {
+			dropped4 = appendCompactPeer(dropped4, ip, peer.peer.Port)
+		} else {
+			dropped6 = appendCompactPeer(dropped6, peer.peer.IP.To16(), peer.peer.Port)
+		}
+	}
+
+	lists := map[string][]byte{
+		"added":    added4,
+		"added.f":  flags4,
+		"dropped":  dropped4,
+		"added6":   added6,
+		"added6.f": flags6,
+		"dropped6": dropped6,
+	}
+
+	// Empty lists are left out of the message
+	dict := make(map[string]bencode.BencodeValue, len(lists))
+
+	for key, list := range lists {
+		if len(list) > 0 {
+			dict[key] = bencode.BencodeValue{Type: bencode.StringType, Str: string(list)}
+		}
+	}
+
+	value := bencode.BencodeValue{Type: bencode.DictType, Dict: dict}
+
+	buffer := bytes.Buffer{}
+
+	if err := value.Encode(&buffer); err != nil {
+		log.Error().Err(err).Msg("failed to encode peer exchange")
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func appendCompactPeer(buffer []byte, ip net.IP, port uint16) []byte {
+	buffer = append(buffer, ip...)
+	return binary.BigEndian.AppendUint16(buffer, port)
+}
+
+// Decodes the added peers of a message with their flags, dropped peers are of no use to us
+// Malformed lists are refused and peers over the cap of the BEP are ignored
+func parsePexMessage(payload []byte) ([]pexPeer, error) {
+
+	value, err := bencode.Parse(bytes.NewReader(payload))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if value.Type != bencode.DictType {
+		return nil, fmt.Errorf("peer exchange message is not a dictionary")
+	}
+
+	var added []pexPeer
+
+	for _, family := range []struct {
+		key    string
+		decode func([]byte) ([]Peer, error)
+	}{
+		{"added", DecodePeers},
+		{"added6", DecodePeers6},
+	} {
+		list, ok := value.Dict[family.key]
+
+		if !ok || list.Type != bencode.StringType || len(list.Str) == 0 {
+			continue
+		}
+
+		peers, err := family.decode([]byte(list.Str))
+
+		if err != nil {
+			return nil, err
+		}
+
+		flags := value.Dict[family.key+".f"]
+
+		for i, peer := range peers[:min(len(peers), maxPexPeers)] {
+			candidate := pexPeer{peer: peer}
+
+			if flags.Type == bencode.StringType && i < len(flags.Str) {
+				candidate.flags = flags.Str[i]
+			}
+
+			added = append(added, candidate)
+		}
+	}
+
+	return added, nil
+}
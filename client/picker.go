@@ -0,0 +1,537 @@
+package client
+
+import (
+	"Torrent-Client/torrent"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"sync"
+)
+
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	piecePartial
+	pieceVerifying
+	pieceDone
+)
+
+// piecePicker decides which blocks each peer downloads next and keeps the pieces being downloaded
+// It counts how many connected peers have each piece and starts the rarest missing piece the peer has,
+// ties are broken at random so peers spread over the swarm
+// The first piece is picked at random instead, a common piece completes sooner and gives us something to upload
+// Pieces are shared by every connection, blocks of a piece may come from several peers and a piece left
+// by a peer that disconnected is finished by the others
+// Once every missing block is requested the picker enters the endgame: peers without work request the blocks
+// still in flight, and the other requests of a block are cancelled as soon as one peer delivers it
+// Every block received goes through the picker, so it keeps counts and buckets instead of going through every piece
+type piecePicker struct {
+	mutex        sync.Mutex
+	torrent      *torrent.TorrentFile
+	availability []int
+	states       []pieceState
+	done         int
+
+	// The pieces nobody started, bucketed by availability so the rarest are found first
+	// position is the place of each of them in its bucket
+	rarity   [][]int
+	position []int
+	missing  int
+
+	// Blocks of the started pieces nobody requested, the endgame starts once this and missing are zero
+	unrequested int
+
+	partials map[int]*partialPiece
+
+	// Blocks requested on each connection and not received yet
+	requests map[*Client]map[blockRequest]struct{}
+}
+
+// A piece with some blocks requested or received
+type partialPiece struct {
+	index       int
+	buffer      []byte
+	blocks      []partialBlock
+	received    int
+	unrequested int
+
+	// Connections that delivered blocks of the piece, to know who to blame when the hash does not match
+	contributors map[*Client]struct{}
+}
+
+type partialBlock struct {
+	received   bool
+	requesters []*Client
+}
+
+// A piece whose every block arrived, ready to be checked against its hash
+type assembledPiece struct {
+	index        int
+	data         []byte
+	contributors []*Client
+}
+
+func newPiecePicker(t *torrent.TorrentFile, completed Bitfield) *piecePicker {
+
+	picker := &piecePicker{
+		torrent:      t,
+		availability: make([]int, len(t.PiecesHash)),
+		states:       make([]pieceState, len(t.PiecesHash)),
+		position:     make([]int, len(t.PiecesHash)),
+		partials:     make(map[int]*partialPiece),
+		requests:     make(map[*Client]map[blockRequest]struct{}),
+	}
+
+	for index := range picker.states {
+		if completed.HasPiece(index) {
+			picker.states[index] = pieceDone
+			picker.done++
+		} else {
+			picker.insertRarity(index)
+			picker.missing++
+		}
+	}
+
+	return picker
+}
+
+// Files a piece nobody started under its availability
+func (p *piecePicker) insertRarity(index int) {
+
+	level := max(p.availability[index], 0)
+
+	for len(p.rarity) <= level {
+		p.rarity = append(p.rarity, nil)
+	}
+
+	p.position[index] = len(p.rarity[level])
+	p.rarity[level] = append(p.rarity[level], index)
+}
+
+// Takes a piece out of its bucket, the last piece of the bucket takes its place
+func (p *piecePicker) removeRarity(index int) {
+
+	level := max(p.availability[index], 0)
+	bucket := p.rarity[level]
+	last := bucket[len(bucket)-1]
+
+	bucket[p.position[index]] = last
+	p.position[last] = p.position[index]
+	p.rarity[level] = bucket[:len(bucket)-1]
+}
+
+// Moves a piece nobody started to the bucket of its new availability
+func (p *piecePicker) changeAvailability(index int, delta int) {
+
+	if p.states[index] != pieceMissing {
+		p.availability[index] += delta
+		return
+	}
+
+	p.removeRarity(index)
+	p.availability[index] += delta
+	p.insertRarity(index)
+}
+
+// Counts the pieces of a peer that connected or sent its bitfield
+func (p *piecePicker) addBitfield(bitfield Bitfield) {
+	p.updateAvailability(bitfield, 1)
+}
+
+// Forgets the pieces of a peer that disconnected or replaced its bitfield
+func (p *piecePicker) removeBitfield(bitfield Bitfield) {
+	p.updateAvailability(bitfield, -1)
+}
+
+func (p *piecePicker) updateAvailability(bitfield Bitfield, delta int) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for index := range p.availability {
+		if bitfield.HasPiece(index) {
+			p.changeAvailability(index, delta)
+		}
+	}
+}
+
+// Counts a piece a peer announced with a have message
+func (p *piecePicker) addHave(index int) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.changeAvailability(index, 1)
+	}
+}
+
+// Returns up to count blocks of the pieces the connection should request next and records them as requested by it
+// The pieces are those of the peer, or the allowed fast ones while it chokes us
+// Started pieces are finished first, then new pieces are started so the requests may span several pieces
+func (p *piecePicker) pickBlocks(client *Client, pieces Bitfield, count int) []blockRequest {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var blocks []blockRequest
+
+	for _, partial := range p.partials {
+		if len(blocks) >= count {
+			break
+		}
+
+		if partial.unrequested > 0 && pieces.HasPiece(partial.index) {
+			blocks = p.takeBlocks(client, partial, count-len(blocks), blocks)
+		}
+	}
+
+	for len(blocks) < count {
+		index, ok := p.pickPiece(pieces)
+
+		if !ok {
+			break
+		}
+
+		blocks = p.takeBlocks(client, p.startPiece(index), count-len(blocks), blocks)
+	}
+
+	if len(blocks) == 0 && p.endgame() {
+		blocks = p.takeEndgameBlocks(client, pieces, count)
+	}
+
+	return blocks
+}
+
+// Picks the rarest missing piece the peer has, or a random one until a piece completes
+// The buckets are gone through from the rarest, the first one holding pieces of the peer ends the search
+func (p *piecePicker) pickPiece(bitfield Bitfield) (int, bool) {
+
+	if p.missing == 0 {
+		return 0, false
+	}
+
+	// Until a piece completes every candidate is as good as another, the first one after a random piece is taken
+	if p.done == 0 {
+		start := rand.Intn(len(p.states))
+
+		for i := range p.states {
+			index := (start + i) % len(p.states)
+
+			if p.states[index] == pieceMissing && bitfield.HasPiece(index) {
+				return index, true
+			}
+		}
+
+		return 0, false
+	}
+
+	var candidates []int
+
+	for _, bucket := range p.rarity {
+		for _, index := range bucket {
+			if bitfield.HasPiece(index) {
+				candidates = append(candidates, index)
+			}
+		}
+
+		if len(candidates) > 0 {
+			return candidates[rand.Intn(len(candidates))], true
+		}
+	}
+
+	return 0, false
+}
+
+func (p *piecePicker) startPiece(index int) *partialPiece {
+
+	length := int(p.torrent.CalculatePieceSize(index))
+
+	blocks := (length + maxBlockSize - 1) / maxBlockSize
+
+	partial := &partialPiece{
+		index:        index,
+		buffer:       make([]byte, length),
+		blocks:       make([]partialBlock, blocks),
+		unrequested:  blocks,
+		contributors: make(map[*Client]struct{}),
+	}
+
+	p.removeRarity(index)
+	p.missing--
+	p.unrequested += blocks
+
+	p.states[index] = piecePartial
+	p.partials[index] = partial
+
+	return partial
+}
+
+// Appends the blocks of the piece nobody requested yet
+func (p *piecePicker) takeBlocks(client *Client, partial *partialPiece, count int, blocks []blockRequest) []blockRequest {
+
+	for i := range partial.blocks {
+		if count == 0 || partial.unrequested == 0 {
+			break
+		}
+
+		block := &partial.blocks[i]
+
+		if block.received || len(block.requesters) > 0 {
+			continue
+		}
+
+		blocks = append(blocks, p.request(client, partial, i))
+		count--
+	}
+
+	return blocks
+}
+
+// Whether every block we miss is requested already
+func (p *piecePicker) endgame() bool {
+	return p.missing == 0 && p.unrequested == 0
+}
+
+// Requests blocks in flight on other connections, the ones with the fewest requesters first
+func (p *piecePicker) takeEndgameBlocks(client *Client, pieces Bitfield, count int) []blockRequest {
+
+	type candidate struct {
+		partial *partialPiece
+		block   int
+	}
+
+	var candidates []candidate
+	fewest := 0
+
+	for _, partial := range p.partials {
+		if !pieces.HasPiece(partial.index) {
+			continue
+		}
+
+		for i, block := range partial.blocks {
+			if block.received || requestedBy(block, client) {
+				continue
+			}
+
+			if len(candidates) > 0 && len(block.requesters) > fewest {
+				continue
+			}
+
+			if len(candidates) == 0 || len(block.requesters) < fewest {
+				candidates = candidates[:0]
+				fewest = len(block.requesters)
+			}
+
+			candidates = append(candidates, candidate{partial, i})
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+
+	var blocks []blockRequest
+
+	for _, c := range candidates[:min(count, len(candidates))] {
+		blocks = append(blocks, p.request(client, c.partial, c.block))
+	}
+
+	if len(blocks) > 0 {
+		log.Debug().Str("peer", client.peer.Address()).Int("blocks", len(blocks)).Msg("endgame, requesting blocks in flight again")
+	}
+
+	return blocks
+}
+
+func (p *piecePicker) request(client *Client, partial *partialPiece, block int) blockRequest {
+
+	begin := block * maxBlockSize
+	request := blockRequest{
+		index:  partial.index,
+		begin:  begin,
+		length: min(maxBlockSize, len(partial.buffer)-begin),
+	}
+
+	if len(partial.blocks[block].requesters) == 0 {
+		partial.unrequested--
+		p.unrequested--
+	}
+
+	partial.blocks[block].requesters = append(partial.blocks[block].requesters, client)
+
+	if p.requests[client] == nil {
+		p.requests[client] = make(map[blockRequest]struct{})
+	}
+
+	p.requests[client][request] = struct{}{}
+
+	return request
+}
+
+// Number of blocks requested on the connection and not received yet
+func (p *piecePicker) outstanding(client *Client) int {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.requests[client])
+}
+
+// Stores a block received on the connection
+// Returns the other connections that requested it, which should cancel their request, and the piece once every block arrived
+// Blocks that were not requested on the connection are dropped, a late answer to a cancelled request is one of them
+func (p *piecePicker) blockReceived(client *Client, index, begin int, data []byte) ([]*Client, *assembledPiece) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	request := blockRequest{index: index, begin: begin, length: len(data)}
+
+	if _, ok := p.requests[client][request]; !ok {
+		return nil, nil
+	}
+
+	delete(p.requests[client], request)
+
+	partial := p.partials[index]
+
+	if partial == nil {
+		return nil, nil
+	}
+
+	block := &partial.blocks[begin/maxBlockSize]
+
+	if block.received {
+		return nil, nil
+	}
+
+	copy(partial.buffer[begin:], data)
+	block.received = true
+	partial.received++
+	partial.contributors[client] = struct{}{}
+
+	var others []*Client
+
+	for _, requester := range block.requesters {
+		if requester != client {
+			others = append(others, requester)
+			delete(p.requests[requester], request)
+		}
+	}
+
+	block.requesters = nil
+
+	if partial.received < len(partial.blocks) {
+		return others, nil
+	}
+
+	delete(p.partials, index)
+	p.states[index] = pieceVerifying
+
+	assembled := &assembledPiece{index: index, data: partial.buffer}
+
+	for contributor := range partial.contributors {
+		assembled.contributors = append(assembled.contributors, contributor)
+	}
+
+	return others, assembled
+}
+
+// Gives back the blocks requested on the connection, when it closed or the peer choked us and dropped them
+func (p *piecePicker) releaseRequests(client *Client) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for request := range p.requests[client] {
+		p.forgetRequest(client, request)
+	}
+
+	delete(p.requests, client)
+}
+
+// Gives back a block requested on the connection, the peer rejected it
+func (p *piecePicker) releaseRequest(client *Client, request blockRequest) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.requests[client][request]; !ok {
+		return
+	}
+
+	p.forgetRequest(client, request)
+	delete(p.requests[client], request)
+}
+
+// Removes the connection from the requesters of the block
+func (p *piecePicker) forgetRequest(client *Client, request blockRequest) {
+
+	partial := p.partials[request.index]
+
+	if partial == nil {
+		return
+	}
+
+	block := &partial.blocks[request.begin/maxBlockSize]
+
+	for i, requester := range block.requesters {
+		if requester != client {
+			continue
+		}
+
+		block.requesters = append(block.requesters[:i], block.requesters[i+1:]...)
+
+		if len(block.requesters) == 0 && !block.received {
+			partial.unrequested++
+			p.unrequested++
+		}
+
+		return
+	}
+}
+
+// The assembled piece did not match its hash, it is downloaded again from scratch
+func (p *piecePicker) pieceFailed(index int) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.states[index] == pieceVerifying {
+		p.states[index] = pieceMissing
+		p.insertRarity(index)
+		p.missing++
+	}
+}
+
+// Records a piece written to disk
+func (p *piecePicker) finished(index int) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch p.states[index] {
+	case pieceDone:
+		return
+	case pieceMissing:
+		p.removeRarity(index)
+		p.missing--
+	case piecePartial:
+		p.unrequested -= p.partials[index].unrequested
+	}
+
+	p.states[index] = pieceDone
+	p.done++
+
+	delete(p.partials, index)
+}
+
+func requestedBy(block partialBlock, client *Client) bool {
+
+	for _, requester := range block.requesters {
+		if requester == client {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/storage"
+	"Torrent-Client/torrent"
+	"bytes"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+)
+
+// ResumeData is persisted next to the downloaded content so an interrupted download can skip the pieces it already has
+// The info hash ties the file to the torrent, a resume file from another torrent is considered stale
+type ResumeData struct {
+	InfoHash [20]byte
+	Bitfield Bitfield
+}
+
+// ResumePath returns where the resume file of the torrent is kept inside the output directory
+func ResumePath(t *torrent.TorrentFile, dir string) string {
+	return filepath.Join(dir, t.Name+".resume")
+}
+
+// LoadResume reads the resume file and checks it still matches the torrent
+func LoadResume(path string, t *torrent.TorrentFile) (Bitfield, error) {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(file *os.File) {
+		if err := file.Close(); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("failed to close resume file")
+		}
+	}(file)
+
+	result, err := bencode.Parse(file)
+
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("failed to parse resume file")
+		return nil, err
+	}
+
+	if result.Type != bencode.DictType {
+		return nil, fmt.Errorf("resume file is not a dictionary")
+	}
+
+	infoHash, ok := result.Dict["info hash"]
+
+	if !ok || infoHash.Type != bencode.StringType || infoHash.Str != string(t.InfoHash[:]) {
+		log.Debug().Str("path", path).Msg("resume file belongs to another torrent")
+		return nil, fmt.Errorf("resume file info hash mismatch")
+	}
+
+	bitfield, ok := result.Dict["bitfield"]
+
+	if !ok || bitfield.Type != bencode.StringType {
+		log.Debug().Str("path", path).Msg("resume file without bitfield")
+		return nil, fmt.Errorf("resume file without bitfield")
+	}
+
+	// Checked as the bitfield of a peer is, spare bits set past the last piece mean the file is corrupted
+	if err := Bitfield(bitfield.Str).Validate(len(t.PiecesHash)); err != nil {
+		log.Debug().Err(err).Str("path", path).Msg("resume file bitfield does not match the torrent")
+		return nil, fmt.Errorf("resume file bitfield mismatch: %w", err)
+	}
+
+	return Bitfield(bitfield.Str), nil
+}
+
+// SaveResume writes the resume file, replacing the previous one atomically
+func SaveResume(path string, data ResumeData) error {
+
+	value := bencode.BencodeValue{
+		Type: bencode.DictType,
+		Dict: map[string]bencode.BencodeValue{
+			"info hash": {Type: bencode.StringType, Str: string(data.InfoHash[:])},
+			"bitfield":  {Type: bencode.StringType, Str: string(data.Bitfield)},
+		},
+	}
+
+	buffer := bytes.Buffer{}
+
+	if err := value.Encode(&buffer); err != nil {
+		log.Error().Err(err).Msg("failed to encode resume data")
+		return err
+	}
+
+	temporary := path + ".tmp"
+
+	if err := os.WriteFile(temporary, buffer.Bytes(), 0644); err != nil {
+		log.Error().Err(err).Str("path", temporary).Msg("failed to write resume file")
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+// Checks whether any of the torrent files is already on disk, a fresh download has nothing to re-hash
+func hasExistingFiles(t *torrent.TorrentFile, dir string) bool {
+
+	for _, file := range t.Files {
+		if _, err := os.Stat(file.LocalPath(dir)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Loads the pieces already downloaded, falling back to hashing the data on disk when the resume file is missing or stale
+func loadCompletedPieces(t *torrent.TorrentFile, store *storage.Storage, resumePath string, existing bool) Bitfield {
+
+	bitfield, err := LoadResume(resumePath, t)
+
+	// Without data on disk there is nothing to resume, whatever the resume file says
+	if !existing {
+		return NewBitfield(len(t.PiecesHash))
+	}
+
+	if err == nil {
+		log.Debug().Str("name", t.Name).Str("path", resumePath).Msg("loaded resume file")
+		return bitfield
+	}
+
+	log.Info().Err(err).Str("name", t.Name).Msg("resume file missing or stale, checking data on disk")
+
+	return VerifyStorage(t, store).Bitfield
+}
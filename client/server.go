@@ -0,0 +1,231 @@
+package client
+
+import (
+	"Torrent-Client/mse"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Peers connected to us served at once for a torrent, on top of the ones we dial
+const defaultMaxInboundPeers = 50
+
+// Server accepts the peers connecting to us and serves them the torrents registered on it
+// Incoming handshakes for an info hash we do not hold are dropped
+// Closing the server cancels its context, which closes every connection
+type Server struct {
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mutex      sync.Mutex
+	sessions   map[[20]byte]*Session
+	encryption mse.Policy
+
+	waitGroup sync.WaitGroup
+}
+
+// NewServer listens on the port, on every interface and both IPv4 and IPv6, zero picks a free port
+func NewServer(port uint16) (*Server, error) {
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+
+	if err != nil {
+		log.Error().Err(err).Uint16("port", port).Msg("failed to listen for peers")
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	server := &Server{
+		listener: listener,
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[[20]byte]*Session),
+	}
+
+	server.waitGroup.Add(1)
+	go server.acceptLoop()
+
+	log.Info().Str("address", listener.Addr().String()).Msg("listening for peers")
+
+	return server, nil
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() uint16 {
+	return uint16(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// AddSession makes the torrent of the session available to the peers connecting to us
+func (s *Server) AddSession(session *Session) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[session.torrent.InfoHash] = session
+}
+
+// RemoveSession stops accepting peers for the torrent, peers already connected are kept
+func (s *Server) RemoveSession(infoHash [20]byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, infoHash)
+}
+
+// Close stops listening, disconnects every peer and waits for their goroutines
+func (s *Server) Close() error {
+
+	s.cancel()
+
+	err := s.listener.Close()
+	s.waitGroup.Wait()
+
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer s.waitGroup.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("failed to accept peer")
+			continue
+		}
+
+		s.waitGroup.Add(1)
+
+		go func() {
+			defer s.waitGroup.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+func (s *Server) session(infoHash [20]byte) *Session {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sessions[infoHash]
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+
+	peer := peerFromAddr(conn.RemoteAddr())
+
+	log.Debug().Str("peer", peer.Address()).Msg("peer connected")
+
+	// Closing the server interrupts the handshake, then the connection follows the server context
+	stop := context.AfterFunc(s.ctx, func() { _ = conn.Close() })
+
+	session, request, stream, err := s.acceptHandshake(conn)
+
+	if !stop() || err != nil {
+		log.Debug().Err(err).Str("peer", peer.Address()).Msg("rejected inbound handshake")
+
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to close connection")
+		}
+
+		return
+	}
+
+	// Each peer holds a socket and goroutines, past the limit the connection is dropped before any message
+	if !session.acquireInbound() {
+		log.Debug().Str("peer", peer.Address()).Str("name", session.torrent.Name).Msg("too many inbound peers, dropping connection")
+
+		if err := conn.Close(); err != nil {
+			log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to close connection")
+		}
+
+		return
+	}
+
+	defer session.releaseInbound()
+
+	wire := NewPeerConn(stream)
+	wire.Start(s.ctx)
+
+	defer func(wire *PeerConn) {
+		if err := wire.Close(); err != nil {
+			log.Error().Err(err).Str("peer", peer.Address()).Msg("failed to close connection")
+		}
+	}(wire)
+
+	client := newClient(wire, peer, session.torrent.InfoHash, request.PeerID, NewBitfield(len(session.torrent.PiecesHash)))
+	client.reserved = request.Reserved
+
+	log.Debug().Str("peer", peer.Address()).Str("name", session.torrent.Name).Msg("serving inbound peer")
+
+	session.servePeer(client)
+}
+
+// Reads the handshake of the peer and answers it when we hold the torrent it asks for
+// The MSE handshake comes first when the encryption policy allows it
+// Returns the session of the torrent, the handshake of the peer and the connection the messages follow on
+func (s *Server) acceptHandshake(conn net.Conn) (*Session, *Handshake, net.Conn, error) {
+
+	err := conn.SetDeadline(time.Now().Add(defaultPeerTimeout))
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stream, err := s.acceptEncryption(conn)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	request, err := ReadResponse(stream)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if request.Pstr != protocolIdentifier {
+		return nil, nil, nil, fmt.Errorf("unknown protocol %q", request.Pstr)
+	}
+
+	// The info hash of the MSE handshake must be the one of the BitTorrent handshake
+	if encrypted, ok := stream.(*mse.Conn); ok && encrypted.Method() != 0 && encrypted.InfoHash() != request.InfoHash {
+		return nil, nil, nil, fmt.Errorf("info hash %x differs from the encrypted handshake", request.InfoHash)
+	}
+
+	session := s.session(request.InfoHash)
+
+	if session == nil {
+		return nil, nil, nil, fmt.Errorf("unknown info hash %x", request.InfoHash)
+	}
+
+	response := NewHandshake(session.peerID, request.InfoHash)
+	response.Reserved = supportedExtensions()
+
+	_, err = stream.Write(response.Serialize())
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return session, request, stream, nil
+}
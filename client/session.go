@@ -0,0 +1,288 @@
+package client
+
+import (
+	"Torrent-Client/storage"
+	"Torrent-Client/torrent"
+	"context"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// Session is the state of a torrent shared by the download loop, its workers and the inbound connections
+// It knows which pieces are on disk and which peers are connected, so new pieces can be announced to all of them
+type Session struct {
+	torrent *torrent.TorrentFile
+	storage *storage.Storage
+	peerID  [20]byte
+	stats   *transferStats
+
+	mutex     sync.RWMutex
+	completed Bitfield
+	pieces    int
+	clients   map[*Client]struct{}
+	inbound   int
+
+	// Availability of the pieces among the connected peers and the pieces being downloaded
+	picker *piecePicker
+
+	// Signalled when peers come, go or change their interest, so free upload slots are handed out right away
+	chokerWake chan struct{}
+
+	// Protocol extensions offered to the peers that support the extension protocol
+	extensions *ExtensionRegistry
+	pex        *peerExchange
+
+	// Peers learned from other sources than the trackers, for the download loop to dial
+	discovered chan []Peer
+
+	// PeerExchangeInterval is how often the connected peers are sent the peers we know, a minute as BEP 11 asks unless set before Run
+	PeerExchangeInterval time.Duration
+
+	// MaxInboundPeers is how many peers connected to us are served at once, the ones past it are disconnected
+	// after the handshake, defaultMaxInboundPeers unless set before the server hands peers to the session
+	MaxInboundPeers int
+}
+
+// NewSession creates the session of a torrent whose data is held by the storage
+// Completed holds the pieces already verified on disk, the session keeps its own copy
+func NewSession(t *torrent.TorrentFile, store *storage.Storage, completed Bitfield, peerID [20]byte) *Session {
+
+	bitfield := NewBitfield(len(t.PiecesHash))
+	copy(bitfield, completed)
+
+	pieces := 0
+
+	for index := range t.PiecesHash {
+		if bitfield.HasPiece(index) {
+			pieces++
+		}
+	}
+
+	session := &Session{
+		torrent:    t,
+		storage:    store,
+		peerID:     peerID,
+		stats:      &transferStats{},
+		completed:  bitfield,
+		pieces:     pieces,
+		clients:    make(map[*Client]struct{}),
+		picker:     newPiecePicker(t, bitfield),
+		chokerWake: make(chan struct{}, 1),
+		extensions: NewExtensionRegistry(),
+		discovered: make(chan []Peer, discoveredBacklog),
+	}
+
+	session.pex = newPeerExchange(session)
+
+	if err := session.extensions.Register(utPex, session.pex); err != nil {
+		log.Error().Err(err).Str("name", t.Name).Msg("failed to register peer exchange")
+	}
+
+	// Peers that joined from a magnet link fetch the info dictionary from us
+	if len(t.Info) > 0 {
+		session.extensions.SetMetadataSize(len(t.Info))
+
+		if err := session.extensions.Register(utMetadata, newMetadataExchange(t.InfoHash, t.Info)); err != nil {
+			log.Error().Err(err).Str("name", t.Name).Msg("failed to register metadata exchange")
+		}
+	}
+
+	return session
+}
+
+// Run drives the periodic work of the session, choking and unchoking peers and exchanging peers with them,
+// until the context is cancelled
+func (s *Session) Run(ctx context.Context) {
+	go s.pex.run(ctx)
+	newChoker(s).run(ctx)
+}
+
+func (s *Session) Torrent() *torrent.TorrentFile {
+	return s.torrent
+}
+
+// Extensions returns the registry the protocol extensions of the session are plugged into
+func (s *Session) Extensions() *ExtensionRegistry {
+	return s.extensions
+}
+
+// HasPiece reports whether the piece is verified and on disk
+func (s *Session) HasPiece(index int) bool {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.completed.HasPiece(index)
+}
+
+// Bitfield returns a copy of the pieces on disk
+func (s *Session) Bitfield() Bitfield {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	bitfield := make(Bitfield, len(s.completed))
+	copy(bitfield, s.completed)
+
+	return bitfield
+}
+
+// Complete reports whether every piece is on disk, the session is then seeding
+func (s *Session) Complete() bool {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.pieces == len(s.torrent.PiecesHash)
+}
+
+// Uploaded returns how many bytes were served to other peers
+func (s *Session) Uploaded() int64 {
+	return s.stats.uploaded.Load()
+}
+
+// Marks the piece as on disk and tells every connected peer we have it
+func (s *Session) completePiece(index int) {
+
+	s.mutex.Lock()
+
+	if !s.completed.HasPiece(index) {
+		s.completed.SetPiece(index)
+		s.pieces++
+	}
+
+	s.mutex.Unlock()
+
+	s.picker.finished(index)
+
+	for _, client := range s.connectedClients() {
+		if err := client.SendHave(index); err != nil {
+			log.Debug().Err(err).Str("peer", client.peer.Address()).Int("index", index).Msg("failed to send have message")
+		}
+	}
+}
+
+// Tells a connected peer which pieces we have and registers it, it is told about every piece completed from now on
+// The pieces are read and the peer registered under one lock, a piece completed meanwhile is either in the first
+// message or announced by a have message that follows it
+// The pieces of the peers we dialed count for the picker, only those are downloaded from
+// The peer is registered unless the first message could not be queued
+func (s *Session) addClient(client *Client) error {
+
+	s.mutex.Lock()
+
+	bitfield := make(Bitfield, len(s.completed))
+	copy(bitfield, s.completed)
+
+	// The queue of a new connection is empty, the message does not wait while the lock is held
+	if message := availabilityMessage(client, bitfield, s.pieces == len(s.torrent.PiecesHash)); message != nil {
+		if err := client.trySend(message); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+	}
+
+	s.clients[client] = struct{}{}
+
+	if client.outbound {
+		s.picker.addBitfield(client.bitfield)
+	}
+
+	s.countPieces(client)
+	s.wakeChoker()
+
+	s.mutex.Unlock()
+
+	// A failed send means the connection closed, the message loop of the peer stops on its own
+	_ = s.grantAllowedFast(client, bitfield)
+
+	return nil
+}
+
+// Counts a peer connected to us in, false when the session already serves as many as it accepts
+func (s *Session) acquireInbound() bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	limit := s.MaxInboundPeers
+
+	if limit <= 0 {
+		limit = defaultMaxInboundPeers
+	}
+
+	if s.inbound >= limit {
+		return false
+	}
+
+	s.inbound++
+
+	return true
+}
+
+func (s *Session) releaseInbound() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inbound--
+}
+
+// Counts the pieces of the bitfield of the peer, the have messages that follow add to the count
+func (s *Session) countPieces(client *Client) {
+
+	client.pieces = 0
+
+	for index := range s.torrent.PiecesHash {
+		if client.bitfield.HasPiece(index) {
+			client.pieces++
+		}
+	}
+
+	client.seed.Store(client.pieces == len(s.torrent.PiecesHash))
+}
+
+func (s *Session) removeClient(client *Client) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.clients, client)
+
+	if client.outbound {
+		s.picker.removeBitfield(client.bitfield)
+	}
+
+	s.wakeChoker()
+}
+
+func (s *Session) connectedClients() []*Client {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	clients := make([]*Client, 0, len(s.clients))
+
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+
+	return clients
+}
+
+// Hands peers to the download loop, they are dropped when it is behind or not running, as when seeding
+func (s *Session) addDiscoveredPeers(peers []Peer) {
+	select {
+	case s.discovered <- peers:
+	default:
+		log.Debug().Str("name", s.torrent.Name).Int("peers", len(peers)).Msg("dropping discovered peers")
+	}
+}
+
+func (s *Session) wakeChoker() {
+	select {
+	case s.chokerWake <- struct{}{}:
+	default:
+	}
+}
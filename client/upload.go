@@ -0,0 +1,283 @@
+package client
+
+import (
+	"github.com/rs/zerolog/log"
+	"net"
+)
+
+// Requests an inbound peer may queue before the following ones are dropped
+const maxQueuedRequests = 256
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// Reads the requested block from disk and sends it to the peer, counting it as uploaded
+// Requests we cannot honour are dropped, or rejected with the fast extension, the peer will ask someone else
+// Choked peers are only served the allowed fast pieces we granted them
+func (s *Session) serveRequest(client *Client, request blockRequest) error {
+
+	if client.amChoking.Load() && !client.grantedFast.HasPiece(request.index) {
+		log.Debug().Str("peer", client.peer.Address()).Int("index", request.index).Msg("dropping request from choked peer")
+		return client.rejectRequest(request)
+	}
+
+	if request.index < 0 || request.index >= len(s.torrent.PiecesHash) || !s.HasPiece(request.index) {
+		log.Debug().Str("peer", client.peer.Address()).Int("index", request.index).Msg("dropping request for a piece we do not have")
+		return client.rejectRequest(request)
+	}
+
+	pieceSize := int(s.torrent.CalculatePieceSize(request.index))
+
+	// Blocks are served up to the size we accept in piece messages ourselves, as most clients do
+
+	if request.length <= 0 || request.length > maxBlockSize || request.begin < 0 || request.begin+request.length > pieceSize {
+		log.Debug().Str("peer", client.peer.Address()).Int("index", request.index).Int("begin", request.begin).Int("length", request.length).Msg("dropping invalid request")
+		return client.rejectRequest(request)
+	}
+
+	begin, _ := s.torrent.CalculateBoundsForPiece(request.index)
+	data := make([]byte, request.length)
+
+	_, err := s.storage.ReadAt(data, begin+int64(request.begin))
+
+	if err != nil {
+		log.Error().Err(err).Int("index", request.index).Int("begin", request.begin).Msg("failed to read block")
+		return err
+	}
+
+	err = client.SendPiece(request.index, request.begin, data)
+
+	if err != nil {
+		return err
+	}
+
+	s.stats.uploaded.Add(int64(request.length))
+	client.uploaded.Add(int64(request.length))
+
+	return nil
+}
+
+// Handles the messages every connection shares, whoever dialed it
+// Returns false for the messages left to the caller
+func (s *Session) handlePeerMessage(client *Client, message *Message) bool {
+
+	switch message.ID {
+	case MessageKeepAlive:
+	case MessageChoke:
+		client.choked = true
+	case MessageUnchoke:
+		client.choked = false
+	case MessageInterested:
+		client.peerInterested.Store(true)
+		s.wakeChoker()
+	case MessageNotInterested:
+		client.peerInterested.Store(false)
+		s.wakeChoker()
+	case MessageHave:
+		index, err := ParseHave(*message)
+
+		if err != nil {
+			log.Error().Err(err).Msg("could not parse have message")
+			break
+		}
+
+		// The spare bits of the last byte fit the bitfield but are no piece, as for an invalid bitfield the peer is dropped
+		if index >= len(s.torrent.PiecesHash) {
+			log.Debug().Str("peer", client.peer.Address()).Int("index", index).Msg("closing connection, have for an unknown piece")
+			_ = client.Close()
+			break
+		}
+
+		// Counted once
+		if !client.bitfield.HasPiece(index) {
+			client.bitfield.SetPiece(index)
+
+			if client.bitfield.HasPiece(index) {
+				if client.outbound {
+					s.picker.addHave(index)
+				}
+
+				client.pieces++
+				client.seed.Store(client.pieces == len(s.torrent.PiecesHash))
+			}
+		}
+	case MessageBitfield:
+		// Usually the first message, a late one replaces the pieces we know of
+		if err := Bitfield(message.Payload).Validate(len(s.torrent.PiecesHash)); err != nil {
+			log.Debug().Err(err).Str("peer", client.peer.Address()).Msg("closing connection, invalid bitfield")
+			_ = client.Close()
+			break
+		}
+
+		s.replaceBitfield(client, message.Payload)
+	case MessageHaveAll, MessageHaveNone:
+		if !client.fast() {
+			log.Debug().Str("peer", client.peer.Address()).Str("message", message.Type()).Msg("ignoring fast message, extension not negotiated")
+			break
+		}
+
+		if message.ID == MessageHaveAll {
+			s.replaceBitfield(client, fullBitfield(len(s.torrent.PiecesHash)))
+		} else {
+			s.replaceBitfield(client, NewBitfield(len(s.torrent.PiecesHash)))
+		}
+	case MessageAllowedFast:
+		if index, err := ParseHave(*message); err == nil && index < len(s.torrent.PiecesHash) {
+			client.addAllowedFast(index)
+		}
+	case MessageSuggest:
+		// Suggestions are ignored, the picker goes for the rarest pieces
+	case MessageExtended:
+		client.handleExtended(message)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Replaces the pieces of the peer, they count for the picker instead of the previous ones
+func (s *Session) replaceBitfield(client *Client, bitfield Bitfield) {
+
+	if client.outbound {
+		s.picker.removeBitfield(client.bitfield)
+		s.picker.addBitfield(bitfield)
+	}
+
+	client.bitfield = bitfield
+	s.countPieces(client)
+}
+
+// Serves a peer that connected to us until the connection fails
+// Requests are queued so a cancel received before the block went out drops it
+// We never download from these peers, their pieces are left out of the availability the picker goes by
+func (s *Session) servePeer(client *Client) {
+
+	if err := s.addClient(client); err != nil {
+		return
+	}
+
+	defer s.removeClient(client)
+
+	if err := client.startExtensions(s.extensions); err != nil {
+		return
+	}
+
+	messages := client.conn.Messages()
+
+	defer func() {
+		log.Debug().Err(client.conn.Err()).Str("peer", client.peer.Address()).Msg("inbound peer disconnected")
+	}()
+
+	var queue []blockRequest
+
+	for {
+		var message *Message
+		var ok bool
+
+		if len(queue) == 0 {
+			message, ok = <-messages
+		} else {
+			select {
+			case message, ok = <-messages:
+			default:
+				request := queue[0]
+				queue = queue[1:]
+
+				if err := s.serveRequest(client, request); err != nil {
+					return
+				}
+
+				continue
+			}
+		}
+
+		if !ok {
+			return
+		}
+
+		if s.handlePeerMessage(client, message) {
+			continue
+		}
+
+		switch message.ID {
+		case MessageRequest:
+			index, begin, length, err := ParseRequest(*message)
+
+			if err != nil {
+				continue
+			}
+
+			if len(queue) >= maxQueuedRequests {
+				log.Debug().Str("peer", client.peer.Address()).Msg("request queue full, dropping request")
+				continue
+			}
+
+			queue = append(queue, blockRequest{index, begin, length})
+		case MessageCancel:
+			index, begin, length, err := ParseRequest(*message)
+
+			if err != nil {
+				continue
+			}
+
+			request := blockRequest{index, begin, length}
+			queued := len(queue)
+			queue = removeRequest(queue, request)
+
+			// With the fast extension every request gets an answer, a cancelled one is rejected
+			if len(queue) < queued {
+				if err := client.rejectRequest(request); err != nil {
+					return
+				}
+			}
+		case MessagePiece:
+			log.Debug().Str("peer", client.peer.Address()).Msg("ignoring unrequested piece")
+		default:
+			log.Warn().Int("id", int(message.ID)).Msg("unexpected message")
+		}
+	}
+}
+
+func removeRequest(queue []blockRequest, request blockRequest) []blockRequest {
+
+	for i, queued := range queue {
+		if queued == request {
+			return append(queue[:i], queue[i+1:]...)
+		}
+	}
+
+	return queue
+}
+
+func hasAnyPiece(bitfield Bitfield) bool {
+
+	for _, b := range bitfield {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Builds the peer of an inbound connection from its remote address
+func peerFromAddr(addr net.Addr) Peer {
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+
+	if !ok {
+		return Peer{}
+	}
+
+	ip := tcpAddr.IP
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return Peer{IP: ip, Port: uint16(tcpAddr.Port)}
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"Torrent-Client/storage"
+	"Torrent-Client/torrent"
+	"crypto/sha1"
+	"github.com/rs/zerolog/log"
+	"runtime"
+	"sync"
+)
+
+// VerifyReport tells which pieces of a torrent are backed by valid data on disk
+type VerifyReport struct {
+	Bitfield Bitfield
+	Valid    int
+	Pieces   int
+	Files    []FileReport
+}
+
+// FileReport is the completion of a single file
+// Pieces counts every piece overlapping the file, a piece shared with a neighbour file counts for both
+type FileReport struct {
+	File           torrent.File
+	Pieces         int
+	CompletePieces int
+}
+
+// Complete reports whether every piece of the torrent is valid
+func (r *VerifyReport) Complete() bool {
+	return r.Valid == r.Pieces
+}
+
+// Complete reports whether every piece overlapping the file is valid
+func (r FileReport) Complete() bool {
+	return r.CompletePieces == r.Pieces
+}
+
+// Percent is the share of valid pieces of the file
+func (r FileReport) Percent() float64 {
+
+	if r.Pieces == 0 {
+		return 100
+	}
+
+	return float64(r.CompletePieces) / float64(r.Pieces) * 100
+}
+
+// Verify hashes the data of the torrent found in dir without creating or modifying any file
+func Verify(t *torrent.TorrentFile, dir string) (*VerifyReport, error) {
+
+	store, err := storage.NewReadOnlyStorage(t, dir)
+
+	if err != nil {
+		log.Error().Err(err).Str("name", t.Name).Msg("failed to open storage")
+		return nil, err
+	}
+
+	defer func(store *storage.Storage) {
+		if err := store.Close(); err != nil {
+			log.Error().Err(err).Str("name", t.Name).Msg("failed to close files")
+		}
+	}(store)
+
+	return VerifyStorage(t, store), nil
+}
+
+// VerifyStorage hashes every piece held by the storage, spreading the work across the CPU cores
+// Pieces that cannot be read, because a file is missing or too short, are reported as invalid
+func VerifyStorage(t *torrent.TorrentFile, store *storage.Storage) *VerifyReport {
+
+	bitfield := NewBitfield(len(t.PiecesHash))
+	mutex := sync.Mutex{}
+
+	indexes := make(chan int)
+	workers := sync.WaitGroup{}
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			// Each worker reuses its buffer, pieces are at most one piece length long
+			buffer := make([]byte, t.PieceLength)
+
+			for index := range indexes {
+				begin, end := t.CalculateBoundsForPiece(index)
+				data := buffer[:end-begin]
+
+				if _, err := store.ReadAt(data, begin); err != nil {
+					log.Debug().Err(err).Int("index", index).Msg("could not read piece")
+					continue
+				}
+
+				if sha1.Sum(data) != t.PiecesHash[index] {
+					log.Debug().Int("index", index).Msg("piece hash mismatch")
+					continue
+				}
+
+				mutex.Lock()
+				bitfield.SetPiece(index)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for index := range t.PiecesHash {
+		indexes <- index
+	}
+
+	close(indexes)
+	workers.Wait()
+
+	return newVerifyReport(t, bitfield)
+}
+
+// Builds the report of the torrent and each of its files from the valid pieces
+func newVerifyReport(t *torrent.TorrentFile, bitfield Bitfield) *VerifyReport {
+
+	report := &VerifyReport{
+		Bitfield: bitfield,
+		Pieces:   len(t.PiecesHash),
+		Files:    make([]FileReport, len(t.Files)),
+	}
+
+	for index := range t.PiecesHash {
+		if bitfield.HasPiece(index) {
+			report.Valid++
+		}
+	}
+
+	for i, file := range t.Files {
+		report.Files[i].File = file
+
+		if file.Length == 0 || t.PieceLength == 0 {
+			continue
+		}
+
+		first := int(file.Offset / t.PieceLength)
+		last := int((file.Offset + file.Length - 1) / t.PieceLength)
+
+		for index := first; index <= last; index++ {
+			report.Files[i].Pieces++
+
+			if bitfield.HasPiece(index) {
+				report.Files[i].CompletePieces++
+			}
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/dht"
+	"Torrent-Client/lsd"
+	"Torrent-Client/mse"
+	"Torrent-Client/torrent"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes returned by the binary
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitInterrupted = 130 // Conventional code of a process stopped by SIGINT
+)
+
+const usage = `usage: torrent-client <command> [flags] <file.torrent>
+
+commands:
+  download  download the torrent content into the output directory, and seed it with -seed
+            a magnet link may be given instead of the torrent file
+  info      print the metadata of the torrent file
+  verify    check the data in the output directory against the piece hashes
+
+run "torrent-client <command> -h" to see the flags of a command
+`
+
+// errUsage is returned when the command line is invalid, the usage was already printed
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+
+	var err error
+
+	switch args[0] {
+	case "download":
+		err = runDownload(args[1:])
+	case "info":
+		err = runInfo(args[1:])
+	case "verify":
+		err = runVerify(args[1:])
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+		return exitOK
+	case "-h", "-help", "--help":
+		// As for the flags of a command, asking for help with a flag is a usage error
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		return exitUsage
+	}
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "interrupted")
+		return exitInterrupted
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+// commonFlags are the flags shared by every command
+type commonFlags struct {
+	logLevel string
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.logLevel, "log-level", "info", "log level (trace, debug, info, warn, error, disabled)")
+}
+
+// setupLogging configures the global logger to write human readable output to stderr
+func (c *commonFlags) setupLogging() error {
+
+	level, err := zerolog.ParseLevel(c.logLevel)
+
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", c.logLevel)
+	}
+
+	zerolog.SetGlobalLevel(level)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.TimeOnly})
+
+	return nil
+}
+
+// parseCommand parses the flags of a command and loads the torrent file given as the only argument
+func parseCommand(fs *flag.FlagSet, common *commonFlags, args []string) (torrent.TorrentFile, error) {
+
+	path, err := parseArguments(fs, common, args)
+
+	if err != nil {
+		return torrent.TorrentFile{}, err
+	}
+
+	return torrent.NewTorrentFrom(path)
+}
+
+// parseArguments parses the flags of a command and returns its only argument
+// Flags may come before or after the argument, the flag package stops at the first argument so parsing resumes after it
+// Everything after a "--" terminator is an argument, even when it starts with a dash
+func parseArguments(fs *flag.FlagSet, common *commonFlags, args []string) (string, error) {
+
+	var positional, rest []string
+
+	if i := terminatorIndex(fs, args); i >= 0 {
+		args, rest = args[:i], args[i+1:]
+	}
+
+	for {
+		// The flag package already printed the error and the usage
+		if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+			return "", err
+		} else if err != nil {
+			return "", errUsage
+		}
+
+		if fs.NArg() == 0 {
+			break
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	positional = append(positional, rest...)
+
+	if len(positional) != 1 {
+		fmt.Fprintf(fs.Output(), "expected exactly one torrent file, got %d arguments\n", len(positional))
+		fs.Usage()
+		return "", errUsage
+	}
+
+	if err := common.setupLogging(); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return "", errUsage
+	}
+
+	return positional[0], nil
+}
+
+// terminatorIndex returns the position of the "--" ending the flags, -1 without one
+// A "--" following a flag that takes a value is that value, as the flag package reads it
+func terminatorIndex(fs *flag.FlagSet, args []string) int {
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			return i
+		}
+
+		if len(arg) < 2 || arg[0] != '-' || strings.Contains(arg, "=") {
+			continue
+		}
+
+		// Unknown flags are left for the flag package to report
+		f := fs.Lookup(strings.TrimPrefix(arg[1:], "-"))
+
+		if f == nil {
+			continue
+		}
+
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+
+		// The next argument is the value of the flag
+		i++
+	}
+
+	return -1
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: torrent-client %s [flags] <file.torrent>\n\nflags:\n", name)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func runDownload(args []string) error {
+
+	common := commonFlags{}
+	fs := newFlagSet("download")
+	common.register(fs)
+
+	output := fs.String("o", ".", "output directory")
+	port := fs.Uint("port", uint(client.Port), "port to listen on and announce to the trackers")
+	seed := fs.Bool("seed", false, "keep seeding once the download completes, until interrupted")
+	useDHT := fs.Bool("dht", true, "find peers on the DHT, listening on the same port over UDP")
+	dhtState := fs.String("dht-state", defaultDHTStatePath(), "file keeping the DHT nodes between runs, empty to start afresh every time")
+	useLSD := fs.Bool("lsd", true, "find peers on the local network and announce the torrent to it")
+	encryption := fs.String("encryption", mse.Prefer.String(), "obfuscate peer connections with MSE (disabled, prefer, require)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: torrent-client download [flags] <file.torrent | magnet link>\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+
+	source, err := parseArguments(fs, &common, args)
+
+	if err != nil {
+		return err
+	}
+
+	if *port == 0 || *port > 65535 {
+		fmt.Fprintf(fs.Output(), "invalid port %d\n", *port)
+		return errUsage
+	}
+
+	policy, err := mse.ParsePolicy(*encryption)
+
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return errUsage
+	}
+
+	// Interrupting the download lets it save its progress and tell the trackers it stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts := client.DownloadOptions{
+		Path:       *output,
+		Port:       uint16(*port),
+		Seed:       *seed,
+		Encryption: policy,
+	}
+
+	if *useDHT {
+		node, err := startDHT(opts.Port, *dhtState)
+
+		if err != nil {
+			log.Warn().Err(err).Msg("not using the dht")
+		} else {
+			defer stopDHT(node, *dhtState)
+			opts.DHT = node
+		}
+	}
+
+	if *useLSD {
+		service, err := startLSD()
+
+		if err != nil {
+			log.Warn().Err(err).Msg("not looking for local peers")
+		} else {
+			defer func(service *lsd.Service) {
+				if err := service.Close(); err != nil {
+					log.Error().Err(err).Msg("failed to close lsd service")
+				}
+			}(service)
+
+			opts.LSD = service
+		}
+	}
+
+	var t torrent.TorrentFile
+
+	if torrent.IsMagnet(source) {
+		magnet, err := torrent.ParseMagnet(source)
+
+		if err != nil {
+			return err
+		}
+
+		// The info dictionary comes from the peers, which are then asked for the content
+		t, err = client.FetchMetadata(ctx, magnet, opts)
+
+		if err != nil {
+			return err
+		}
+
+		opts.Peers = magnet.Peers
+	} else {
+		t, err = torrent.NewTorrentFrom(source)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return client.DownloadTorrentContext(ctx, &t, opts)
+}
+
+// Returns where the DHT state is kept by default, empty when the user has no configuration directory
+func defaultDHTStatePath() string {
+
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "torrent-client", "dht.dat")
+}
+
+// Creates the DHT node with the state of the previous run, the download bootstraps it
+func startDHT(port uint16, path string) (*dht.Node, error) {
+
+	node, err := dht.NewNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		if err := node.Load(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn().Err(err).Str("path", path).Msg("ignoring dht state")
+		}
+	}
+
+	if err := node.Listen(net.JoinHostPort("", strconv.Itoa(int(port)))); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// Saves the nodes for the next run and stops the node
+func stopDHT(node *dht.Node, path string) {
+
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("failed to create dht state directory")
+		} else if err := node.Save(path); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("failed to save dht state")
+		}
+	}
+
+	if err := node.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close dht node")
+	}
+}
+
+func startLSD() (*lsd.Service, error) {
+
+	service, err := lsd.NewService()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := service.Listen(); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+func runInfo(args []string) error {
+
+	common := commonFlags{}
+	fs := newFlagSet("info")
+	common.register(fs)
+
+	t, err := parseCommand(fs, &common, args)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("name:          %s\n", t.Name)
+	fmt.Printf("info hash:     %s\n", hex.EncodeToString(t.InfoHash[:]))
+	for i, tier := range t.AnnounceTiers() {
+		for _, tracker := range tier {
+			fmt.Printf("tracker:       [tier %d] %s\n", i, tracker)
+		}
+	}
+
+	fmt.Printf("length:        %d\n", t.Length)
+	fmt.Printf("piece length:  %d\n", t.PieceLength)
+	fmt.Printf("pieces:        %d\n", len(t.PiecesHash))
+
+	if len(t.Files) > 1 {
+		fmt.Printf("files:\n")
+
+		for _, file := range t.Files {
+			fmt.Printf("  %12d  %s\n", file.Length, filepath.Join(file.Path...))
+		}
+	}
+
+	if t.Comment != "" {
+		fmt.Printf("comment:       %s\n", t.Comment)
+	}
+
+	if t.CreatedBy != "" {
+		fmt.Printf("created by:    %s\n", t.CreatedBy)
+	}
+
+	if t.CreationDate != 0 {
+		fmt.Printf("creation date: %s\n", time.Unix(t.CreationDate, 0).UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func runVerify(args []string) error {
+
+	common := commonFlags{}
+	fs := newFlagSet("verify")
+	common.register(fs)
+
+	output := fs.String("o", ".", "directory holding the downloaded data")
+
+	t, err := parseCommand(fs, &common, args)
+
+	if err != nil {
+		return err
+	}
+
+	report, err := client.Verify(&t, *output)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range report.Files {
+		fmt.Printf("%6.2f%%  %s\n", file.Percent(), filepath.Join(file.File.Path...))
+	}
+
+	fmt.Printf("%d of %d pieces valid\n", report.Valid, report.Pieces)
+
+	if !report.Complete() {
+		return fmt.Errorf("%d pieces missing or corrupted", report.Pieces-report.Valid)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+const demoTorrent = "../../test_data/demo.torrent"
+
+func TestRun_ExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no arguments", nil, exitUsage},
+		{"unknown command", []string{"fetch", demoTorrent}, exitUsage},
+		{"help flag", []string{"-h"}, exitUsage},
+		{"help flag of a command", []string{"info", "-h"}, exitUsage},
+		{"help command", []string{"help"}, exitOK},
+		{"no torrent file", []string{"info"}, exitUsage},
+		{"two torrent files", []string{"info", demoTorrent, demoTorrent}, exitUsage},
+		{"unknown flag", []string{"info", "-bogus", demoTorrent}, exitUsage},
+		{"invalid flag value", []string{"download", "-port", "many", demoTorrent}, exitUsage},
+		{"flags after the file", []string{"info", demoTorrent, "-log-level", "disabled"}, exitOK},
+		{"invalid flag after the file", []string{"info", demoTorrent, "-log-level", "loud"}, exitUsage},
+		{"missing torrent file", []string{"info", "-log-level", "disabled", "missing.torrent"}, exitFailure},
+		{"invalid encryption", []string{"download", "-encryption", "always", demoTorrent}, exitUsage},
+		{"zero port", []string{"download", "-port", "0", demoTorrent}, exitUsage},
+		{"port out of range", []string{"download", demoTorrent, "-port", "70000"}, exitUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, run(tt.args))
+		})
+	}
+}
+
+func TestParseArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		source string
+		output string
+		seed   bool
+		err    bool
+	}{
+		{"flags before the file", []string{"-o", "out", "file.torrent"}, "file.torrent", "out", false, false},
+		{"flags after the file", []string{"file.torrent", "-o", "out", "-seed"}, "file.torrent", "out", true, false},
+		{"flags around the file", []string{"-seed", "file.torrent", "-o", "out"}, "file.torrent", "out", true, false},
+		{"terminator", []string{"-o", "out", "--", "-file.torrent"}, "-file.torrent", "out", false, false},
+		{"terminator after a bool flag", []string{"-seed", "--", "-file.torrent"}, "-file.torrent", ".", true, false},
+		{"terminator as a flag value", []string{"-o", "--", "file.torrent", "-seed"}, "file.torrent", "--", true, false},
+		{"terminator after a flag value", []string{"-o", "--", "--", "-o"}, "-o", "--", false, false},
+		{"flags after the terminator", []string{"file.torrent", "--", "-o", "out"}, "", "", false, true},
+		{"no file", []string{"-o", "out"}, "", "", false, true},
+		{"two files", []string{"a.torrent", "b.torrent"}, "", "", false, true},
+		{"missing flag value", []string{"file.torrent", "-o"}, "", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			common := commonFlags{}
+			fs := newFlagSet("download")
+			fs.SetOutput(io.Discard)
+			common.register(fs)
+
+			output := fs.String("o", ".", "output directory")
+			seed := fs.Bool("seed", false, "keep seeding")
+
+			source, err := parseArguments(fs, &common, tt.args)
+
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.source, source)
+			assert.Equal(t, tt.output, *output)
+			assert.Equal(t, tt.seed, *seed)
+		})
+	}
+}
+
+func TestParseArguments_Help(t *testing.T) {
+	common := commonFlags{}
+	fs := newFlagSet("info")
+	fs.SetOutput(io.Discard)
+	common.register(fs)
+
+	_, err := parseArguments(fs, &common, []string{"file.torrent", "-h"})
+	assert.True(t, errors.Is(err, flag.ErrHelp))
+}
@@ -0,0 +1,320 @@
+package dht
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/torrent"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// KRPC (BEP 5), every message is a bencoded dictionary sent in a single UDP packet
+// The t key pairs responses with queries, y tells a query (q), a response (r) and an error (e) apart
+const (
+	kindQuery    = "q"
+	kindResponse = "r"
+	kindError    = "e"
+)
+
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// Error codes of the error messages
+const (
+	errorGeneric  = 201
+	errorServer   = 202
+	errorProtocol = 203
+	errorMethod   = 204
+)
+
+// Compact node info is the 20 byte node ID followed by the compact IPv4 address and port
+const compactNodeSize = 26
+
+type message struct {
+	transaction string
+	kind        string
+
+	// Queries
+	method string
+	args   arguments
+
+	// Responses
+	response response
+
+	// Errors
+	errorCode    int
+	errorMessage string
+}
+
+type arguments struct {
+	id          [20]byte
+	target      [20]byte
+	infoHash    [20]byte
+	port        int
+	impliedPort bool
+	token       string
+}
+
+type response struct {
+	id     [20]byte
+	nodes  []nodeInfo
+	values []torrent.Peer
+	token  string
+}
+
+// nodeInfo is the contact of a node, as found in compact node info
+type nodeInfo struct {
+	id   [20]byte
+	addr *net.UDPAddr
+}
+
+// KRPCError is the error message a node answered a query with
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func (m *message) encode() ([]byte, error) {
+
+	dict := map[string]bencode.BencodeValue{
+		"t": {Type: bencode.StringType, Str: m.transaction},
+		"y": {Type: bencode.StringType, Str: m.kind},
+	}
+
+	switch m.kind {
+	case kindQuery:
+		args := map[string]bencode.BencodeValue{
+			"id": {Type: bencode.StringType, Str: string(m.args.id[:])},
+		}
+
+		switch m.method {
+		case methodFindNode:
+			args["target"] = bencode.BencodeValue{Type: bencode.StringType, Str: string(m.args.target[:])}
+		case methodGetPeers:
+			args["info_hash"] = bencode.BencodeValue{Type: bencode.StringType, Str: string(m.args.infoHash[:])}
+		case methodAnnouncePeer:
+			args["info_hash"] = bencode.BencodeValue{Type: bencode.StringType, Str: string(m.args.infoHash[:])}
+			args["port"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: int64(m.args.port)}
+			args["token"] = bencode.BencodeValue{Type: bencode.StringType, Str: m.args.token}
+
+			if m.args.impliedPort {
+				args["implied_port"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: 1}
+			}
+		}
+
+		dict["q"] = bencode.BencodeValue{Type: bencode.StringType, Str: m.method}
+		dict["a"] = bencode.BencodeValue{Type: bencode.DictType, Dict: args}
+	case kindResponse:
+		// A response without nodes, token or values simply lacks the key
+		r := map[string]bencode.BencodeValue{
+			"id": {Type: bencode.StringType, Str: string(m.response.id[:])},
+		}
+
+		if len(m.response.nodes) > 0 {
+			r["nodes"] = bencode.BencodeValue{Type: bencode.StringType, Str: string(encodeNodes(m.response.nodes))}
+		}
+
+		if m.response.token != "" {
+			r["token"] = bencode.BencodeValue{Type: bencode.StringType, Str: m.response.token}
+		}
+
+		if len(m.response.values) > 0 {
+			values := make([]bencode.BencodeValue, 0, len(m.response.values))
+
+			for _, peer := range m.response.values {
+				values = append(values, bencode.BencodeValue{Type: bencode.StringType, Str: string(encodePeer(peer))})
+			}
+
+			r["values"] = bencode.BencodeValue{Type: bencode.ListType, List: values}
+		}
+
+		dict["r"] = bencode.BencodeValue{Type: bencode.DictType, Dict: r}
+	case kindError:
+		dict["e"] = bencode.BencodeValue{Type: bencode.ListType, List: []bencode.BencodeValue{
+			{Type: bencode.IntegerType, Int: int64(m.errorCode)},
+			{Type: bencode.StringType, Str: m.errorMessage},
+		}}
+	default:
+		return nil, fmt.Errorf("unknown message kind %q", m.kind)
+	}
+
+	value := bencode.BencodeValue{Type: bencode.DictType, Dict: dict}
+	buffer := bytes.Buffer{}
+
+	if err := value.Encode(&buffer); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Decodes a packet, the keys of the kind of message it is must be present and well formed
+func decodeMessage(packet []byte) (*message, error) {
+
+	value, err := bencode.Parse(bytes.NewReader(packet))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if value.Type != bencode.DictType {
+		return nil, fmt.Errorf("message is not a dictionary")
+	}
+
+	m := &message{
+		transaction: stringValue(value.Dict["t"]),
+		kind:        stringValue(value.Dict["y"]),
+	}
+
+	if m.transaction == "" {
+		return nil, fmt.Errorf("message without transaction ID")
+	}
+
+	switch m.kind {
+	case kindQuery:
+		m.method = stringValue(value.Dict["q"])
+		args := value.Dict["a"]
+
+		if m.method == "" || args.Type != bencode.DictType {
+			return nil, fmt.Errorf("query without method or arguments")
+		}
+
+		if m.args.id, err = nodeID(args.Dict["id"]); err != nil {
+			return nil, err
+		}
+
+		switch m.method {
+		case methodFindNode:
+			if m.args.target, err = nodeID(args.Dict["target"]); err != nil {
+				return nil, err
+			}
+		case methodGetPeers, methodAnnouncePeer:
+			if m.args.infoHash, err = nodeID(args.Dict["info_hash"]); err != nil {
+				return nil, err
+			}
+		}
+
+		if port := args.Dict["port"]; port.Type == bencode.IntegerType {
+			m.args.port = int(port.Int)
+		}
+
+		if implied := args.Dict["implied_port"]; implied.Type == bencode.IntegerType {
+			m.args.impliedPort = implied.Int != 0
+		}
+
+		m.args.token = stringValue(args.Dict["token"])
+	case kindResponse:
+		r := value.Dict["r"]
+
+		if r.Type != bencode.DictType {
+			return nil, fmt.Errorf("response without values")
+		}
+
+		if m.response.id, err = nodeID(r.Dict["id"]); err != nil {
+			return nil, err
+		}
+
+		if nodes := r.Dict["nodes"]; nodes.Type == bencode.StringType {
+			if m.response.nodes, err = decodeNodes([]byte(nodes.Str)); err != nil {
+				return nil, err
+			}
+		}
+
+		if values := r.Dict["values"]; values.Type == bencode.ListType {
+			for _, value := range values.List {
+				// Malformed peers are skipped, the rest of the response is still useful
+				if value.Type == bencode.StringType && len(value.Str) == 6 {
+					peers, _ := torrent.DecodePeers([]byte(value.Str))
+					m.response.values = append(m.response.values, peers...)
+				}
+			}
+		}
+
+		m.response.token = stringValue(r.Dict["token"])
+	case kindError:
+		e := value.Dict["e"]
+
+		if e.Type == bencode.ListType && len(e.List) == 2 {
+			m.errorCode = int(e.List[0].Int)
+			m.errorMessage = e.List[1].Str
+		}
+	default:
+		return nil, fmt.Errorf("unknown message kind %q", m.kind)
+	}
+
+	return m, nil
+}
+
+func stringValue(value bencode.BencodeValue) string {
+
+	if value.Type != bencode.StringType {
+		return ""
+	}
+
+	return value.Str
+}
+
+func nodeID(value bencode.BencodeValue) ([20]byte, error) {
+
+	if value.Type != bencode.StringType || len(value.Str) != 20 {
+		return [20]byte{}, fmt.Errorf("invalid node ID")
+	}
+
+	return [20]byte([]byte(value.Str)), nil
+}
+
+func encodePeer(peer torrent.Peer) []byte {
+	return binary.BigEndian.AppendUint16(append([]byte{}, peer.IP.To4()...), peer.Port)
+}
+
+func encodeNodes(nodes []nodeInfo) []byte {
+
+	buffer := make([]byte, 0, len(nodes)*compactNodeSize)
+
+	for _, node := range nodes {
+		ip := node.addr.IP.To4()
+
+		// Compact node info only holds IPv4 addresses
+		if ip == nil {
+			continue
+		}
+
+		buffer = append(buffer, node.id[:]...)
+		buffer = append(buffer, ip...)
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(node.addr.Port))
+	}
+
+	return buffer
+}
+
+func decodeNodes(buffer []byte) ([]nodeInfo, error) {
+
+	if len(buffer)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("malformed compact node info")
+	}
+
+	nodes := make([]nodeInfo, 0, len(buffer)/compactNodeSize)
+
+	for offset := 0; offset < len(buffer); offset += compactNodeSize {
+		entry := buffer[offset : offset+compactNodeSize]
+
+		nodes = append(nodes, nodeInfo{
+			id: [20]byte(entry[0:20]),
+			addr: &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, entry[20:24]...)),
+				Port: int(binary.BigEndian.Uint16(entry[24:26])),
+			},
+		})
+	}
+
+	return nodes, nil
+}
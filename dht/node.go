@@ -0,0 +1,670 @@
+package dht
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/torrent"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mainline DHT (BEP 5), a Kademlia network where the nodes closest to an info hash keep the peers of its torrent
+// Lookups walk towards the info hash, asking the closest nodes known for closer ones until no closer node answers
+const defaultQueryTimeout = 2 * time.Second
+
+// Queries in flight at once during a lookup
+const alpha = 3
+
+const maxPacketSize = 65536
+
+// How often expired peers are dropped and stale buckets refreshed
+const maintenanceInterval = time.Minute
+
+// DefaultBootstrapNodes are well known nodes that answer anyone, used to join the network with an empty table
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var errNoNodes = errors.New("no dht nodes known")
+var errQueryTimeout = errors.New("dht node did not respond")
+
+// Node is a DHT node, it answers the queries of other nodes and looks up the peers of torrents
+// Listen starts serving, Close stops the node
+type Node struct {
+	// Timeout is how long a query waits for the response
+	Timeout time.Duration
+	// BootstrapNodes are the host:port addresses Bootstrap joins the network through
+	BootstrapNodes []string
+
+	id     [20]byte
+	table  *routingTable
+	tokens *tokenSecret
+	store  *peerStore
+
+	conn   *net.UDPConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex        sync.Mutex
+	transactions map[string]*transaction
+}
+
+// transaction is a query waiting for its response
+type transaction struct {
+	addr     *net.UDPAddr
+	response chan *message
+}
+
+type lookupResult struct {
+	node  nodeInfo
+	token string
+}
+
+// NewNode creates a node with a random ID, Load restores the ID and the nodes of a previous run
+func NewNode() (*Node, error) {
+
+	var id [20]byte
+
+	if _, err := rand.Read(id[:]); err != nil {
+		log.Error().Err(err).Msg("failed to generate node ID")
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Node{
+		Timeout:        defaultQueryTimeout,
+		BootstrapNodes: DefaultBootstrapNodes,
+		id:             id,
+		table:          newRoutingTable(id),
+		tokens:         newTokenSecret(),
+		store:          newPeerStore(),
+		ctx:            ctx,
+		cancel:         cancel,
+		transactions:   make(map[string]*transaction),
+	}, nil
+}
+
+func (n *Node) ID() [20]byte {
+	return n.id
+}
+
+// Addr returns the address the node listens on, nil before Listen
+func (n *Node) Addr() *net.UDPAddr {
+
+	if n.conn == nil {
+		return nil
+	}
+
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns how many nodes the routing table holds
+func (n *Node) Nodes() int {
+	return n.table.size()
+}
+
+// Listen opens the UDP socket and starts answering queries
+func (n *Node) Listen(address string) error {
+
+	addr, err := net.ResolveUDPAddr("udp4", address)
+
+	if err != nil {
+		log.Error().Err(err).Str("address", address).Msg("failed to resolve dht address")
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+
+	if err != nil {
+		log.Error().Err(err).Str("address", address).Msg("failed to listen for dht")
+		return err
+	}
+
+	n.conn = conn
+
+	go n.serve()
+	go n.maintain()
+
+	log.Debug().Str("address", conn.LocalAddr().String()).Msg("dht node listening")
+
+	return nil
+}
+
+func (n *Node) Close() error {
+
+	n.cancel()
+
+	if n.conn == nil {
+		return nil
+	}
+
+	return n.conn.Close()
+}
+
+// Load restores the ID and the routing table saved by Save, it must be called before Listen
+func (n *Node) Load(path string) error {
+
+	if n.conn != nil {
+		return fmt.Errorf("dht state must be loaded before listening")
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	value, err := bencode.Parse(bytes.NewReader(data))
+
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("failed to parse dht state")
+		return err
+	}
+
+	if value.Type != bencode.DictType {
+		return fmt.Errorf("dht state is not a dictionary")
+	}
+
+	id, err := nodeID(value.Dict["id"])
+
+	if err != nil {
+		return err
+	}
+
+	nodes, err := decodeNodes([]byte(stringValue(value.Dict["nodes"])))
+
+	if err != nil {
+		return err
+	}
+
+	n.id = id
+	n.table = newRoutingTable(id)
+
+	for _, node := range nodes {
+		n.table.insert(node)
+	}
+
+	log.Debug().Str("path", path).Int("nodes", n.table.size()).Msg("loaded dht state")
+
+	return nil
+}
+
+// Save writes the ID and the routing table, replacing the previous file atomically
+func (n *Node) Save(path string) error {
+
+	value := bencode.BencodeValue{
+		Type: bencode.DictType,
+		Dict: map[string]bencode.BencodeValue{
+			"id":    {Type: bencode.StringType, Str: string(n.id[:])},
+			"nodes": {Type: bencode.StringType, Str: string(encodeNodes(n.table.nodes()))},
+		},
+	}
+
+	buffer := bytes.Buffer{}
+
+	if err := value.Encode(&buffer); err != nil {
+		log.Error().Err(err).Msg("failed to encode dht state")
+		return err
+	}
+
+	temporary := path + ".tmp"
+
+	if err := os.WriteFile(temporary, buffer.Bytes(), 0644); err != nil {
+		log.Error().Err(err).Str("path", temporary).Msg("failed to write dht state")
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+// Bootstrap joins the network through the bootstrap nodes and the nodes already known, then looks up our own ID
+// to fill the table with the nodes close to us
+func (n *Node) Bootstrap(ctx context.Context) error {
+
+	wg := sync.WaitGroup{}
+
+	for _, address := range n.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+
+		if err != nil {
+			log.Debug().Err(err).Str("address", address).Msg("failed to resolve bootstrap node")
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// The response adds the node to the table
+			if _, err := n.Ping(ctx, addr); err != nil {
+				log.Debug().Err(err).Str("address", address).Msg("bootstrap node did not respond")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if _, _, err := n.lookup(ctx, n.id, methodFindNode); err != nil {
+		return err
+	}
+
+	log.Debug().Int("nodes", n.table.size()).Msg("dht bootstrapped")
+
+	return nil
+}
+
+// Ping asks the node at the address for its ID
+func (n *Node) Ping(ctx context.Context, addr *net.UDPAddr) ([20]byte, error) {
+
+	response, err := n.query(ctx, nodeInfo{addr: addr}, &message{method: methodPing})
+
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	return response.response.id, nil
+}
+
+// GetPeers looks up the peers of the torrent
+func (n *Node) GetPeers(ctx context.Context, infoHash [20]byte) ([]torrent.Peer, error) {
+	_, peers, err := n.lookup(ctx, infoHash, methodGetPeers)
+	return peers, err
+}
+
+// Announce looks up the peers of the torrent and tells the closest nodes we have it on the port
+// The peers found are returned even when no node accepted the announce
+func (n *Node) Announce(ctx context.Context, infoHash [20]byte, port uint16) ([]torrent.Peer, error) {
+
+	results, peers, err := n.lookup(ctx, infoHash, methodGetPeers)
+
+	if err != nil {
+		return peers, err
+	}
+
+	accepted := make(chan bool, len(results))
+
+	for _, result := range results {
+		if result.token == "" {
+			accepted <- false
+			continue
+		}
+
+		go func() {
+			_, err := n.query(ctx, result.node, &message{
+				method: methodAnnouncePeer,
+				args:   arguments{infoHash: infoHash, port: int(port), token: result.token},
+			})
+
+			if err != nil {
+				log.Debug().Err(err).Str("node", result.node.addr.String()).Msg("announce refused")
+			}
+
+			accepted <- err == nil
+		}()
+	}
+
+	announced := 0
+
+	for range results {
+		if <-accepted {
+			announced++
+		}
+	}
+
+	log.Debug().Int("nodes", announced).Int("peers", len(peers)).Msg("announced to the dht")
+
+	if announced == 0 {
+		return peers, fmt.Errorf("no dht node accepted the announce")
+	}
+
+	return peers, nil
+}
+
+// Iterative lookup of the target, queries go to the closest nodes not asked yet until the K closest nodes known have answered
+// Returns the K closest nodes that answered with their tokens and the peers they returned
+func (n *Node) lookup(ctx context.Context, target [20]byte, method string) ([]lookupResult, []torrent.Peer, error) {
+
+	candidates := n.table.closest(target, bucketSize)
+
+	if len(candidates) == 0 {
+		return nil, nil, errNoNodes
+	}
+
+	seen := make(map[[20]byte]bool)
+	queried := make(map[[20]byte]bool)
+
+	for _, candidate := range candidates {
+		seen[candidate.id] = true
+	}
+
+	var responded []lookupResult
+	var peers []torrent.Peer
+	peerSeen := make(map[string]bool)
+
+	type reply struct {
+		node     nodeInfo
+		response *message
+		err      error
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, peers, err
+		}
+
+		var batch []nodeInfo
+
+		for _, candidate := range candidates[:min(len(candidates), bucketSize)] {
+			if !queried[candidate.id] && len(batch) < alpha {
+				queried[candidate.id] = true
+				batch = append(batch, candidate)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		replies := make(chan reply, len(batch))
+
+		for _, node := range batch {
+			go func() {
+				query := &message{method: method, args: arguments{target: target, infoHash: target}}
+				response, err := n.query(ctx, node, query)
+				replies <- reply{node, response, err}
+			}()
+		}
+
+		for range batch {
+			r := <-replies
+
+			if r.err != nil {
+				candidates = removeNode(candidates, r.node.id)
+				continue
+			}
+
+			responded = append(responded, lookupResult{
+				node:  nodeInfo{id: r.response.response.id, addr: r.node.addr},
+				token: r.response.response.token,
+			})
+
+			for _, peer := range r.response.response.values {
+				if address := peer.Address(); !peerSeen[address] {
+					peerSeen[address] = true
+					peers = append(peers, peer)
+				}
+			}
+
+			for _, node := range r.response.response.nodes {
+				if !seen[node.id] && node.id != n.id && node.addr.Port != 0 {
+					seen[node.id] = true
+					candidates = append(candidates, node)
+				}
+			}
+		}
+
+		sortByDistance(candidates, target)
+	}
+
+	nodes := make([]nodeInfo, len(responded))
+	tokens := make(map[[20]byte]string, len(responded))
+
+	for i, result := range responded {
+		nodes[i] = result.node
+		tokens[result.node.id] = result.token
+	}
+
+	sortByDistance(nodes, target)
+
+	closest := make([]lookupResult, 0, bucketSize)
+
+	for _, node := range nodes[:min(len(nodes), bucketSize)] {
+		closest = append(closest, lookupResult{node: node, token: tokens[node.id]})
+	}
+
+	return closest, peers, nil
+}
+
+func removeNode(nodes []nodeInfo, id [20]byte) []nodeInfo {
+
+	for i, node := range nodes {
+		if node.id == id {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+
+	return nodes
+}
+
+// Random so that a third party cannot guess the IDs of our queries and forge their responses
+func newTransactionID() string {
+
+	buffer := make([]byte, 2)
+
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(buffer)
+
+	return string(buffer)
+}
+
+// Sends the query and waits for its response, the node answering is added to the table
+// A node that does not answer in time is marked as failing
+func (n *Node) query(ctx context.Context, node nodeInfo, query *message) (*message, error) {
+
+	if n.conn == nil {
+		return nil, fmt.Errorf("dht node is not listening")
+	}
+
+	pending := &transaction{addr: node.addr, response: make(chan *message, 1)}
+
+	n.mutex.Lock()
+	key := newTransactionID()
+
+	// Drawn again while it collides with a query still in flight
+	for n.transactions[key] != nil {
+		key = newTransactionID()
+	}
+
+	n.transactions[key] = pending
+	n.mutex.Unlock()
+
+	defer func() {
+		n.mutex.Lock()
+		delete(n.transactions, key)
+		n.mutex.Unlock()
+	}()
+
+	query.transaction = key
+	query.kind = kindQuery
+	query.args.id = n.id
+
+	packet, err := query.encode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := n.conn.WriteToUDP(packet, node.addr); err != nil {
+		log.Debug().Err(err).Str("node", node.addr.String()).Msg("failed to send dht query")
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.Timeout)
+	defer timer.Stop()
+
+	var response *message
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.ctx.Done():
+		return nil, net.ErrClosed
+	case <-timer.C:
+		n.table.failed(node.id)
+		return nil, errQueryTimeout
+	case response = <-pending.response:
+	}
+
+	if response.kind == kindError {
+		return nil, &KRPCError{Code: response.errorCode, Message: response.errorMessage}
+	}
+
+	n.table.insert(nodeInfo{id: response.response.id, addr: node.addr})
+
+	return response, nil
+}
+
+// Reads the packets of the socket, queries are answered and responses handed to the query waiting for them
+func (n *Node) serve() {
+
+	buffer := make([]byte, maxPacketSize)
+
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug().Err(err).Msg("failed to read dht packet")
+			continue
+		}
+
+		m, err := decodeMessage(buffer[:size])
+
+		if err != nil {
+			log.Trace().Err(err).Str("node", addr.String()).Msg("ignoring invalid dht packet")
+			continue
+		}
+
+		if m.kind == kindQuery {
+			n.handleQuery(m, addr)
+			continue
+		}
+
+		n.mutex.Lock()
+		pending, ok := n.transactions[m.transaction]
+
+		// Responses must come from the node that was queried
+		if ok && pending.addr.IP.Equal(addr.IP) && pending.addr.Port == addr.Port {
+			delete(n.transactions, m.transaction)
+		} else {
+			ok = false
+		}
+
+		n.mutex.Unlock()
+
+		if ok {
+			pending.response <- m
+		}
+	}
+}
+
+func (n *Node) handleQuery(query *message, addr *net.UDPAddr) {
+
+	reply := &message{transaction: query.transaction, kind: kindResponse}
+
+	switch query.method {
+	case methodPing:
+	case methodFindNode:
+		reply.response.nodes = n.table.closest(query.args.target, bucketSize)
+	case methodGetPeers:
+		reply.response.token = n.tokens.token(addr.IP)
+		reply.response.values = n.store.get(query.args.infoHash, maxResponsePeers)
+		reply.response.nodes = n.table.closest(query.args.infoHash, bucketSize)
+	case methodAnnouncePeer:
+		if !n.tokens.valid(query.args.token, addr.IP) {
+			n.reply(&message{transaction: query.transaction, kind: kindError, errorCode: errorProtocol, errorMessage: "bad token"}, addr)
+			return
+		}
+
+		// Peers behind a NAT announce the port of the DHT socket, which is the one we see
+		port := query.args.port
+
+		if query.args.impliedPort {
+			port = addr.Port
+		}
+
+		if port <= 0 || port > 65535 {
+			n.reply(&message{transaction: query.transaction, kind: kindError, errorCode: errorProtocol, errorMessage: "invalid port"}, addr)
+			return
+		}
+
+		n.store.add(query.args.infoHash, torrent.Peer{IP: addr.IP.To4(), Port: uint16(port)})
+
+		log.Debug().Str("peer", addr.IP.String()).Int("port", port).Msg("peer announced to the dht")
+	default:
+		n.reply(&message{transaction: query.transaction, kind: kindError, errorCode: errorMethod, errorMessage: "method unknown"}, addr)
+		return
+	}
+
+	reply.response.id = n.id
+	n.reply(reply, addr)
+
+	n.table.insert(nodeInfo{id: query.args.id, addr: addr})
+}
+
+func (n *Node) reply(m *message, addr *net.UDPAddr) {
+
+	packet, err := m.encode()
+
+	if err != nil {
+		return
+	}
+
+	if _, err := n.conn.WriteToUDP(packet, addr); err != nil {
+		log.Debug().Err(err).Str("node", addr.String()).Msg("failed to send dht response")
+	}
+}
+
+// Drops expired peers and refreshes the buckets no node was heard from lately
+func (n *Node) maintain() {
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.store.expire()
+
+		for _, prefix := range n.table.staleBuckets(bucketRefreshInterval) {
+			if _, _, err := n.lookup(n.ctx, randomIDInBucket(n.id, prefix), methodFindNode); err != nil {
+				log.Debug().Err(err).Int("bucket", prefix).Msg("failed to refresh bucket")
+			}
+		}
+	}
+}
+
+// Returns a random ID sharing exactly prefix leading bits with ours
+func randomIDInBucket(self [20]byte, prefix int) [20]byte {
+
+	var id [20]byte
+	_, _ = rand.Read(id[:])
+
+	for i := 0; i < prefix; i++ {
+		mask := byte(0x80) >> (i % 8)
+		id[i/8] = id[i/8]&^mask | self[i/8]&mask
+	}
+
+	mask := byte(0x80) >> (prefix % 8)
+	id[prefix/8] = id[prefix/8]&^mask | ^self[prefix/8]&mask
+
+	return id
+}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"Torrent-Client/torrent"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tokens handed out with get_peers responses are the hash of the querier IP and a secret (BEP 5)
+// The secret changes every five minutes and tokens of the previous one are still accepted, so a token lives up to ten minutes
+const tokenRotation = 5 * time.Minute
+
+// Announced peers are forgotten when they do not announce again within this delay
+const peerExpiry = 30 * time.Minute
+
+// Bounds of the announced peers kept, announces over them are dropped
+const (
+	maxStoredTorrents = 1024
+	maxStoredPeers    = 256
+)
+
+// Peers returned by a get_peers response, enough for the response to fit a UDP packet
+const maxResponsePeers = 64
+
+type tokenSecret struct {
+	mutex    sync.Mutex
+	current  [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func newTokenSecret() *tokenSecret {
+
+	secret := &tokenSecret{rotated: time.Now()}
+	_, _ = rand.Read(secret.current[:])
+	secret.previous = secret.current
+
+	return secret
+}
+
+// Rotates the secret when it is due, lazily since tokens are only needed when queried
+func (s *tokenSecret) rotate() {
+
+	if time.Since(s.rotated) < tokenRotation {
+		return
+	}
+
+	s.previous = s.current
+	_, _ = rand.Read(s.current[:])
+	s.rotated = time.Now()
+}
+
+func (s *tokenSecret) token(ip net.IP) string {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rotate()
+
+	return tokenFor(s.current, ip)
+}
+
+func (s *tokenSecret) valid(token string, ip net.IP) bool {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.rotate()
+
+	for _, secret := range [][20]byte{s.current, s.previous} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tokenFor(secret, ip))) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	sum := sha1.Sum(append(secret[:], ip...))
+
+	return string(sum[:])
+}
+
+// peerStore keeps the peers announced to us for each info hash
+type peerStore struct {
+	mutex sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+}
+
+type storedPeer struct {
+	peer      torrent.Peer
+	announced time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		peers: make(map[[20]byte]map[string]storedPeer),
+	}
+}
+
+func (s *peerStore) add(infoHash [20]byte, peer torrent.Peer) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	peers, ok := s.peers[infoHash]
+
+	if !ok {
+		if len(s.peers) >= maxStoredTorrents {
+			return
+		}
+
+		peers = make(map[string]storedPeer)
+		s.peers[infoHash] = peers
+	}
+
+	address := peer.Address()
+
+	if _, ok := peers[address]; !ok && len(peers) >= maxStoredPeers {
+		return
+	}
+
+	peers[address] = storedPeer{peer: peer, announced: time.Now()}
+}
+
+// Returns up to count peers announced for the info hash, expired ones are dropped on the way
+func (s *peerStore) get(infoHash [20]byte, count int) []torrent.Peer {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []torrent.Peer
+
+	for address, stored := range s.peers[infoHash] {
+		if time.Since(stored.announced) >= peerExpiry {
+			delete(s.peers[infoHash], address)
+			continue
+		}
+
+		if len(result) < count {
+			result = append(result, stored.peer)
+		}
+	}
+
+	if peers, ok := s.peers[infoHash]; ok && len(peers) == 0 {
+		delete(s.peers, infoHash)
+	}
+
+	return result
+}
+
+// Drops the peers that did not announce again in time
+func (s *peerStore) expire() {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for infoHash, peers := range s.peers {
+		for address, stored := range peers {
+			if time.Since(stored.announced) >= peerExpiry {
+				delete(peers, address)
+			}
+		}
+
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package dht
+
+import (
+	"bytes"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kademlia routing table, nodes are kept in buckets by the length of the prefix their ID shares with ours
+// Each bucket holds at most K nodes so we know many nodes close to us and a few far away
+const bucketSize = 8
+
+// Nodes that failed to answer this many queries in a row are replaced by the next node that fits their bucket
+const maxFailures = 2
+
+// Buckets untouched for this long are refreshed with a lookup of an ID they cover (BEP 5)
+const bucketRefreshInterval = 15 * time.Minute
+
+type contact struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+type bucket struct {
+	contacts []*contact
+	changed  time.Time
+}
+
+type routingTable struct {
+	self [20]byte
+
+	mutex   sync.Mutex
+	buckets [160]bucket
+}
+
+func newRoutingTable(self [20]byte) *routingTable {
+
+	table := &routingTable{self: self}
+	now := time.Now()
+
+	for i := range table.buckets {
+		table.buckets[i].changed = now
+	}
+
+	return table
+}
+
+func distance(a, b [20]byte) [20]byte {
+
+	var result [20]byte
+
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
+
+// Number of leading bits the IDs share
+func commonPrefix(a, b [20]byte) int {
+
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return 160
+}
+
+// Adds a node that answered us or queried us, or marks it seen when it is already known
+// A full bucket only makes room by evicting a node that stopped answering
+func (t *routingTable) insert(node nodeInfo) bool {
+
+	prefix := commonPrefix(t.self, node.id)
+
+	if prefix == 160 || node.addr == nil || node.addr.Port == 0 {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	b := &t.buckets[prefix]
+	now := time.Now()
+
+	for i, c := range b.contacts {
+		if c.id == node.id {
+			c.addr = node.addr
+			c.lastSeen = now
+			c.failures = 0
+			// Least recently seen first
+			b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), c)
+			b.changed = now
+			return true
+		}
+	}
+
+	added := &contact{id: node.id, addr: node.addr, lastSeen: now}
+
+	if len(b.contacts) < bucketSize {
+		b.contacts = append(b.contacts, added)
+		b.changed = now
+		return true
+	}
+
+	for i, c := range b.contacts {
+		if c.failures >= maxFailures {
+			b.contacts = append(append(b.contacts[:i:i], b.contacts[i+1:]...), added)
+			b.changed = now
+			return true
+		}
+	}
+
+	return false
+}
+
+// Records a query the node did not answer
+func (t *routingTable) failed(id [20]byte) {
+
+	prefix := commonPrefix(t.self, id)
+
+	if prefix == 160 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, c := range t.buckets[prefix].contacts {
+		if c.id == id {
+			c.failures++
+			return
+		}
+	}
+}
+
+// Returns up to count nodes closest to the target, closest first
+// Nodes that stopped answering are left out
+func (t *routingTable) closest(target [20]byte, count int) []nodeInfo {
+
+	t.mutex.Lock()
+
+	var nodes []nodeInfo
+
+	for i := range t.buckets {
+		for _, c := range t.buckets[i].contacts {
+			if c.failures < maxFailures {
+				nodes = append(nodes, nodeInfo{id: c.id, addr: c.addr})
+			}
+		}
+	}
+
+	t.mutex.Unlock()
+
+	sortByDistance(nodes, target)
+
+	return nodes[:min(len(nodes), count)]
+}
+
+// Returns every node of the table
+func (t *routingTable) nodes() []nodeInfo {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var nodes []nodeInfo
+
+	for i := range t.buckets {
+		for _, c := range t.buckets[i].contacts {
+			nodes = append(nodes, nodeInfo{id: c.id, addr: c.addr})
+		}
+	}
+
+	return nodes
+}
+
+func (t *routingTable) size() int {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	size := 0
+
+	for i := range t.buckets {
+		size += len(t.buckets[i].contacts)
+	}
+
+	return size
+}
+
+// Returns the prefix lengths of the buckets no node was added to or heard from for the interval
+// Only buckets up to the deepest one holding nodes count, deeper ones cover IDs too close to us to exist
+func (t *routingTable) staleBuckets(interval time.Duration) []int {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deepest := -1
+
+	for i := range t.buckets {
+		if len(t.buckets[i].contacts) > 0 {
+			deepest = i
+		}
+	}
+
+	var stale []int
+
+	for i := 0; i <= deepest; i++ {
+		if time.Since(t.buckets[i].changed) >= interval {
+			stale = append(stale, i)
+		}
+	}
+
+	return stale
+}
+
+func sortByDistance(nodes []nodeInfo, target [20]byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		a := distance(nodes[i].id, target)
+		b := distance(nodes[j].id, target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
@@ -0,0 +1,303 @@
+package lsd
+
+import (
+	"Torrent-Client/torrent"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery (BEP 14), peers on the same network announce the torrents they have to a multicast group
+// Announces look like HTTP requests, BT-SEARCH followed by the host, the port the peer listens on and the info hashes
+// Only the IPv4 group is joined
+const DefaultGroup = "239.192.152.143:6771"
+
+// How often a torrent is announced, the BEP asks for no more than one announce a minute
+const defaultInterval = 5 * time.Minute
+const minInterval = time.Minute
+
+const maxPacketSize = 1400
+
+// Subscribers that do not keep up lose the peers announced meanwhile
+const peersBacklog = 16
+
+// Service announces torrents to the local network and hands the peers announcing them to their subscribers
+// Listen joins the group, Close leaves it
+type Service struct {
+	// Group is the multicast address the announces are sent to and received on
+	Group string
+	// Interval is how often the torrents being downloaded or seeded are announced again
+	Interval time.Duration
+
+	// Announces carrying our cookie are our own, looped back by the group
+	cookie string
+	group  *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+
+	mutex       sync.Mutex
+	subscribers map[[20]byte][]chan torrent.Peer
+	announced   map[[20]byte]time.Time
+}
+
+// announce is a parsed announce message
+type announce struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+func NewService() (*Service, error) {
+
+	cookie := make([]byte, 8)
+
+	if _, err := rand.Read(cookie); err != nil {
+		log.Error().Err(err).Msg("failed to generate lsd cookie")
+		return nil, err
+	}
+
+	return &Service{
+		Group:       DefaultGroup,
+		Interval:    defaultInterval,
+		cookie:      hex.EncodeToString(cookie),
+		subscribers: make(map[[20]byte][]chan torrent.Peer),
+		announced:   make(map[[20]byte]time.Time),
+	}, nil
+}
+
+// Listen joins the multicast group on the default interface and starts receiving announces
+func (s *Service) Listen() error {
+
+	group, err := net.ResolveUDPAddr("udp4", s.Group)
+
+	if err != nil {
+		log.Error().Err(err).Str("group", s.Group).Msg("failed to resolve lsd group")
+		return err
+	}
+
+	if !group.IP.IsMulticast() {
+		return fmt.Errorf("lsd group %q is not a multicast address", s.Group)
+	}
+
+	listen, err := net.ListenMulticastUDP("udp4", nil, group)
+
+	if err != nil {
+		log.Error().Err(err).Str("group", s.Group).Msg("failed to join lsd group")
+		return err
+	}
+
+	send, err := net.ListenUDP("udp4", nil)
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open lsd socket")
+		_ = listen.Close()
+		return err
+	}
+
+	s.group = group
+	s.listen = listen
+	s.send = send
+
+	go s.serve()
+
+	log.Debug().Str("group", s.Group).Msg("listening for local peers")
+
+	return nil
+}
+
+func (s *Service) Close() error {
+
+	if s.listen == nil {
+		return nil
+	}
+
+	err := s.listen.Close()
+
+	if sendErr := s.send.Close(); err == nil {
+		err = sendErr
+	}
+
+	return err
+}
+
+// Subscribe returns the channel the peers announcing the torrent are sent on, until the returned function is called
+func (s *Service) Subscribe(infoHash [20]byte) (<-chan torrent.Peer, func()) {
+
+	peers := make(chan torrent.Peer, peersBacklog)
+
+	s.mutex.Lock()
+	s.subscribers[infoHash] = append(s.subscribers[infoHash], peers)
+	s.mutex.Unlock()
+
+	unsubscribe := func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		subscribers := s.subscribers[infoHash]
+
+		for i, subscriber := range subscribers {
+			if subscriber == peers {
+				s.subscribers[infoHash] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+
+		if len(s.subscribers[infoHash]) == 0 {
+			delete(s.subscribers, infoHash)
+		}
+	}
+
+	return peers, unsubscribe
+}
+
+// Announce tells the local network we have the torrent on the port
+// Announces of the same torrent within a minute of the previous one are skipped
+func (s *Service) Announce(infoHash [20]byte, port uint16) error {
+
+	if s.send == nil {
+		return fmt.Errorf("lsd service is not listening")
+	}
+
+	s.mutex.Lock()
+
+	if last, ok := s.announced[infoHash]; ok && time.Since(last) < minInterval {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	s.announced[infoHash] = time.Now()
+	s.mutex.Unlock()
+
+	packet := encodeAnnounce(s.Group, port, [][20]byte{infoHash}, s.cookie)
+
+	if _, err := s.send.WriteToUDP(packet, s.group); err != nil {
+		log.Debug().Err(err).Str("group", s.Group).Msg("failed to send lsd announce")
+		return err
+	}
+
+	log.Debug().Str("info hash", hex.EncodeToString(infoHash[:])).Uint16("port", port).Msg("announced to local peers")
+
+	return nil
+}
+
+// Reads the announces of the group and hands the peer to the subscribers of its torrents
+func (s *Service) serve() {
+
+	buffer := make([]byte, maxPacketSize)
+
+	for {
+		size, addr, err := s.listen.ReadFromUDP(buffer)
+
+		if err != nil {
+			return
+		}
+
+		message, err := parseAnnounce(buffer[:size])
+
+		if err != nil {
+			log.Trace().Err(err).Str("peer", addr.String()).Msg("ignoring invalid lsd announce")
+			continue
+		}
+
+		if message.cookie == s.cookie {
+			continue
+		}
+
+		peer := torrent.Peer{IP: addr.IP, Port: message.port}
+
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			peer.IP = ip4
+		}
+
+		s.mutex.Lock()
+
+		for _, infoHash := range message.infoHashes {
+			for _, subscriber := range s.subscribers[infoHash] {
+				select {
+				case subscriber <- peer:
+				default:
+					log.Debug().Str("peer", peer.Address()).Msg("dropping local peer, subscriber is busy")
+				}
+			}
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+func encodeAnnounce(host string, port uint16, infoHashes [][20]byte, cookie string) []byte {
+
+	buffer := bytes.Buffer{}
+
+	buffer.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buffer.WriteString("Host: " + host + "\r\n")
+	buffer.WriteString("Port: " + strconv.Itoa(int(port)) + "\r\n")
+
+	for _, infoHash := range infoHashes {
+		buffer.WriteString("Infohash: " + hex.EncodeToString(infoHash[:]) + "\r\n")
+	}
+
+	if cookie != "" {
+		buffer.WriteString("cookie: " + cookie + "\r\n")
+	}
+
+	buffer.WriteString("\r\n\r\n")
+
+	return buffer.Bytes()
+}
+
+// Parses an announce, info hashes that are not 40 hex characters are skipped
+func parseAnnounce(packet []byte) (announce, error) {
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(packet)))
+
+	line, err := reader.ReadLine()
+
+	if err != nil {
+		return announce{}, err
+	}
+
+	if !strings.HasPrefix(line, "BT-SEARCH * HTTP/") {
+		return announce{}, fmt.Errorf("not an lsd announce")
+	}
+
+	header, err := reader.ReadMIMEHeader()
+
+	// The blank lines closing the announce are optional
+	if err != nil && len(header) == 0 {
+		return announce{}, err
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+
+	if err != nil || port == 0 {
+		return announce{}, fmt.Errorf("invalid lsd port %q", header.Get("Port"))
+	}
+
+	message := announce{port: uint16(port), cookie: header.Get("Cookie")}
+
+	for _, value := range header.Values("Infohash") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+
+		if err != nil || len(decoded) != 20 {
+			continue
+		}
+
+		message.infoHashes = append(message.infoHashes, [20]byte(decoded))
+	}
+
+	if len(message.infoHashes) == 0 {
+		return announce{}, fmt.Errorf("lsd announce without info hash")
+	}
+
+	return message, nil
+}
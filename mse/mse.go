@@ -0,0 +1,509 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Message Stream Encryption, also known as Protocol Encryption, hides the BitTorrent handshake from traffic shaping
+// The peers agree on a secret with a Diffie-Hellman exchange, the info hash proves they want the same torrent, and
+// the stream that follows is encrypted with RC4, or only the handshake is when both settle for plaintext
+//
+// A (dialer) -> B: Ya, PadA
+// B -> A: Yb, PadB
+// A -> B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+// B -> A: ENCRYPT(VC, crypto_select, len(PadD), PadD), ENCRYPT2(payload)
+//
+// SKEY is the info hash, VC eight zero bytes, and the pads random bytes that hide the length of the messages
+// We dial without initial payload and with empty PadC and PadD, and accept peers that send them
+
+// CryptoMethod is a bit of crypto_provide and crypto_select
+type CryptoMethod uint32
+
+const (
+	// CryptoPlaintext obfuscates the handshake only, the payload that follows is sent as it is
+	CryptoPlaintext CryptoMethod = 1
+	// CryptoRC4 encrypts the whole stream
+	CryptoRC4 CryptoMethod = 2
+)
+
+// Policy says which connections are obfuscated
+type Policy int
+
+const (
+	// Disabled only makes plain BitTorrent connections
+	Disabled Policy = iota
+	// Prefer dials with MSE and falls back to a plain connection, and accepts both
+	Prefer
+	// Require only makes connections encrypted with RC4
+	Require
+)
+
+// The 768 bit prime and the generator of the key exchange
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var generator = big.NewInt(2)
+
+const keySize = 96
+
+// The private key is 160 bits, as the specification advises
+const privateKeySize = 20
+
+const maxPadSize = 512
+
+// Bytes of the RC4 key stream thrown away, the first ones leak the key
+const discardSize = 1024
+
+// The start of a plain BitTorrent handshake, the protocol string and its length
+var plainHandshake = []byte("\x13BitTorrent protocol")
+
+var verificationConstant = make([]byte, 8)
+
+var (
+	errUnknownInfoHash = errors.New("mse: unknown info hash")
+	errNoCryptoMethod  = errors.New("mse: no common crypto method")
+	errNotSynchronized = errors.New("mse: handshake not found in stream")
+)
+
+// Conn is a connection whose MSE handshake completed, reads and writes go through the negotiated crypto method
+type Conn struct {
+	net.Conn
+
+	reader   io.Reader
+	writer   io.Writer
+	method   CryptoMethod
+	infoHash [20]byte
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+// Method returns the negotiated crypto method, zero when an incoming peer sent a plain BitTorrent handshake
+func (c *Conn) Method() CryptoMethod {
+	return c.method
+}
+
+// InfoHash returns the info hash the peer used as SKEY, zero for a plain connection
+func (c *Conn) InfoHash() [20]byte {
+	return c.infoHash
+}
+
+// Initiate runs the MSE handshake of a connection we dialed, the BitTorrent handshake follows on the returned connection
+// Prefer offers both crypto methods, Require only RC4
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+
+	provide := policy.methods()
+
+	if provide == 0 {
+		return nil, fmt.Errorf("mse: encryption disabled")
+	}
+
+	private, public, err := newKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pad, err := randomPad()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	other := make([]byte, keySize)
+
+	if _, err := io.ReadFull(reader, other); err != nil {
+		return nil, err
+	}
+
+	secret := sharedSecret(private, other)
+
+	encrypt, err := newCipher("keyA", secret, infoHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	decrypt, err := newCipher("keyB", secret, infoHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// VC, crypto_provide, len(PadC) and len(IA), both pads are empty
+	negotiation := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(negotiation[8:12], uint32(provide))
+	encrypt.XORKeyStream(negotiation, negotiation)
+
+	request := hash([]byte("req1"), secret)
+	request = append(request, xor(hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), secret))...)
+	request = append(request, negotiation...)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	// B answers with ENCRYPT(VC) after PadB, found by encrypting VC ourselves
+	expected := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(expected, verificationConstant)
+
+	if err := synchronize(reader, expected, maxPadSize); err != nil {
+		return nil, err
+	}
+
+	answer := make([]byte, 4+2)
+
+	if _, err := io.ReadFull(reader, answer); err != nil {
+		return nil, err
+	}
+
+	decrypt.XORKeyStream(answer, answer)
+
+	selected := CryptoMethod(binary.BigEndian.Uint32(answer[0:4]))
+
+	if (selected != CryptoPlaintext && selected != CryptoRC4) || selected&provide == 0 {
+		return nil, fmt.Errorf("mse: peer selected crypto method %d", selected)
+	}
+
+	if err := skipPad(reader, decrypt, binary.BigEndian.Uint16(answer[4:6])); err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("peer", conn.RemoteAddr().String()).Uint32("method", uint32(selected)).Msg("encrypted handshake done")
+
+	return newConn(conn, reader, encrypt, decrypt, selected, infoHash), nil
+}
+
+// Accept runs the MSE handshake of a connection a peer dialed, the info hash it asks for must be one of ours
+// With Prefer a peer that starts a plain BitTorrent handshake is let through, and RC4 is picked when it is offered
+// With Require only RC4 is accepted
+func Accept(conn net.Conn, infoHashes [][20]byte, policy Policy) (*Conn, error) {
+
+	allowed := policy.methods()
+
+	if allowed == 0 {
+		return nil, fmt.Errorf("mse: encryption disabled")
+	}
+
+	reader := bufio.NewReader(conn)
+
+	start, err := reader.Peek(len(plainHandshake))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, plainHandshake) {
+		if policy == Require {
+			return nil, fmt.Errorf("mse: plain handshake refused")
+		}
+
+		return &Conn{Conn: conn, reader: reader, writer: conn}, nil
+	}
+
+	other := make([]byte, keySize)
+
+	if _, err := io.ReadFull(reader, other); err != nil {
+		return nil, err
+	}
+
+	private, public, err := newKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pad, err := randomPad()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return nil, err
+	}
+
+	secret := sharedSecret(private, other)
+
+	if err := synchronize(reader, hash([]byte("req1"), secret), maxPadSize); err != nil {
+		return nil, err
+	}
+
+	obfuscated := make([]byte, 20)
+
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, err
+	}
+
+	infoHash, ok := findInfoHash(xor(obfuscated, hash([]byte("req3"), secret)), infoHashes)
+
+	if !ok {
+		return nil, errUnknownInfoHash
+	}
+
+	decrypt, err := newCipher("keyA", secret, infoHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt, err := newCipher("keyB", secret, infoHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	negotiation := make([]byte, 8+4+2)
+
+	if _, err := io.ReadFull(reader, negotiation); err != nil {
+		return nil, err
+	}
+
+	decrypt.XORKeyStream(negotiation, negotiation)
+
+	if !bytes.Equal(negotiation[0:8], verificationConstant) {
+		return nil, fmt.Errorf("mse: bad verification constant")
+	}
+
+	provide := CryptoMethod(binary.BigEndian.Uint32(negotiation[8:12]))
+
+	if err := skipPad(reader, decrypt, binary.BigEndian.Uint16(negotiation[12:14])); err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 2)
+
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+
+	decrypt.XORKeyStream(length, length)
+
+	selected := CryptoRC4
+
+	if provide&allowed&CryptoRC4 == 0 {
+		selected = CryptoPlaintext
+	}
+
+	if provide&allowed&selected == 0 {
+		return nil, errNoCryptoMethod
+	}
+
+	// VC, crypto_select and an empty PadD
+	answer := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(answer[8:12], uint32(selected))
+	encrypt.XORKeyStream(answer, answer)
+
+	if _, err := conn.Write(answer); err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("peer", conn.RemoteAddr().String()).Uint32("method", uint32(selected)).Msg("encrypted handshake accepted")
+
+	encrypted := newConn(conn, reader, encrypt, decrypt, selected, infoHash)
+
+	// The initial payload of the peer is encrypted with RC4 whatever the method, the stream after it follows the method
+	if initial := binary.BigEndian.Uint16(length); initial > 0 && selected == CryptoPlaintext {
+		encrypted.reader = io.MultiReader(cipher.StreamReader{S: decrypt, R: io.LimitReader(reader, int64(initial))}, reader)
+	}
+
+	return encrypted, nil
+}
+
+// Parses a policy name, as the command line flag takes it
+func ParsePolicy(name string) (Policy, error) {
+
+	switch name {
+	case "disabled":
+		return Disabled, nil
+	case "prefer":
+		return Prefer, nil
+	case "require":
+		return Require, nil
+	}
+
+	return Disabled, fmt.Errorf("unknown encryption policy %q", name)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	default:
+		return "unknown"
+	}
+}
+
+// The crypto methods the policy offers or accepts
+func (p Policy) methods() CryptoMethod {
+	switch p {
+	case Prefer:
+		return CryptoPlaintext | CryptoRC4
+	case Require:
+		return CryptoRC4
+	default:
+		return 0
+	}
+}
+
+func newConn(conn net.Conn, reader io.Reader, encrypt, decrypt *rc4.Cipher, method CryptoMethod, infoHash [20]byte) *Conn {
+
+	encrypted := &Conn{Conn: conn, reader: reader, writer: conn, method: method, infoHash: infoHash}
+
+	if method == CryptoRC4 {
+		encrypted.reader = cipher.StreamReader{S: decrypt, R: reader}
+		encrypted.writer = cipher.StreamWriter{S: encrypt, W: conn}
+	}
+
+	return encrypted
+}
+
+func newKeyPair() (*big.Int, []byte, error) {
+
+	buffer := make([]byte, privateKeySize)
+
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, nil, err
+	}
+
+	private := new(big.Int).SetBytes(buffer)
+	public := new(big.Int).Exp(generator, private, prime)
+
+	return private, public.FillBytes(make([]byte, keySize)), nil
+}
+
+func sharedSecret(private *big.Int, public []byte) []byte {
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(public), private, prime)
+	return secret.FillBytes(make([]byte, keySize))
+}
+
+// Random bytes of random length, up to the longest pad
+func randomPad() ([]byte, error) {
+
+	var length [2]byte
+
+	if _, err := rand.Read(length[:]); err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(maxPadSize+1))
+
+	if _, err := rand.Read(pad); err != nil {
+		return nil, err
+	}
+
+	return pad, nil
+}
+
+// RC4 keyed with HASH(name, S, SKEY), past the bytes of the key stream thrown away
+func newCipher(name string, secret []byte, infoHash [20]byte) (*rc4.Cipher, error) {
+
+	c, err := rc4.NewCipher(hash([]byte(name), secret, infoHash[:]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	discard := make([]byte, discardSize)
+	c.XORKeyStream(discard, discard)
+
+	return c, nil
+}
+
+// Reads until the pattern, which comes after at most limit bytes of pad
+func synchronize(reader *bufio.Reader, pattern []byte, limit int) error {
+
+	window := make([]byte, 0, limit+len(pattern))
+
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return errNotSynchronized
+}
+
+// Reads and decrypts a pad of the negotiation, its content does not matter
+func skipPad(reader io.Reader, decrypt *rc4.Cipher, length uint16) error {
+
+	if length > maxPadSize {
+		return fmt.Errorf("mse: pad of %d bytes", length)
+	}
+
+	pad := make([]byte, length)
+
+	if _, err := io.ReadFull(reader, pad); err != nil {
+		return err
+	}
+
+	decrypt.XORKeyStream(pad, pad)
+
+	return nil
+}
+
+// The info hash whose HASH('req2', SKEY) matches
+func findInfoHash(obfuscated []byte, infoHashes [][20]byte) ([20]byte, bool) {
+
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(hash([]byte("req2"), infoHash[:]), obfuscated) {
+			return infoHash, true
+		}
+	}
+
+	return [20]byte{}, false
+}
+
+func hash(parts ...[]byte) []byte {
+
+	h := sha1.New()
+
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+
+	result := make([]byte, len(a))
+
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
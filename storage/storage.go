@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"Torrent-Client/torrent"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+)
+
+// Storage maps the piece stream of a torrent onto the files on disk
+// Pieces are written at their offset as soon as they are verified, so only in-flight pieces are kept in memory
+type Storage struct {
+	torrent *torrent.TorrentFile
+	dir     string
+	files   []*os.File
+}
+
+// NewStorage opens or creates every file of the torrent inside dir
+// Missing files are created sparse with their final size, existing data is kept so downloads can be resumed
+func NewStorage(t *torrent.TorrentFile, dir string) (*Storage, error) {
+
+	storage := &Storage{
+		torrent: t,
+		dir:     dir,
+		files:   make([]*os.File, len(t.Files)),
+	}
+
+	for i, file := range t.Files {
+		handle, err := openFile(file.LocalPath(dir), file.Length)
+
+		if err != nil {
+			log.Error().Err(err).Strs("file", file.Path).Msg("failed to open file")
+
+			if closeErr := storage.Close(); closeErr != nil {
+				log.Error().Err(closeErr).Msg("failed to close storage")
+			}
+
+			return nil, err
+		}
+
+		storage.files[i] = handle
+	}
+
+	return storage, nil
+}
+
+// NewReadOnlyStorage opens the files of the torrent that already exist inside dir without creating or modifying anything
+// Reading a range held by a missing file fails with an error matching os.ErrNotExist
+func NewReadOnlyStorage(t *torrent.TorrentFile, dir string) (*Storage, error) {
+
+	storage := &Storage{
+		torrent: t,
+		dir:     dir,
+		files:   make([]*os.File, len(t.Files)),
+	}
+
+	for i, file := range t.Files {
+		handle, err := os.Open(file.LocalPath(dir))
+
+		if errors.Is(err, os.ErrNotExist) {
+			log.Debug().Strs("file", file.Path).Msg("file missing")
+			continue
+		}
+
+		if err != nil {
+			log.Error().Err(err).Strs("file", file.Path).Msg("failed to open file")
+
+			if closeErr := storage.Close(); closeErr != nil {
+				log.Error().Err(closeErr).Msg("failed to close storage")
+			}
+
+			return nil, err
+		}
+
+		storage.files[i] = handle
+	}
+
+	return storage, nil
+}
+
+// Opens the file for reading and writing, creating its directory and growing it to its final length
+// Truncate leaves a hole in the file, so the disk space is only used as pieces arrive
+func openFile(path string, length int64) (*os.File, error) {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := handle.Stat()
+
+	if err == nil && info.Size() < length {
+		log.Debug().Str("path", path).Int64("length", length).Msg("allocating file")
+		err = handle.Truncate(length)
+	}
+
+	if err != nil {
+		if closeErr := handle.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Str("path", path).Msg("failed to close file")
+		}
+
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// WriteAt writes data at the offset of the piece stream, splitting it across the files it covers
+func (s *Storage) WriteAt(data []byte, offset int64) (int, error) {
+
+	end := offset + int64(len(data))
+
+	if offset < 0 || end > s.torrent.Length {
+		return 0, fmt.Errorf("range %d-%d out of bounds", offset, end)
+	}
+
+	written := 0
+
+	for _, segment := range s.segments(offset, end) {
+		if segment.handle == nil {
+			return written, &os.PathError{Op: "write", Path: segment.File.LocalPath(s.dir), Err: os.ErrNotExist}
+		}
+
+		n, err := segment.handle.WriteAt(data[written:written+int(segment.Length)], segment.Offset)
+		written += n
+
+		if err != nil {
+			log.Error().Err(err).Strs("file", segment.File.Path).Msg("failed to write file")
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// ReadAt reads data from the offset of the piece stream, gathering it from the files it covers
+func (s *Storage) ReadAt(data []byte, offset int64) (int, error) {
+
+	end := offset + int64(len(data))
+
+	if offset < 0 || end > s.torrent.Length {
+		return 0, fmt.Errorf("range %d-%d out of bounds", offset, end)
+	}
+
+	read := 0
+
+	for _, segment := range s.segments(offset, end) {
+		if segment.handle == nil {
+			return read, &os.PathError{Op: "read", Path: segment.File.LocalPath(s.dir), Err: os.ErrNotExist}
+		}
+
+		n, err := segment.handle.ReadAt(data[read:read+int(segment.Length)], segment.Offset)
+		read += n
+
+		if err != nil {
+			log.Debug().Err(err).Strs("file", segment.File.Path).Msg("failed to read file")
+			return read, err
+		}
+	}
+
+	return read, nil
+}
+
+// WritePiece writes a verified piece at its position
+func (s *Storage) WritePiece(index int, data []byte) error {
+
+	begin, end := s.torrent.CalculateBoundsForPiece(index)
+
+	if int64(len(data)) != end-begin {
+		return fmt.Errorf("piece %d has %d bytes, expected %d", index, len(data), end-begin)
+	}
+
+	_, err := s.WriteAt(data, begin)
+
+	return err
+}
+
+// ReadPiece reads the whole piece into a new buffer
+func (s *Storage) ReadPiece(index int) ([]byte, error) {
+
+	begin, end := s.torrent.CalculateBoundsForPiece(index)
+	data := make([]byte, end-begin)
+
+	_, err := s.ReadAt(data, begin)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Sync flushes the files to disk
+func (s *Storage) Sync() error {
+
+	for _, handle := range s.files {
+		if handle == nil {
+			continue
+		}
+
+		if err := handle.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes every open file, returning the first error found
+func (s *Storage) Close() error {
+
+	var result error
+
+	for i, handle := range s.files {
+		if handle == nil {
+			continue
+		}
+
+		if err := handle.Close(); err != nil && result == nil {
+			result = err
+		}
+
+		s.files[i] = nil
+	}
+
+	return result
+}
+
+type segment struct {
+	torrent.FileSegment
+	handle *os.File
+}
+
+// Maps a range of the piece stream to the open files holding it
+func (s *Storage) segments(begin, end int64) []segment {
+
+	fileSegments := s.torrent.FileSegments(begin, end)
+	segments := make([]segment, len(fileSegments))
+
+	for i, fileSegment := range fileSegments {
+		segments[i] = segment{FileSegment: fileSegment, handle: s.files[fileSegment.Index]}
+	}
+
+	return segments
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/torrent"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHTTPTracker serves a fixed bencoded response and counts the announces it receives
+func newHTTPTracker(t *testing.T, response bencode.BencodeValue, announces *int32) *httptest.Server {
+	buffer := bytes.Buffer{}
+	require.NoError(t, response.Encode(&buffer))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(announces, 1)
+		w.Write(buffer.Bytes())
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func trackerResponse(interval int64, peers string) bencode.BencodeValue {
+	return bencode.BencodeValue{
+		Type: bencode.DictType,
+		Dict: map[string]bencode.BencodeValue{
+			"interval": {Type: bencode.IntegerType, Int: interval},
+			"peers":    {Type: bencode.StringType, Str: peers},
+		},
+	}
+}
+
+func TestAnnouncer_FailsOverAndMergesPeers(t *testing.T) {
+	var brokenAnnounces, firstAnnounces, secondAnnounces int32
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&brokenAnnounces, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+
+	first := newHTTPTracker(t, trackerResponse(1800, "\x7f\x00\x00\x01\x1a\xe1"), &firstAnnounces)
+	second := newHTTPTracker(t, trackerResponse(900, "\x7f\x00\x00\x01\x1a\xe1\x7f\x00\x00\x02\x1a\xe1"), &secondAnnounces)
+
+	announcer := torrent.NewAnnouncer([][]string{
+		{broken.URL, first.URL},
+		{second.URL},
+	})
+
+	defer announcer.Close()
+
+	result, err := announcer.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, result.Trackers)
+	assert.Equal(t, 900*time.Second, result.Interval)
+	require.Len(t, result.Peers, 2, "peers are merged without duplicates")
+	assert.Equal(t, "127.0.0.1:6881", result.Peers[0].Address())
+	assert.Equal(t, "127.0.0.2:6881", result.Peers[1].Address())
+
+	// The working tracker is promoted, the broken one is not asked anymore
+	assert.Equal(t, [][]string{{first.URL, broken.URL}, {second.URL}}, announcer.Tiers())
+
+	atomic.StoreInt32(&brokenAnnounces, 0)
+
+	_, err = announcer.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&brokenAnnounces))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&firstAnnounces))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondAnnounces))
+}
+
+func TestAnnouncer_AllTrackersFail(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+
+	announcer := torrent.NewAnnouncer([][]string{{broken.URL}, {"gopher://tracker.example.com"}})
+	defer announcer.Close()
+
+	_, err := announcer.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	assert.Error(t, err)
+}
+
+func TestAnnounceList(t *testing.T) {
+	tier := func(trackers ...string) bencode.BencodeValue {
+		list := bencode.BencodeValue{Type: bencode.ListType}
+
+		for _, tracker := range trackers {
+			list.List = append(list.List, bencode.BencodeValue{Type: bencode.StringType, Str: tracker})
+		}
+
+		return list
+	}
+
+	input := multiFileInfo(fileEntry(40, "file"))
+	delete(input.Dict, "announce")
+
+	_, err := torrent.BencodeToTorrentFile(input, torrent.BencodeToTorrentFileOpts{From: "test"})
+	assert.Error(t, err, "a torrent needs an announce URL or an announce list")
+
+	input.Dict["announce-list"] = bencode.BencodeValue{
+		Type: bencode.ListType,
+		List: []bencode.BencodeValue{
+			tier("udp://a.example.com:80", "http://b.example.com/announce"),
+			tier(),
+			tier("http://c.example.com/announce"),
+		},
+	}
+
+	to, err := torrent.BencodeToTorrentFile(input, torrent.BencodeToTorrentFileOpts{From: "test"})
+	require.NoError(t, err)
+
+	expected := [][]string{
+		{"udp://a.example.com:80", "http://b.example.com/announce"},
+		{"http://c.example.com/announce"},
+	}
+
+	assert.Equal(t, expected, to.AnnounceList)
+	assert.Equal(t, expected, to.AnnounceTiers())
+
+	single := torrent.TorrentFile{Announce: "http://tracker.example.com/announce"}
+	assert.Equal(t, [][]string{{"http://tracker.example.com/announce"}}, single.AnnounceTiers())
+}
+
+func TestAnnouncer_Run(t *testing.T) {
+	type announce struct {
+		event      string
+		uploaded   string
+		downloaded string
+		left       string
+		at         time.Time
+	}
+
+	announces := make(chan announce, 10)
+
+	response := trackerResponse(1, "\x7f\x00\x00\x01\x1a\xe1")
+	response.Dict["min interval"] = bencode.BencodeValue{Type: bencode.IntegerType, Int: 2}
+
+	buffer := bytes.Buffer{}
+	require.NoError(t, response.Encode(&buffer))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		announces <- announce{
+			event:      query.Get("event"),
+			uploaded:   query.Get("uploaded"),
+			downloaded: query.Get("downloaded"),
+			left:       query.Get("left"),
+			at:         time.Now(),
+		}
+		w.Write(buffer.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	announcer := torrent.NewAnnouncer([][]string{{server.URL}})
+	defer announcer.Close()
+
+	var downloaded atomic.Int64
+
+	stats := func() torrent.TransferStats {
+		return torrent.TransferStats{Uploaded: 5, Downloaded: downloaded.Load(), Left: 100 - downloaded.Load()}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	peers := make(chan []torrent.Peer)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		announcer.Run(ctx, torrent.AnnounceRequest{Port: 6881}, stats, peers)
+	}()
+
+	next := func() announce {
+		select {
+		case a := <-announces:
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatal("tracker was not announced to")
+			return announce{}
+		}
+	}
+
+	started := next()
+	assert.Equal(t, "started", started.event)
+	assert.Equal(t, "0", started.downloaded)
+	assert.Equal(t, "100", started.left)
+	assert.Len(t, <-peers, 1)
+
+	downloaded.Store(40)
+
+	// The tracker asks for an interval of one second but a min interval of two
+	regular := next()
+	assert.Equal(t, "", regular.event)
+	assert.Equal(t, "5", regular.uploaded)
+	assert.Equal(t, "40", regular.downloaded)
+	assert.Equal(t, "60", regular.left)
+	assert.GreaterOrEqual(t, regular.at.Sub(started.at), 2*time.Second)
+	<-peers
+
+	downloaded.Store(100)
+	announcer.Complete()
+
+	completed := next()
+	assert.Equal(t, "completed", completed.event)
+	assert.Equal(t, "0", completed.left)
+	<-peers
+
+	cancel()
+
+	stopped := next()
+	assert.Equal(t, "stopped", stopped.event)
+
+	<-done
+}
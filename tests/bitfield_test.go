@@ -45,3 +45,26 @@ func TestBitfield_SetPiece(t *testing.T) {
 		t.Errorf("SetPiece(3) failed, got %08b", bf[0])
 	}
 }
+
+func TestBitfield_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		bitfield client.Bitfield
+		pieces   int
+		valid    bool
+	}{
+		{"exact", client.Bitfield{0xff, 0xe0}, 11, true},
+		{"full bytes", client.Bitfield{0xff}, 8, true},
+		{"too short", client.Bitfield{0xff}, 11, false},
+		{"too long", client.Bitfield{0xff, 0x00, 0x00}, 11, false},
+		{"spare bits set", client.Bitfield{0xff, 0xe1}, 11, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.bitfield.Validate(tt.pieces); (err == nil) != tt.valid {
+				t.Errorf("Validate(%d) = %v, expected valid %v", tt.pieces, err, tt.valid)
+			}
+		})
+	}
+}
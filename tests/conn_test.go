@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerConn_SendsKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := client.NewPeerConn(local)
+	conn.KeepAliveInterval = 50 * time.Millisecond
+	conn.Start(context.Background())
+	defer conn.Close()
+
+	require.NoError(t, remote.SetReadDeadline(time.Now().Add(time.Second)))
+
+	message, err := client.ReadMessage(remote)
+	require.NoError(t, err)
+	assert.Equal(t, client.MessageKeepAlive, message.ID)
+}
+
+func TestPeerConn_ClosesIdleConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := client.NewPeerConn(local)
+	conn.IdleTimeout = 50 * time.Millisecond
+	conn.Start(context.Background())
+
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+
+	_, ok := <-conn.Messages()
+	assert.False(t, ok)
+	assert.Error(t, conn.Err())
+}
+
+func TestPeerConn_DeliversMessagesWithoutKeepAlives(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := client.NewPeerConn(local)
+	conn.Start(context.Background())
+	defer conn.Close()
+
+	go func() {
+		remote.Write((&client.Message{ID: client.MessageKeepAlive}).Serialize())
+		remote.Write(client.NewHaveMessage(7).Serialize())
+	}()
+
+	select {
+	case message := <-conn.Messages():
+		assert.Equal(t, client.MessageHave, message.ID)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestPeerConn_FlushesQueueOnCancel(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn := client.NewPeerConn(local)
+	conn.Start(ctx)
+
+	require.NoError(t, conn.Send(client.NewHaveMessage(1)))
+	require.NoError(t, conn.Send(client.NewHaveMessage(2)))
+	cancel()
+
+	require.NoError(t, remote.SetReadDeadline(time.Now().Add(time.Second)))
+
+	for _, index := range []int{1, 2} {
+		message, err := client.ReadMessage(remote)
+		require.NoError(t, err)
+		assert.Equal(t, client.MessageHave, message.ID)
+		assert.Equal(t, byte(index), message.Payload[3])
+	}
+
+	<-conn.Done()
+	assert.ErrorIs(t, conn.Err(), context.Canceled)
+	assert.Error(t, conn.Send(client.NewHaveMessage(3)))
+}
+
+func TestPeerConn_TrySendDisconnectsSlowPeer(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := client.NewPeerConn(local)
+	conn.Start(context.Background())
+	defer conn.Close()
+
+	// The peer never reads, the writer blocks on the first message and the queue fills up
+	var err error
+
+	for i := 0; i < 100 && err == nil; i++ {
+		err = conn.TrySend(client.NewHaveMessage(i))
+	}
+
+	assert.Error(t, err)
+
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Fatal("slow peer was not disconnected")
+	}
+
+	assert.Error(t, conn.Send(client.NewHaveMessage(1)))
+}
@@ -0,0 +1,286 @@
+package tests
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/client"
+	"Torrent-Client/dht"
+	"Torrent-Client/torrent"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Starts a DHT node on loopback that joins the network through the given nodes
+func newDHTNode(t *testing.T, bootstrap ...*dht.Node) *dht.Node {
+	node, err := dht.NewNode()
+	require.NoError(t, err)
+
+	node.Timeout = 500 * time.Millisecond
+	node.BootstrapNodes = nil
+
+	for _, other := range bootstrap {
+		node.BootstrapNodes = append(node.BootstrapNodes, other.Addr().String())
+	}
+
+	require.NoError(t, node.Listen("127.0.0.1:0"))
+	t.Cleanup(func() { node.Close() })
+
+	return node
+}
+
+// Starts nodes on loopback bootstrapped through the first one, a second round lets the early nodes learn about the later ones
+func newDHTSwarm(t *testing.T, count int) []*dht.Node {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	nodes := []*dht.Node{newDHTNode(t)}
+
+	for len(nodes) < count {
+		node := newDHTNode(t, nodes[0])
+		require.NoError(t, node.Bootstrap(ctx))
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		require.NoError(t, node.Bootstrap(ctx))
+	}
+
+	return nodes
+}
+
+func TestDHT_AnnounceAndGetPeers(t *testing.T) {
+	nodes := newDHTSwarm(t, 20)
+
+	for _, node := range nodes {
+		assert.Greater(t, node.Nodes(), 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+
+	peers, err := nodes[3].Announce(ctx, infoHash, 6000)
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+
+	peers, err = nodes[15].GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, "127.0.0.1:6000", peers[0].Address())
+
+	// Nobody announced this one
+	peers, err = nodes[9].GetPeers(ctx, [20]byte{0xca, 0xfe})
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+}
+
+func TestDHT_SaveAndLoad(t *testing.T) {
+	nodes := newDHTSwarm(t, 5)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	require.NoError(t, nodes[2].Save(path))
+
+	restored, err := dht.NewNode()
+	require.NoError(t, err)
+	require.NoError(t, restored.Load(path))
+
+	assert.Equal(t, nodes[2].ID(), restored.ID())
+	assert.Equal(t, nodes[2].Nodes(), restored.Nodes())
+
+	// The saved nodes are enough to find peers without bootstrap nodes
+	restored.Timeout = 500 * time.Millisecond
+	restored.BootstrapNodes = nil
+	require.NoError(t, restored.Listen("127.0.0.1:0"))
+	t.Cleanup(func() { restored.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	infoHash := [20]byte{1, 2, 3}
+
+	_, err = nodes[0].Announce(ctx, infoHash, 7000)
+	require.NoError(t, err)
+
+	peers, err := restored.GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, uint16(7000), peers[0].Port)
+
+	// Listening nodes keep their state
+	assert.Error(t, restored.Load(path))
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Sends a KRPC query to the node and returns the decoded reply
+func queryDHT(t *testing.T, conn net.Conn, method string, args map[string]bencode.BencodeValue) bencode.BencodeValue {
+	query := bencode.BencodeValue{Type: bencode.DictType, Dict: map[string]bencode.BencodeValue{
+		"t": {Type: bencode.StringType, Str: "aa"},
+		"y": {Type: bencode.StringType, Str: "q"},
+		"q": {Type: bencode.StringType, Str: method},
+		"a": {Type: bencode.DictType, Dict: args},
+	}}
+
+	buffer := bytes.Buffer{}
+	require.NoError(t, query.Encode(&buffer))
+
+	_, err := conn.Write(buffer.Bytes())
+	require.NoError(t, err)
+
+	packet := make([]byte, 2048)
+	size, err := conn.Read(packet)
+	require.NoError(t, err)
+
+	reply, err := bencode.Parse(bytes.NewReader(packet[:size]))
+	require.NoError(t, err)
+	assert.Equal(t, "aa", reply.Dict["t"].Str)
+
+	return reply
+}
+
+func TestDHT_AnnouncePeerNeedsToken(t *testing.T) {
+	node := newDHTNode(t)
+
+	conn, err := net.Dial("udp", node.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	id := bencode.BencodeValue{Type: bencode.StringType, Str: "abcdefghij0123456789"}
+	infoHash := bencode.BencodeValue{Type: bencode.StringType, Str: "mnopqrstuvwxyz123456"}
+
+	reply := queryDHT(t, conn, "announce_peer", map[string]bencode.BencodeValue{
+		"id":        id,
+		"info_hash": infoHash,
+		"port":      {Type: bencode.IntegerType, Int: 6881},
+		"token":     {Type: bencode.StringType, Str: "forged"},
+	})
+
+	require.Equal(t, "e", reply.Dict["y"].Str)
+	assert.Equal(t, int64(203), reply.Dict["e"].List[0].Int)
+
+	// A token handed out by get_peers is accepted, the port the query came from is used with implied_port
+	reply = queryDHT(t, conn, "get_peers", map[string]bencode.BencodeValue{"id": id, "info_hash": infoHash})
+	require.Equal(t, "r", reply.Dict["y"].Str)
+	token := reply.Dict["r"].Dict["token"]
+	require.NotEmpty(t, token.Str)
+
+	reply = queryDHT(t, conn, "announce_peer", map[string]bencode.BencodeValue{
+		"id":           id,
+		"info_hash":    infoHash,
+		"port":         {Type: bencode.IntegerType, Int: 6881},
+		"implied_port": {Type: bencode.IntegerType, Int: 1},
+		"token":        token,
+	})
+	require.Equal(t, "r", reply.Dict["y"].Str)
+	nodeID := node.ID()
+	assert.Equal(t, string(nodeID[:]), reply.Dict["r"].Dict["id"].Str)
+
+	reply = queryDHT(t, conn, "get_peers", map[string]bencode.BencodeValue{"id": id, "info_hash": infoHash})
+	values := reply.Dict["r"].Dict["values"].List
+	require.Len(t, values, 1)
+
+	peers, err := torrent.DecodePeers([]byte(values[0].Str))
+	require.NoError(t, err)
+	assert.Equal(t, conn.LocalAddr().String(), peers[0].Address())
+
+	reply = queryDHT(t, conn, "vote", map[string]bencode.BencodeValue{"id": id})
+	require.Equal(t, "e", reply.Dict["y"].Str)
+	assert.Equal(t, int64(204), reply.Dict["e"].List[0].Int)
+}
+
+func TestDHT_ResponsesLeaveOutUnsetKeys(t *testing.T) {
+	node := newDHTNode(t)
+
+	conn, err := net.Dial("udp", node.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	id := bencode.BencodeValue{Type: bencode.StringType, Str: "abcdefghij0123456789"}
+
+	// The encoder writes what it is given, a reply without nodes, token or values lacks the keys instead of holding empty ones
+	reply := queryDHT(t, conn, "ping", map[string]bencode.BencodeValue{"id": id})
+	require.Equal(t, "r", reply.Dict["y"].Str)
+
+	keys := make([]string, 0, len(reply.Dict["r"].Dict))
+
+	for key := range reply.Dict["r"].Dict {
+		keys = append(keys, key)
+	}
+
+	assert.Equal(t, []string{"id"}, keys)
+}
+
+func TestDHT_SaveAndLoadWithoutNodes(t *testing.T) {
+	node, err := dht.NewNode()
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	require.NoError(t, node.Save(path))
+
+	// The empty node list is written as given and read back as no node
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "5:nodes0:")
+
+	restored, err := dht.NewNode()
+	require.NoError(t, err)
+	require.NoError(t, restored.Load(path))
+
+	assert.Equal(t, node.ID(), restored.ID())
+	assert.Empty(t, restored.Nodes())
+}
+
+func TestDHT_SurvivesOversizedString(t *testing.T) {
+	node := newDHTNode(t)
+
+	conn, err := net.Dial("udp", node.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// A single packet declaring a string far larger than itself
+	_, err = conn.Write([]byte("d1:t9999999999999:ae"))
+	require.NoError(t, err)
+
+	reply := queryDHT(t, conn, "ping", map[string]bencode.BencodeValue{
+		"id": {Type: bencode.StringType, Str: "abcdefghij0123456789"},
+	})
+	assert.Equal(t, "r", reply.Dict["y"].Str)
+}
+
+func TestDownloadTorrent_PeersFromDHT(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+	seeder, _ := newSeeder(t, to, content)
+
+	nodes := newDHTSwarm(t, 8)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The torrent has no tracker, the seeder is only known to the DHT
+	_, err := nodes[1].Announce(ctx, to.InfoHash, seeder.Port())
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	err = client.DownloadTorrentContext(ctx, to, client.DownloadOptions{
+		Path: dir,
+		Port: freePort(t),
+		DHT:  newDHTNode(t, nodes[0]),
+	})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
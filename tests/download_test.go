@@ -0,0 +1,495 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/torrent"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Builds a single file torrent over random content
+func swarmTorrent(t *testing.T, length int, pieceLength int) (*torrent.TorrentFile, []byte) {
+	content := make([]byte, length)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	to := &torrent.TorrentFile{
+		Name:        "swarm.bin",
+		PieceLength: int64(pieceLength),
+		Length:      int64(length),
+		InfoHash:    sha1.Sum(content),
+		Files:       []torrent.File{{Path: []string{"swarm.bin"}, Length: int64(length)}},
+	}
+
+	for begin := 0; begin < length; begin += pieceLength {
+		to.PiecesHash = append(to.PiecesHash, sha1.Sum(content[begin:min(begin+pieceLength, length)]))
+	}
+
+	return to, content
+}
+
+func compactPeer(port uint16) string {
+	return string(binary.BigEndian.AppendUint16([]byte{127, 0, 0, 1}, port))
+}
+
+func freePort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestDownloadTorrent_FromSeeders(t *testing.T) {
+	to, content := swarmTorrent(t, 100*1024, 32*1024)
+
+	first, firstSession := newSeeder(t, to, content)
+	second, secondSession := newSeeder(t, to, content)
+
+	// A dead peer sits between the seeders, the download goes on without it
+	peers := compactPeer(first.Port()) + compactPeer(freePort(t)) + compactPeer(second.Port())
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, peers), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t)})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	assert.GreaterOrEqual(t, firstSession.Uploaded()+secondSession.Uploaded(), int64(len(content)))
+}
+
+func TestDownloadTorrent_PiecesSpreadOverPeers(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+
+	// Each peer is only asked for the pieces it has, together they hold the whole torrent
+	first, _ := newPartialSeeder(t, to, content, 0, 2)
+	second, _ := newPartialSeeder(t, to, content, 1, 3)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(first.Port())+compactPeer(second.Port())), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t)})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+// Accepts one download connection, offers every piece and unchokes, then never answers the requests
+// Returns a channel with the messages received from the downloader
+func newStalledPeer(t *testing.T, to *torrent.TorrentFile) (uint16, <-chan *client.Message) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan *client.Message, 64)
+
+	go func() {
+		defer close(messages)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := client.ReadResponse(conn); err != nil {
+			return
+		}
+
+		bitfield := client.NewBitfield(len(to.PiecesHash))
+		for i := range to.PiecesHash {
+			bitfield.SetPiece(i)
+		}
+
+		conn.Write(client.NewHandshake([20]byte{7}, to.InfoHash).Serialize())
+		conn.Write((&client.Message{ID: client.MessageBitfield, Payload: bitfield}).Serialize())
+		conn.Write(client.NewUnchokeMessage().Serialize())
+
+		for {
+			message, err := client.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+
+			select {
+			case messages <- message:
+			default:
+			}
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port), messages
+}
+
+func TestDownloadTorrent_EndgameCancelsStalledRequests(t *testing.T) {
+	to, content := swarmTorrent(t, 16*1024, 16*1024)
+
+	stalled, messages := newStalledPeer(t, to)
+	seeder, _ := newSeeder(t, to, content)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(stalled)+compactPeer(seeder.Port())), &announces)
+	to.Announce = tracker.URL
+
+	// Well under the piece timeout, the stalled peer cannot hold the download back
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	start := time.Now()
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t)})
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// Every block requested from the stalled peer was cancelled once the seeder delivered it
+	requested := map[string]bool{}
+	timeout := time.After(time.Second)
+
+	for done := false; !done; {
+		select {
+		case message, ok := <-messages:
+			done = !ok
+
+			if ok && message.ID == client.MessageRequest {
+				requested[string(message.Payload)] = true
+			}
+
+			if ok && message.ID == client.MessageCancel {
+				assert.True(t, requested[string(message.Payload)], "cancel without request")
+				delete(requested, string(message.Payload))
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	assert.Empty(t, requested, "requests left without cancel")
+}
+
+// Accepts one download connection, answers its first request with the content and closes the connection
+func newFlakyPeer(t *testing.T, to *torrent.TorrentFile, content []byte) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := client.ReadResponse(conn); err != nil {
+			return
+		}
+
+		bitfield := client.NewBitfield(len(to.PiecesHash))
+		for i := range to.PiecesHash {
+			bitfield.SetPiece(i)
+		}
+
+		conn.Write(client.NewHandshake([20]byte{8}, to.InfoHash).Serialize())
+		conn.Write((&client.Message{ID: client.MessageBitfield, Payload: bitfield}).Serialize())
+		conn.Write(client.NewUnchokeMessage().Serialize())
+
+		for {
+			message, err := client.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+
+			if message.ID == client.MessageRequest {
+				index, begin, length, _ := client.ParseRequest(*message)
+				offset := index*int(to.PieceLength) + begin
+				conn.Write(client.NewPieceMessage(index, begin, content[offset:offset+length]).Serialize())
+				return
+			}
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestDownloadTorrent_PartialPieceSurvivesDisconnect(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 64*1024)
+
+	flaky := newFlakyPeer(t, to, content)
+	seeder, session := newSeeder(t, to, content)
+
+	// The seeder is only handed out once the flaky peer is gone
+	var announces int32
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers := compactPeer(seeder.Port())
+
+		if atomic.AddInt32(&announces, 1) == 1 {
+			peers = compactPeer(flaky)
+		}
+
+		response := trackerResponse(1, peers)
+		buffer := bytes.Buffer{}
+		response.Encode(&buffer)
+		w.Write(buffer.Bytes())
+	}))
+	t.Cleanup(tracker.Close)
+
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t)})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// The block of the flaky peer was kept, the seeder only sent the rest of the piece
+	assert.Equal(t, int64(48*1024), session.Uploaded())
+}
+
+// Accepts one download connection and never sends a bitfield, it unchokes first and announces its pieces with
+// have messages instead, then serves every request
+func newPeerWithoutBitfield(t *testing.T, to *torrent.TorrentFile, content []byte) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := client.ReadResponse(conn); err != nil {
+			return
+		}
+
+		conn.Write(client.NewHandshake([20]byte{10}, to.InfoHash).Serialize())
+		conn.Write(client.NewUnchokeMessage().Serialize())
+		conn.Write((&client.Message{ID: client.MessageKeepAlive}).Serialize())
+
+		for i := range to.PiecesHash {
+			conn.Write(client.NewHaveMessage(i).Serialize())
+		}
+
+		for {
+			message, err := client.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+
+			if message.ID == client.MessageRequest {
+				index, begin, length, _ := client.ParseRequest(*message)
+				offset := index*int(to.PieceLength) + begin
+				conn.Write(client.NewPieceMessage(index, begin, content[offset:offset+length]).Serialize())
+			}
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Completes the handshake of every connection and hangs up right away, counting the connections
+func newDroppingPeer(t *testing.T, to *torrent.TorrentFile, connections *int32) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(connections, 1)
+
+			if _, err := client.ReadResponse(conn); err == nil {
+				conn.Write(client.NewHandshake([20]byte{11}, to.InfoHash).Serialize())
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestDownloadTorrent_BacksOffFromDroppingPeer(t *testing.T) {
+	to, _ := swarmTorrent(t, 16*1024, 16*1024)
+
+	var connections int32
+	peer := newDroppingPeer(t, to, &connections)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(peer)), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: t.TempDir(), Port: freePort(t)})
+	assert.Error(t, err)
+
+	// The peer waits for its retry delay instead of being redialed as soon as it hangs up
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestDownloadTorrent_PeerWithoutBitfield(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+
+	peer := newPeerWithoutBitfield(t, to, content)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(peer)), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t)})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadTorrent_RequestsSpanPieces(t *testing.T) {
+	to, _ := swarmTorrent(t, 64*1024, 16*1024)
+
+	stalled, messages := newStalledPeer(t, to)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(stalled)), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: t.TempDir(), Port: freePort(t)})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Pieces are one block long, the queue of the peer holds several of them at once
+	pieces := map[int]bool{}
+
+	for message := range messages {
+		if message.ID == client.MessageRequest {
+			index, _, _, err := client.ParseRequest(*message)
+			require.NoError(t, err)
+			pieces[index] = true
+		}
+
+		if len(pieces) > 1 {
+			break
+		}
+	}
+
+	assert.Greater(t, len(pieces), 1)
+}
+
+func TestDownloadTorrent_FailsWithoutPeers(t *testing.T) {
+	to, _ := swarmTorrent(t, 16*1024, 16*1024)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, ""), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{
+		Path:            t.TempDir(),
+		Port:            freePort(t),
+		PeerWaitTimeout: 200 * time.Millisecond,
+	})
+
+	// The download gives up on its own, long before the context expires
+	assert.ErrorIs(t, err, client.ErrNoPeers)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestDownloadTorrent_WaitsForLatePeers(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+
+	seeder, _ := newSeeder(t, to, content)
+
+	// The first announce finds nobody, the next one a second later returns the seeder
+	var announces int32
+	empty, found := bytes.Buffer{}, bytes.Buffer{}
+	emptyResponse, foundResponse := trackerResponse(1, ""), trackerResponse(1800, compactPeer(seeder.Port()))
+	require.NoError(t, emptyResponse.Encode(&empty))
+	require.NoError(t, foundResponse.Encode(&found))
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&announces, 1) == 1 {
+			w.Write(empty.Bytes())
+			return
+		}
+
+		w.Write(found.Bytes())
+	}))
+	t.Cleanup(tracker.Close)
+
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{
+		Path:            dir,
+		Port:            freePort(t),
+		PeerWaitTimeout: 10 * time.Second,
+	})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
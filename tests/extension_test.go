@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReserved_ExtensionProtocolBit(t *testing.T) {
+	var reserved client.Reserved
+	reserved.Set(client.ReservedExtensionProtocol)
+
+	assert.Equal(t, client.Reserved{0, 0, 0, 0, 0, 0x10, 0, 0}, reserved)
+	assert.True(t, reserved.Has(client.ReservedExtensionProtocol))
+	assert.False(t, client.Reserved{}.Has(client.ReservedExtensionProtocol))
+}
+
+func TestExtendedHandshake_RoundTrip(t *testing.T) {
+	handshake := &client.ExtendedHandshake{
+		Extensions:   map[string]uint8{"ut_metadata": 2, "ut_pex": 1},
+		Version:      "Torrent-Client",
+		Port:         6881,
+		RequestQueue: 250,
+		MetadataSize: 31235,
+	}
+
+	payload, err := handshake.Serialize()
+	require.NoError(t, err)
+
+	parsed, err := client.ParseExtendedHandshake(payload)
+	require.NoError(t, err)
+	assert.Equal(t, handshake, parsed)
+
+	// The m dictionary is sent even without extensions, and zero disables an extension
+	payload, err = (&client.ExtendedHandshake{Version: "x"}).Serialize()
+	require.NoError(t, err)
+	assert.Equal(t, "d1:mde1:v1:xe", string(payload))
+
+	parsed, err = client.ParseExtendedHandshake([]byte("d1:md6:ut_pexi0e11:ut_metadatai3eee"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint8{"ut_metadata": 3}, parsed.Extensions)
+
+	_, err = client.ParseExtendedHandshake([]byte("li1ee"))
+	assert.Error(t, err)
+}
+
+func TestParseExtendedHandshake_OversizedString(t *testing.T) {
+	// The version claims ~10GB, far more than the message holds
+	_, err := client.ParseExtendedHandshake([]byte("d1:md6:ut_pexi1ee1:v9999999999999:xe"))
+	assert.Error(t, err)
+}
+
+func TestExtensionRegistry_Register(t *testing.T) {
+	registry := client.NewExtensionRegistry()
+
+	require.NoError(t, registry.Register("ut_pex", &echoExtension{}))
+	require.NoError(t, registry.Register("ut_metadata", &echoExtension{}))
+	assert.Error(t, registry.Register("ut_pex", &echoExtension{}))
+
+	registry.SetPort(6881)
+
+	handshake := registry.Handshake()
+	assert.Equal(t, map[string]uint8{"ut_pex": 1, "ut_metadata": 2}, handshake.Extensions)
+	assert.Equal(t, uint16(6881), handshake.Port)
+}
+
+// Answers every message with the same payload, using the extended message ID the peer chose
+type echoExtension struct {
+	handshakes chan *client.ExtendedHandshake
+}
+
+func (e *echoExtension) PeerHandshake(_ *client.Client, handshake *client.ExtendedHandshake) {
+	if e.handshakes != nil {
+		e.handshakes <- handshake
+	}
+}
+
+func (e *echoExtension) HandleMessage(c *client.Client, payload []byte) error {
+	return c.SendExtended("ut_echo", payload)
+}
+
+func TestServer_DispatchesExtendedMessages(t *testing.T) {
+	server, session := newSeedingServer(t)
+
+	extension := &echoExtension{handshakes: make(chan *client.ExtendedHandshake, 1)}
+	require.NoError(t, session.Extensions().Register("ut_echo", extension))
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(server.Port()))))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+
+	request := client.NewHandshake([20]byte{3}, session.Torrent().InfoHash)
+	request.Reserved.Set(client.ReservedExtensionProtocol)
+
+	_, err = conn.Write(request.Serialize())
+	require.NoError(t, err)
+
+	response, err := client.ReadResponse(conn)
+	require.NoError(t, err)
+	assert.True(t, response.Reserved.Has(client.ReservedExtensionProtocol))
+
+	// The bitfield comes first, then the extended handshake
+	message, err := client.ReadMessage(conn)
+	require.NoError(t, err)
+	assert.Equal(t, client.MessageBitfield, message.ID)
+
+	message, err = client.ReadMessage(conn)
+	require.NoError(t, err)
+
+	id, payload, err := client.ParseExtended(*message)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), id)
+
+	handshake, err := client.ParseExtendedHandshake(payload)
+	require.NoError(t, err)
+	echo, ok := handshake.Extensions["ut_echo"]
+	require.True(t, ok)
+	assert.Equal(t, "Torrent-Client", handshake.Version)
+
+	// We receive the extension with ID 7, the server must answer with it
+	ours, err := (&client.ExtendedHandshake{Extensions: map[string]uint8{"ut_echo": 7}}).Serialize()
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewExtendedMessage(0, ours).Serialize())
+	require.NoError(t, err)
+
+	select {
+	case handshake := <-extension.handshakes:
+		assert.Equal(t, uint8(7), handshake.Extensions["ut_echo"])
+	case <-time.After(time.Second):
+		t.Fatal("extension was not told about the handshake")
+	}
+
+	_, err = conn.Write(client.NewExtendedMessage(echo, []byte("ping")).Serialize())
+	require.NoError(t, err)
+
+	message, err = client.ReadMessage(conn)
+	require.NoError(t, err)
+
+	id, payload, err = client.ParseExtended(*message)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(7), id)
+	assert.Equal(t, []byte("ping"), payload)
+}
+
+func TestServer_MergesLaterExtendedHandshakes(t *testing.T) {
+	server, session := newSeedingServer(t)
+	require.NoError(t, session.Extensions().Register("ut_echo", &echoExtension{}))
+
+	conn := dialExtended(t, server.Port(), session.Torrent().InfoHash, [20]byte{24}, &client.ExtendedHandshake{
+		Extensions: map[string]uint8{"ut_echo": 7},
+	})
+
+	message := readUntil(t, conn, func(m *client.Message) bool {
+		return m.ID == client.MessageExtended && m.Payload[0] == 0
+	})
+
+	handshake, err := client.ParseExtendedHandshake(message.Payload[1:])
+	require.NoError(t, err)
+	echo := handshake.Extensions["ut_echo"]
+	require.NotZero(t, echo)
+
+	// A later handshake only carries what changed, ut_echo is still received with 7
+	_, err = conn.Write(client.NewExtendedMessage(0, []byte("d1:md6:ut_pexi1eee")).Serialize())
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewExtendedMessage(echo, []byte("ping")).Serialize())
+	require.NoError(t, err)
+
+	readUntil(t, conn, func(m *client.Message) bool {
+		return m.ID == client.MessageExtended && m.Payload[0] == 7
+	})
+
+	// ID 0 disables it, the ping is not answered before the unchoke that follows it
+	_, err = conn.Write(client.NewExtendedMessage(0, []byte("d1:md7:ut_echoi0eee")).Serialize())
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewExtendedMessage(echo, []byte("ping")).Serialize())
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewInterestedMessage().Serialize())
+	require.NoError(t, err)
+
+	readUntil(t, conn, func(m *client.Message) bool {
+		assert.False(t, m.ID == client.MessageExtended && m.Payload[0] == 7, "disabled extension answered")
+		return m.ID == client.MessageUnchoke
+	})
+}
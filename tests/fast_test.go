@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/torrent"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+
+	// The examples of BEP 6
+	ip := net.ParseIP("80.4.4.200")
+
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, client.AllowedFastSet(ip, infoHash, 1313, 7))
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, client.AllowedFastSet(ip, infoHash, 1313, 9))
+
+	// The last byte of the address does not count, the set cannot hold more pieces than the torrent
+	assert.Equal(t, client.AllowedFastSet(ip, infoHash, 1313, 7), client.AllowedFastSet(net.ParseIP("80.4.4.1"), infoHash, 1313, 7))
+	assert.ElementsMatch(t, []int{0, 1, 2}, client.AllowedFastSet(ip, infoHash, 3, 10))
+	assert.Nil(t, client.AllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 7))
+}
+
+func TestMessage_FastMessages(t *testing.T) {
+	assert.Equal(t, []byte{0, 0, 0, 1, 14}, client.NewHaveAllMessage().Serialize())
+	assert.Equal(t, []byte{0, 0, 0, 1, 15}, client.NewHaveNoneMessage().Serialize())
+
+	index, err := client.ParseHave(*client.NewAllowedFastMessage(7))
+	require.NoError(t, err)
+	assert.Equal(t, 7, index)
+
+	index, err = client.ParseHave(*client.NewSuggestMessage(3))
+	require.NoError(t, err)
+	assert.Equal(t, 3, index)
+
+	index, begin, length, err := client.ParseRequest(*client.NewRejectMessage(1, 16384, 512))
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 16384, 512}, []int{index, begin, length})
+}
+
+func TestServer_FastExtension(t *testing.T) {
+	to, content := swarmTorrent(t, 32*1024, 1024)
+	server, _ := newSeeder(t, to, content)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(server.Port()))))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	request := client.NewHandshake([20]byte{31}, to.InfoHash)
+	request.Reserved.Set(client.ReservedFast)
+
+	_, err = conn.Write(request.Serialize())
+	require.NoError(t, err)
+
+	response, err := client.ReadResponse(conn)
+	require.NoError(t, err)
+	assert.True(t, response.Reserved.Has(client.ReservedFast))
+
+	// A seeder has every piece and grants our allowed fast set
+	message, err := client.ReadMessage(conn)
+	require.NoError(t, err)
+	assert.Equal(t, client.MessageHaveAll, message.ID)
+
+	expected := client.AllowedFastSet(net.IPv4(127, 0, 0, 1), to.InfoHash, len(to.PiecesHash), 10)
+	var granted []int
+
+	for len(granted) < len(expected) {
+		message, err := client.ReadMessage(conn)
+		require.NoError(t, err)
+		require.Equal(t, client.MessageAllowedFast, message.ID)
+
+		index, err := client.ParseHave(*message)
+		require.NoError(t, err)
+
+		granted = append(granted, index)
+	}
+
+	assert.Equal(t, expected, granted)
+
+	// Still choked, an allowed fast piece is served and any other is rejected
+	other := 0
+
+	for contains(granted, other) {
+		other++
+	}
+
+	_, err = conn.Write(client.NewRequestMessage(other, 0, 512).Serialize())
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewRequestMessage(granted[0], 0, 512).Serialize())
+	require.NoError(t, err)
+
+	message = readUntil(t, conn, func(m *client.Message) bool { return m.ID == client.MessageReject })
+	assert.Equal(t, client.NewRejectMessage(other, 0, 512).Payload, message.Payload)
+
+	message = readUntil(t, conn, func(m *client.Message) bool { return m.ID == client.MessagePiece })
+
+	index, begin, data, err := client.ParseBlock(*message)
+	require.NoError(t, err)
+	assert.Equal(t, granted[0], index)
+	assert.Equal(t, 0, begin)
+	assert.Equal(t, content[index*1024:index*1024+512], data)
+}
+
+func contains(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Accepts one download connection with the fast extension, sends have all and grants every piece without unchoking
+// The first request is rejected and the peer unchokes right after, the following ones are served
+// Returns a channel with the requests received from the downloader
+func newFastPeer(t *testing.T, to *torrent.TorrentFile, content []byte) (uint16, <-chan *client.Message) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan *client.Message, 64)
+
+	go func() {
+		defer close(requests)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := client.ReadResponse(conn); err != nil {
+			return
+		}
+
+		handshake := client.NewHandshake([20]byte{9}, to.InfoHash)
+		handshake.Reserved.Set(client.ReservedFast)
+
+		conn.Write(handshake.Serialize())
+		conn.Write(client.NewHaveAllMessage().Serialize())
+
+		for i := range to.PiecesHash {
+			conn.Write(client.NewAllowedFastMessage(i).Serialize())
+		}
+
+		rejected := false
+
+		for {
+			message, err := client.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+
+			if message.ID != client.MessageRequest {
+				continue
+			}
+
+			select {
+			case requests <- message:
+			default:
+			}
+
+			index, begin, length, _ := client.ParseRequest(*message)
+
+			if !rejected {
+				rejected = true
+				conn.Write(client.NewRejectMessage(index, begin, length).Serialize())
+				conn.Write(client.NewUnchokeMessage().Serialize())
+				continue
+			}
+
+			offset := index*int(to.PieceLength) + begin
+			conn.Write(client.NewPieceMessage(index, begin, content[offset:offset+length]).Serialize())
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port), requests
+}
+
+func TestDownloadTorrent_FastPeer(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+
+	fast, requests := newFastPeer(t, to, content)
+
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(fast)), &announces)
+	to.Announce = tracker.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t)})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// The first request went out while choked, and the rejected block was requested again
+	first := <-requests
+	again := false
+
+	for message := range requests {
+		again = again || string(message.Payload) == string(first.Payload)
+	}
+
+	assert.True(t, again, "rejected block not requested again")
+}
@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/lsd"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Joins a multicast group of its own, so the test does not hear real announces of the host
+func newLSDService(t *testing.T, group string) *lsd.Service {
+	service, err := lsd.NewService()
+	require.NoError(t, err)
+
+	service.Group = group
+
+	if err := service.Listen(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+
+	t.Cleanup(func() { service.Close() })
+
+	return service
+}
+
+func lsdGroup(t *testing.T) string {
+	return net.JoinHostPort("239.192.152.143", strconv.Itoa(int(freePort(t))))
+}
+
+func TestLSD_AnnounceReachesOtherPeers(t *testing.T) {
+	group := lsdGroup(t)
+	first := newLSDService(t, group)
+	second := newLSDService(t, group)
+
+	infoHash := [20]byte{4, 5, 6}
+
+	own, unsubscribeOwn := first.Subscribe(infoHash)
+	defer unsubscribeOwn()
+
+	peers, unsubscribe := second.Subscribe(infoHash)
+	defer unsubscribe()
+
+	other, unsubscribeOther := second.Subscribe([20]byte{7, 8, 9})
+	defer unsubscribeOther()
+
+	require.NoError(t, first.Announce(infoHash, 5000))
+
+	select {
+	case peer := <-peers:
+		assert.Equal(t, uint16(5000), peer.Port)
+	case <-time.After(5 * time.Second):
+		t.Fatal("announce not received")
+	}
+
+	// Our own announces and those of other torrents are not handed out
+	select {
+	case peer := <-own:
+		t.Fatalf("received own announce from %s", peer.Address())
+	case peer := <-other:
+		t.Fatalf("received announce of another torrent from %s", peer.Address())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDownloadTorrent_PeersFromLocalNetwork(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+	seeder, _ := newSeeder(t, to, content)
+
+	group := lsdGroup(t)
+	local := newLSDService(t, group)
+
+	// The torrent has no tracker, the seeder announces itself on the local network
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			// A fresh service per announce gets around the rate limit of the torrent
+			if service, err := lsd.NewService(); err == nil {
+				service.Group = group
+
+				if service.Listen() == nil {
+					_ = service.Announce(to.InfoHash, seeder.Port())
+					_ = service.Close()
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	dir := t.TempDir()
+
+	err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{
+		Path: dir,
+		Port: freePort(t),
+		LSD:  local,
+	})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
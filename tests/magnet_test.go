@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/client"
+	"Torrent-Client/torrent"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMagnet(t *testing.T) {
+	infoHash := [20]byte{0xd8, 0xf7, 0x39, 0xce, 0xc3, 0x28, 0x95, 0x6c, 0xcc, 0x5b, 0xbf, 0x1f, 0x86, 0xd9, 0xfd, 0xcf, 0xdb, 0xa8, 0xce, 0xb6}
+
+	magnet, err := torrent.ParseMagnet("magnet:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6" +
+		"&dn=debian.iso" +
+		"&tr=udp%3A%2F%2Ftracker.example.com%3A6969&tr=http%3A%2F%2Ftracker.example.org%2Fannounce&tr=udp%3A%2F%2Ftracker.example.com%3A6969" +
+		"&x.pe=10.0.0.1:6881&x.pe=%5B2001:db8::1%5D:51413&x.pe=peer.example.com:6881&x.pe=10.0.0.2:0")
+	require.NoError(t, err)
+
+	assert.Equal(t, infoHash, magnet.InfoHash)
+	assert.Equal(t, "debian.iso", magnet.Name)
+	assert.Equal(t, []string{"udp://tracker.example.com:6969", "http://tracker.example.org/announce"}, magnet.Trackers)
+	assert.Equal(t, [][]string{{"udp://tracker.example.com:6969"}, {"http://tracker.example.org/announce"}}, magnet.AnnounceTiers())
+
+	// Host names and invalid ports are skipped
+	require.Len(t, magnet.Peers, 2)
+	assert.Equal(t, "10.0.0.1:6881", magnet.Peers[0].Address())
+	assert.Equal(t, "[2001:db8::1]:51413", magnet.Peers[1].Address())
+
+	// Base32 info hashes name the same torrent
+	magnet, err = torrent.ParseMagnet("magnet:?xt=urn:btih:3D3TTTWDFCKWZTC3X4PYNWP5Z7N2RTVW")
+	require.NoError(t, err)
+	assert.Equal(t, infoHash, magnet.InfoHash)
+	assert.Empty(t, magnet.Trackers)
+
+	for _, invalid := range []string{
+		"http://example.com/file.torrent",
+		"magnet:?dn=no-hash",
+		"magnet:?xt=urn:sha1:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6",
+		"magnet:?xt=urn:btih:d8f739",
+		"magnet:?xt=urn:btih:z8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6",
+	} {
+		_, err := torrent.ParseMagnet(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	assert.True(t, torrent.IsMagnet("MAGNET:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6"))
+	assert.False(t, torrent.IsMagnet("debian.torrent"))
+}
+
+// Builds a torrent through the bencode decoder, so it carries its info dictionary
+func metadataTorrent(t *testing.T, length int, pieceLength int) (*torrent.TorrentFile, []byte) {
+	content := make([]byte, length)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	pieces := strings.Builder{}
+
+	for begin := 0; begin < length; begin += pieceLength {
+		hash := sha1.Sum(content[begin:min(begin+pieceLength, length)])
+		pieces.Write(hash[:])
+	}
+
+	to, err := torrent.BencodeToTorrentFile(bencode.BencodeValue{
+		Type: bencode.DictType,
+		Dict: map[string]bencode.BencodeValue{
+			"announce": {Type: bencode.StringType, Str: "http://127.0.0.1:1/announce"},
+			"info": {
+				Type: bencode.DictType,
+				Dict: map[string]bencode.BencodeValue{
+					"name":         {Type: bencode.StringType, Str: "magnet.bin"},
+					"length":       {Type: bencode.IntegerType, Int: int64(length)},
+					"piece length": {Type: bencode.IntegerType, Int: int64(pieceLength)},
+					"pieces":       {Type: bencode.StringType, Str: pieces.String()},
+				},
+			},
+		},
+	}, torrent.BencodeToTorrentFileOpts{From: "test"})
+	require.NoError(t, err)
+
+	return &to, content
+}
+
+func TestNewTorrentFromMetadata(t *testing.T) {
+	to, _ := metadataTorrent(t, 4096, 1024)
+
+	magnet := torrent.Magnet{InfoHash: to.InfoHash, Trackers: []string{"udp://tracker.example.com:6969"}}
+
+	built, err := torrent.NewTorrentFromMetadata(to.Info, magnet)
+	require.NoError(t, err)
+	assert.Equal(t, to.Name, built.Name)
+	assert.Equal(t, to.PiecesHash, built.PiecesHash)
+	assert.Equal(t, to.InfoHash, built.InfoHash)
+	assert.Equal(t, "udp://tracker.example.com:6969", built.Announce)
+
+	// Metadata of another torrent is refused
+	magnet.InfoHash[0] ^= 0xff
+	_, err = torrent.NewTorrentFromMetadata(to.Info, magnet)
+	assert.Error(t, err)
+}
+
+func TestFetchMetadata_FromSeeder(t *testing.T) {
+	// A thousand pieces make an info dictionary of two metadata pieces
+	to, content := metadataTorrent(t, 1000*1024, 1024)
+	require.Greater(t, len(to.Info), 16*1024)
+
+	server, _ := newSeeder(t, to, content)
+
+	magnet := torrent.Magnet{
+		InfoHash: to.InfoHash,
+		Peers:    []torrent.Peer{{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	fetched, err := client.FetchMetadata(ctx, magnet, client.DownloadOptions{Port: freePort(t)})
+	require.NoError(t, err)
+	assert.Equal(t, to.Info, fetched.Info)
+	assert.Equal(t, to.PiecesHash, fetched.PiecesHash)
+	assert.Equal(t, to.Length, fetched.Length)
+
+	// The torrent built from the metadata downloads like any other
+	dir := t.TempDir()
+
+	err = client.DownloadTorrentContext(ctx, &fetched, client.DownloadOptions{Path: dir, Port: freePort(t), Peers: magnet.Peers})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "magnet.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestFetchMetadata_PeerWithoutMetadata(t *testing.T) {
+	// Torrents built by hand have no info dictionary to offer
+	to, content := swarmTorrent(t, 4096, 1024)
+	server, _ := newSeeder(t, to, content)
+
+	magnet := torrent.Magnet{
+		InfoHash: to.InfoHash,
+		Peers:    []torrent.Peer{{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := client.FetchMetadata(ctx, magnet, client.DownloadOptions{Port: freePort(t), PeerWaitTimeout: 200 * time.Millisecond})
+	assert.ErrorIs(t, err, client.ErrNoPeers)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestFetchMetadata_FailsWithoutPeers(t *testing.T) {
+	to, _ := metadataTorrent(t, 4096, 1024)
+
+	// The tracker answers every announce, never with a peer
+	var announces int32
+	tracker := newHTTPTracker(t, trackerResponse(1800, ""), &announces)
+
+	magnet := torrent.Magnet{InfoHash: to.InfoHash, Trackers: []string{tracker.URL}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := client.FetchMetadata(ctx, magnet, client.DownloadOptions{Port: freePort(t), PeerWaitTimeout: 200 * time.Millisecond})
+
+	// The fetch gives up on its own, long before the context expires
+	assert.ErrorIs(t, err, client.ErrNoPeers)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestMetadataExchange_OversizedString(t *testing.T) {
+	to, content := metadataTorrent(t, 4096, 1024)
+	server, _ := newSeeder(t, to, content)
+
+	conn := dialExtended(t, server.Port(), to.InfoHash, [20]byte{31}, &client.ExtendedHandshake{
+		Extensions: map[string]uint8{"ut_metadata": 3},
+	})
+
+	message := readUntil(t, conn, func(m *client.Message) bool {
+		return m.ID == client.MessageExtended && m.Payload[0] == 0
+	})
+
+	handshake, err := client.ParseExtendedHandshake(message.Payload[1:])
+	require.NoError(t, err)
+	id := handshake.Extensions["ut_metadata"]
+	require.NotZero(t, id)
+
+	// The piece claims ~10GB, the message is dropped and the connection keeps serving
+	_, err = conn.Write(client.NewExtendedMessage(id, []byte("d8:msg_typei0e5:piece9999999999999:e")).Serialize())
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewExtendedMessage(id, []byte("d8:msg_typei0e5:piecei0ee")).Serialize())
+	require.NoError(t, err)
+
+	message = readUntil(t, conn, func(m *client.Message) bool {
+		return m.ID == client.MessageExtended && m.Payload[0] == 3
+	})
+
+	assert.True(t, strings.HasSuffix(string(message.Payload[1:]), string(to.Info)))
+}
@@ -3,6 +3,9 @@ package tests
 import (
 	"Torrent-Client/client"
 	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
@@ -87,3 +90,35 @@ func TestMessage_Serialize(t *testing.T) {
 		})
 	}
 }
+
+func TestReadMessage_RejectsOversizedMessages(t *testing.T) {
+	// A whole block is accepted
+	block := client.NewPieceMessage(1, 0, make([]byte, 16384)).Serialize()
+
+	message, err := client.ReadMessage(bytes.NewReader(block))
+	require.NoError(t, err)
+	assert.Equal(t, client.MessagePiece, message.ID)
+	assert.Len(t, message.Payload, 8+16384)
+
+	tests := []struct {
+		name   string
+		id     client.MessageID
+		length uint32
+	}{
+		{"piece longer than a block", client.MessagePiece, 1 + 8 + 16384 + 1},
+		{"long have", client.MessageHave, 100},
+		{"huge bitfield", client.MessageBitfield, 0xffffffff},
+		{"huge extended", client.MessageExtended, 1 << 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the header is sent, the length must be refused before the payload is read
+			header := binary.BigEndian.AppendUint32(nil, tt.length)
+			header = append(header, byte(tt.id))
+
+			_, err := client.ReadMessage(bytes.NewReader(header))
+			assert.ErrorContains(t, err, "too long")
+		})
+	}
+}
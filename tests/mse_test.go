@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/mse"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Keeps the bytes read from the connection, as they went over the wire
+type recordingConn struct {
+	net.Conn
+	received bytes.Buffer
+}
+
+func (r *recordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.received.Write(b[:n])
+
+	return n, err
+}
+
+type acceptResult struct {
+	conn     *mse.Conn
+	received []byte
+	err      error
+}
+
+// Accepts one connection on the loopback and runs the MSE handshake on it, then reads a BitTorrent handshake
+// and answers with a piece of data
+func acceptEncrypted(t *testing.T, infoHashes [][20]byte, policy mse.Policy) (string, <-chan acceptResult) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	results := make(chan acceptResult, 1)
+
+	go func() {
+		raw, err := listener.Accept()
+		if err != nil {
+			results <- acceptResult{err: err}
+			return
+		}
+		defer raw.Close()
+
+		raw.SetDeadline(time.Now().Add(5 * time.Second))
+		recording := &recordingConn{Conn: raw}
+
+		conn, err := mse.Accept(recording, infoHashes, policy)
+		if err == nil {
+			_, err = client.ReadResponse(conn)
+		}
+		if err == nil {
+			_, err = conn.Write([]byte("data of the piece"))
+		}
+
+		results <- acceptResult{conn: conn, received: recording.received.Bytes(), err: err}
+	}()
+
+	return listener.Addr().String(), results
+}
+
+func TestMSE_EncryptsStream(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	address, results := acceptEncrypted(t, [][20]byte{{9, 9, 9}, infoHash}, mse.Prefer)
+
+	raw, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer raw.Close()
+
+	require.NoError(t, raw.SetDeadline(time.Now().Add(5*time.Second)))
+
+	conn, err := mse.Initiate(raw, infoHash, mse.Prefer)
+	require.NoError(t, err)
+	assert.Equal(t, mse.CryptoRC4, conn.Method())
+
+	_, err = conn.Write(client.NewHandshake([20]byte{4}, infoHash).Serialize())
+	require.NoError(t, err)
+
+	data := make([]byte, len("data of the piece"))
+	_, err = conn.Read(data)
+	require.NoError(t, err)
+	assert.Equal(t, "data of the piece", string(data))
+
+	result := <-results
+	require.NoError(t, result.err)
+	assert.Equal(t, mse.CryptoRC4, result.conn.Method())
+	assert.Equal(t, infoHash, result.conn.InfoHash())
+
+	// Neither the protocol string nor the info hash went over the wire in the clear
+	assert.NotContains(t, string(result.received), "BitTorrent protocol")
+	assert.NotContains(t, string(result.received), string(infoHash[:]))
+}
+
+func TestMSE_PlainHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	for _, policy := range []mse.Policy{mse.Prefer, mse.Require} {
+		t.Run(policy.String(), func(t *testing.T) {
+			address, results := acceptEncrypted(t, [][20]byte{infoHash}, policy)
+
+			conn, err := net.Dial("tcp", address)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write(client.NewHandshake([20]byte{4}, infoHash).Serialize())
+			require.NoError(t, err)
+
+			result := <-results
+
+			// Prefer lets a plain handshake through, Require drops the connection
+			if policy == mse.Require {
+				assert.Error(t, result.err)
+				return
+			}
+
+			require.NoError(t, result.err)
+			assert.Equal(t, mse.CryptoMethod(0), result.conn.Method())
+		})
+	}
+}
+
+func TestMSE_UnknownInfoHash(t *testing.T) {
+	address, results := acceptEncrypted(t, [][20]byte{{9, 9, 9}}, mse.Require)
+
+	raw, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer raw.Close()
+
+	require.NoError(t, raw.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = mse.Initiate(raw, [20]byte{1, 2, 3}, mse.Require)
+	assert.Error(t, err)
+
+	assert.Error(t, (<-results).err)
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []mse.Policy{mse.Disabled, mse.Prefer, mse.Require} {
+		parsed, err := mse.ParsePolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+
+	_, err := mse.ParsePolicy("always")
+	assert.Error(t, err)
+}
+
+func TestDownloadTorrent_Encryption(t *testing.T) {
+	tests := []struct {
+		seeder     mse.Policy
+		downloader mse.Policy
+	}{
+		{mse.Require, mse.Require},
+		{mse.Prefer, mse.Prefer},
+		{mse.Prefer, mse.Disabled},
+		// The seeder does not speak MSE, the downloader dials it again for a plain connection
+		{mse.Disabled, mse.Prefer},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s to %s", tt.downloader, tt.seeder), func(t *testing.T) {
+			to, content := swarmTorrent(t, 64*1024, 16*1024)
+
+			seeder, _ := newSeeder(t, to, content)
+			seeder.SetEncryption(tt.seeder)
+
+			var announces int32
+			tracker := newHTTPTracker(t, trackerResponse(1800, compactPeer(seeder.Port())), &announces)
+			to.Announce = tracker.URL
+
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+
+			dir := t.TempDir()
+
+			err := client.DownloadTorrentContext(ctx, to, client.DownloadOptions{
+				Path:       dir,
+				Port:       freePort(t),
+				Encryption: tt.downloader,
+			})
+			require.NoError(t, err)
+
+			data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+			require.NoError(t, err)
+			assert.Equal(t, content, data)
+		})
+	}
+}
@@ -87,3 +87,58 @@ func TestParse(t *testing.T) {
 	}
 
 }
+
+func TestDictValueBytes(t *testing.T) {
+	data := []byte("d1:ai0e4:infod6:lengthi0e4:name0:e1:zi1ee")
+
+	raw, err := bencode.DictValueBytes(data, "info")
+
+	if err != nil {
+		t.Fatalf("DictValueBytes() error = %v", err)
+	}
+
+	if string(raw) != "d6:lengthi0e4:name0:e" {
+		t.Errorf("DictValueBytes() = %q, expected the bytes of the info dictionary", raw)
+	}
+
+	if _, err := bencode.DictValueBytes(data, "missing"); err == nil {
+		t.Errorf("DictValueBytes() expected an error for a missing key")
+	}
+}
+
+func TestEncode_WritesEmptyValues(t *testing.T) {
+	value := bencode.BencodeValue{
+		Type: bencode.DictType,
+		Dict: map[string]bencode.BencodeValue{
+			"a": {Type: bencode.DictType, Dict: map[string]bencode.BencodeValue{}},
+			"b": {Type: bencode.ListType},
+			"c": {Type: bencode.IntegerType, Int: 0},
+			"d": {Type: bencode.StringType},
+		},
+	}
+
+	buffer := bytes.Buffer{}
+
+	if err := value.Encode(&buffer); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	if buffer.String() != "d1:ade1:ble1:ci0e1:d0:e" {
+		t.Errorf("Encode() = %q, expected every value", buffer.String())
+	}
+}
+
+func TestParse_DeclaredLengthPastInput(t *testing.T) {
+	// The string claims to be ~10GB long, the parser must not allocate what is not there
+	inputs := []string{
+		"d1:t9999999999999:ae",
+		"9999999999999:a",
+		"l9223372036854775807:e",
+	}
+
+	for _, input := range inputs {
+		if _, err := bencode.Parse(bytes.NewReader([]byte(input))); err == nil {
+			t.Errorf("Parse(%q) expected an error", input)
+		}
+	}
+}
@@ -2,6 +2,10 @@ package tests
 
 import (
 	"Torrent-Client/client"
+	"Torrent-Client/mse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
 	"testing"
 )
 
@@ -37,3 +41,65 @@ func TestDecodePeers(t *testing.T) {
 	}
 
 }
+
+func TestDecodePeers6(t *testing.T) {
+	_, err := client.DecodePeers6([]byte{})
+	assert.Error(t, err)
+
+	_, err = client.DecodePeers6(make([]byte, 17))
+	assert.Error(t, err)
+
+	peers, err := client.DecodePeers6([]byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 1, 1, 0, 80,
+	})
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+
+	assert.Equal(t, "[2001:db8::1]:6881", peers[0].Address())
+	assert.Equal(t, "tcp6", peers[0].Network())
+
+	// IPv4-mapped addresses are dialed over IPv4
+	assert.Equal(t, "192.168.1.1:80", peers[1].Address())
+	assert.Equal(t, "tcp4", peers[1].Network())
+}
+
+func TestNewClient_IPv6Peer(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+
+	defer listener.Close()
+
+	infoHash := [20]byte{1, 2, 3}
+	remoteID := [20]byte{4, 5, 6}
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		if _, err := client.ReadResponse(conn); err != nil {
+			return
+		}
+
+		conn.Write(client.NewHandshake(remoteID, infoHash).Serialize())
+		conn.Write((&client.Message{ID: client.MessageBitfield, Payload: []byte{0xff}}).Serialize())
+
+		// Keep the connection open until the client is done
+		conn.Read(make([]byte, 1))
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	peer := client.Peer{IP: address.IP, Port: uint16(address.Port)}
+
+	c, err := client.NewClient(peer, infoHash, [20]byte{7, 8, 9}, 8, mse.Disabled)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+}
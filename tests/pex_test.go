@@ -0,0 +1,291 @@
+package tests
+
+import (
+	"Torrent-Client/bencode"
+	"Torrent-Client/client"
+	"Torrent-Client/storage"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Connects to the server with the extension protocol and sends our extended handshake
+func dialExtended(t *testing.T, port uint16, infoHash [20]byte, peerID [20]byte, handshake *client.ExtendedHandshake) net.Conn {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	request := client.NewHandshake(peerID, infoHash)
+	request.Reserved.Set(client.ReservedExtensionProtocol)
+
+	_, err = conn.Write(request.Serialize())
+	require.NoError(t, err)
+
+	_, err = client.ReadResponse(conn)
+	require.NoError(t, err)
+
+	payload, err := handshake.Serialize()
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewExtendedMessage(0, payload).Serialize())
+	require.NoError(t, err)
+
+	return conn
+}
+
+// Reads messages until one matches
+func readUntil(t *testing.T, conn net.Conn, match func(*client.Message) bool) *client.Message {
+	for {
+		message, err := client.ReadMessage(conn)
+		require.NoError(t, err)
+
+		if match(message) {
+			return message
+		}
+	}
+}
+
+func TestPeerExchange_AdvertisesConnectedPeers(t *testing.T) {
+	server, session := newSeedingServer(t)
+	infoHash := session.Torrent().InfoHash
+
+	// The first peer connected to us, it listens on the port of its extended handshake
+	first := dialExtended(t, server.Port(), infoHash, [20]byte{21}, &client.ExtendedHandshake{
+		Extensions: map[string]uint8{"ut_pex": 1},
+		Port:       7001,
+	})
+
+	// Unchoked once the server handled the messages before interested, the extended handshake among them
+	_, err := first.Write(client.NewInterestedMessage().Serialize())
+	require.NoError(t, err)
+
+	readUntil(t, first, func(m *client.Message) bool { return m.ID == client.MessageUnchoke })
+
+	second := dialExtended(t, server.Port(), infoHash, [20]byte{22}, &client.ExtendedHandshake{
+		Extensions: map[string]uint8{"ut_pex": 5},
+	})
+
+	message := readUntil(t, second, func(m *client.Message) bool {
+		return m.ID == client.MessageExtended && m.Payload[0] == 5
+	})
+
+	value, err := bencode.Parse(bytes.NewReader(message.Payload[1:]))
+	require.NoError(t, err)
+
+	assert.Equal(t, compactPeer(7001), value.Dict["added"].Str)
+	assert.Equal(t, "\x00", value.Dict["added.f"].Str)
+	assert.NotContains(t, value.Dict, "dropped")
+}
+
+func TestDownloadTorrent_PeersFromPeerExchange(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+	seeder, seederSession := newSeeder(t, to, content)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	// A peer without any piece, it only tells the downloader about the seeder
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		if _, err := client.ReadResponse(conn); err != nil {
+			return
+		}
+
+		response := client.NewHandshake([20]byte{9}, to.InfoHash)
+		response.Reserved.Set(client.ReservedExtensionProtocol)
+		conn.Write(response.Serialize())
+		conn.Write(client.NewBitfieldMessage(client.NewBitfield(len(to.PiecesHash))).Serialize())
+
+		ours, _ := (&client.ExtendedHandshake{Extensions: map[string]uint8{"ut_pex": 1}}).Serialize()
+		conn.Write(client.NewExtendedMessage(0, ours).Serialize())
+
+		for {
+			message, err := client.ReadMessage(conn)
+
+			if err != nil {
+				return
+			}
+
+			if message.ID != client.MessageExtended || message.Payload[0] != 0 {
+				continue
+			}
+
+			theirs, err := client.ParseExtendedHandshake(message.Payload[1:])
+
+			if err != nil {
+				return
+			}
+
+			pex := "d5:added6:" + compactPeer(seeder.Port()) + "7:added.f1:\x02e"
+			conn.Write(client.NewExtendedMessage(theirs.Extensions["ut_pex"], []byte(pex)).Serialize())
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	peer := client.Peer{IP: net.IPv4(127, 0, 0, 1).To4(), Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+
+	err = client.DownloadTorrentContext(ctx, to, client.DownloadOptions{Path: dir, Port: freePort(t), Peers: []client.Peer{peer}})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	assert.Equal(t, int64(len(content)), seederSession.Uploaded())
+}
+
+func TestPeerExchange_OversizedString(t *testing.T) {
+	server, session := newSeedingServer(t)
+
+	conn := dialExtended(t, server.Port(), session.Torrent().InfoHash, [20]byte{23}, &client.ExtendedHandshake{
+		Extensions: map[string]uint8{"ut_pex": 1},
+	})
+
+	message := readUntil(t, conn, func(m *client.Message) bool {
+		return m.ID == client.MessageExtended && m.Payload[0] == 0
+	})
+
+	handshake, err := client.ParseExtendedHandshake(message.Payload[1:])
+	require.NoError(t, err)
+	id := handshake.Extensions["ut_pex"]
+	require.NotZero(t, id)
+
+	// The peer list claims ~10GB, the message is dropped and the connection keeps going
+	_, err = conn.Write(client.NewExtendedMessage(id, []byte("d5:added9999999999999:e")).Serialize())
+	require.NoError(t, err)
+
+	_, err = conn.Write(client.NewInterestedMessage().Serialize())
+	require.NoError(t, err)
+
+	readUntil(t, conn, func(m *client.Message) bool { return m.ID == client.MessageUnchoke })
+}
+
+// Accepts connections on loopback, signalling each one
+func acceptingListener(t *testing.T) (net.Listener, <-chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan struct{}, 16)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	return listener, accepted
+}
+
+func TestPeerExchange_BetweenOurClients(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 16*1024)
+	interval := time.Second
+
+	store, err := storage.NewStorage(to, t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	_, err = store.WriteAt(content, 0)
+	require.NoError(t, err)
+
+	// Only the first piece, the download never completes and keeps exchanging peers
+	completed := client.NewBitfield(len(to.PiecesHash))
+	completed.SetPiece(0)
+
+	session := client.NewSession(to, store, completed, [20]byte{1})
+	session.PeerExchangeInterval = interval
+
+	server, err := client.NewServer(0)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	server.AddSession(session)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go session.Run(ctx)
+	started := time.Now()
+
+	// Peers the seeder is connected to, the downloader learns about them over peer exchange and dials them
+	join := func(peerID byte) <-chan struct{} {
+		listener, accepted := acceptingListener(t)
+
+		conn := dialExtended(t, server.Port(), to.InfoHash, [20]byte{peerID}, &client.ExtendedHandshake{
+			Extensions: map[string]uint8{"ut_pex": 1},
+			Port:       uint16(listener.Addr().(*net.TCPAddr).Port),
+		})
+
+		_, err := conn.Write(client.NewInterestedMessage().Serialize())
+		require.NoError(t, err)
+
+		readUntil(t, conn, func(m *client.Message) bool { return m.ID == client.MessageUnchoke })
+
+		return accepted
+	}
+
+	first := join(41)
+
+	// Connecting just before the seeder checks its connections, a message sent then would closely follow the first one
+	time.Sleep(time.Until(started.Add(interval * 8 / 10)))
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		client.DownloadTorrentContext(ctx, to, client.DownloadOptions{
+			Path:                 t.TempDir(),
+			Port:                 freePort(t),
+			Peers:                []client.Peer{{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}},
+			PeerExchangeInterval: interval,
+		})
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The first message goes out with the extended handshake
+	select {
+	case <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first peer was not exchanged")
+	}
+
+	// The next one waits for the interval, the downloader would drop it otherwise and never learn about this peer
+	second := join(42)
+
+	select {
+	case <-second:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second peer was not exchanged")
+	}
+}
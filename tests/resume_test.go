@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResume_SaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	to := &torrent.TorrentFile{
+		Name:       "demo",
+		InfoHash:   [20]byte{1, 2, 3},
+		PiecesHash: make([][20]byte, 10),
+	}
+
+	path := client.ResumePath(to, dir)
+	assert.Equal(t, filepath.Join(dir, "demo.resume"), path)
+
+	bitfield := client.NewBitfield(len(to.PiecesHash))
+	bitfield.SetPiece(0)
+	bitfield.SetPiece(9)
+
+	require.NoError(t, client.SaveResume(path, client.ResumeData{InfoHash: to.InfoHash, Bitfield: bitfield}))
+
+	loaded, err := client.LoadResume(path, to)
+	require.NoError(t, err)
+	assert.Equal(t, bitfield, loaded)
+	assert.True(t, loaded.HasPiece(9))
+	assert.False(t, loaded.HasPiece(5))
+}
+
+func TestResume_RejectsStaleFile(t *testing.T) {
+	dir := t.TempDir()
+
+	to := &torrent.TorrentFile{
+		Name:       "demo",
+		InfoHash:   [20]byte{1, 2, 3},
+		PiecesHash: make([][20]byte, 10),
+	}
+
+	path := client.ResumePath(to, dir)
+
+	_, err := client.LoadResume(path, to)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Another torrent
+	require.NoError(t, client.SaveResume(path, client.ResumeData{InfoHash: [20]byte{9}, Bitfield: client.NewBitfield(10)}))
+	_, err = client.LoadResume(path, to)
+	assert.Error(t, err)
+
+	// Bitfield sized for a different number of pieces
+	require.NoError(t, client.SaveResume(path, client.ResumeData{InfoHash: to.InfoHash, Bitfield: client.NewBitfield(30)}))
+	_, err = client.LoadResume(path, to)
+	assert.Error(t, err)
+
+	// Spare bits set past the last of the 10 pieces
+	require.NoError(t, client.SaveResume(path, client.ResumeData{InfoHash: to.InfoHash, Bitfield: client.Bitfield{0xff, 0xc1}}))
+	_, err = client.LoadResume(path, to)
+	assert.Error(t, err)
+}
@@ -0,0 +1,313 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/mse"
+	"Torrent-Client/storage"
+	"Torrent-Client/torrent"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Starts a server seeding the torrent, the content is written to a fresh storage first
+func newSeeder(t *testing.T, to *torrent.TorrentFile, content []byte) (*client.Server, *client.Session) {
+	pieces := make([]int, len(to.PiecesHash))
+	for i := range pieces {
+		pieces[i] = i
+	}
+
+	return newPartialSeeder(t, to, content, pieces...)
+}
+
+// Starts a server offering only the given pieces of the torrent
+func newPartialSeeder(t *testing.T, to *torrent.TorrentFile, content []byte, pieces ...int) (*client.Server, *client.Session) {
+	store, err := storage.NewStorage(to, t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	_, err = store.WriteAt(content, 0)
+	require.NoError(t, err)
+
+	completed := client.NewBitfield(len(to.PiecesHash))
+	for _, i := range pieces {
+		completed.SetPiece(i)
+	}
+
+	session := client.NewSession(to, store, completed, [20]byte{1})
+
+	server, err := client.NewServer(0)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	server.AddSession(session)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go session.Run(ctx)
+
+	return server, session
+}
+
+// Seeds the storage test torrent with every piece on disk
+func newSeedingServer(t *testing.T) (*client.Server, *client.Session) {
+	to := storageTorrent()
+	to.InfoHash = [20]byte{9, 8, 7}
+
+	return newSeeder(t, to, []byte("ABCDEFGHIJKLMNOPQRST"))
+}
+
+func TestServer_ServesRequests(t *testing.T) {
+	server, session := newSeedingServer(t)
+
+	peer := client.Peer{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}
+
+	// The handshake is answered and our pieces are the first message
+	c, err := client.NewClient(peer, session.Torrent().InfoHash, [20]byte{2}, len(session.Torrent().PiecesHash), mse.Disabled)
+	require.NoError(t, err)
+
+	require.NoError(t, c.SendInterested())
+
+	message, err := readPeerMessage(c)
+	require.NoError(t, err)
+	assert.Equal(t, client.MessageUnchoke, message.ID)
+
+	// The block spans the two files of the torrent
+	require.NoError(t, c.SendRequest(0, 3, 4))
+
+	message, err = readPeerMessage(c)
+	require.NoError(t, err)
+	require.Equal(t, client.MessagePiece, message.ID)
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(message.Payload[0:4]))
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(message.Payload[4:8]))
+	assert.Equal(t, []byte("DEFG"), message.Payload[8:])
+
+	// Requests past the end of the piece are rejected, the next one is still served
+	require.NoError(t, c.SendRequest(2, 2, 4))
+	require.NoError(t, c.SendRequest(2, 0, 4))
+
+	message, err = readPeerMessage(c)
+	require.NoError(t, err)
+	require.Equal(t, client.MessageReject, message.ID)
+	assert.Equal(t, client.NewRejectMessage(2, 2, 4).Payload, message.Payload)
+
+	message, err = readPeerMessage(c)
+	require.NoError(t, err)
+	require.Equal(t, client.MessagePiece, message.ID)
+	assert.Equal(t, []byte("QRST"), message.Payload[8:])
+
+	assert.Equal(t, int64(8), session.Uploaded())
+}
+
+func TestServer_RejectsBlocksLargerThanItAccepts(t *testing.T) {
+	to, content := swarmTorrent(t, 64*1024, 32*1024)
+	server, _ := newSeeder(t, to, content)
+
+	peer := client.Peer{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}
+
+	c, err := client.NewClient(peer, to.InfoHash, [20]byte{2}, len(to.PiecesHash), mse.Disabled)
+	require.NoError(t, err)
+
+	require.NoError(t, c.SendInterested())
+
+	message, err := readPeerMessage(c)
+	require.NoError(t, err)
+	require.Equal(t, client.MessageUnchoke, message.ID)
+
+	// A piece message for this block would be larger than ReadMessage accepts
+	require.NoError(t, c.SendRequest(0, 0, 32*1024))
+	require.NoError(t, c.SendRequest(0, 0, 16*1024))
+
+	message, err = readPeerMessage(c)
+	require.NoError(t, err)
+	require.Equal(t, client.MessageReject, message.ID)
+	assert.Equal(t, client.NewRejectMessage(0, 0, 32*1024).Payload, message.Payload)
+
+	message, err = readPeerMessage(c)
+	require.NoError(t, err)
+	require.Equal(t, client.MessagePiece, message.ID)
+	assert.Equal(t, content[:16*1024], message.Payload[8:])
+}
+
+// Reads the next message of the peer, skipping the pieces and the extended handshake the server sends first
+func readPeerMessage(c *client.Client) (*client.Message, error) {
+	for {
+		message, err := c.ReadMessage()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch message.ID {
+		case client.MessageBitfield, client.MessageHaveAll, client.MessageAllowedFast, client.MessageExtended:
+		default:
+			return message, nil
+		}
+	}
+}
+
+// Waits briefly for the unchoke message that follows interested
+func waitUnchoke(c *client.Client) bool {
+	unchoked := make(chan bool, 1)
+
+	go func() {
+		message, err := readPeerMessage(c)
+		unchoked <- err == nil && message.ID == client.MessageUnchoke
+	}()
+
+	select {
+	case result := <-unchoked:
+		return result
+	case <-time.After(300 * time.Millisecond):
+		return false
+	}
+}
+
+func TestSession_UploadSlots(t *testing.T) {
+	server, session := newSeedingServer(t)
+
+	peer := client.Peer{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}
+
+	// Only four interested peers get a slot until the next rechoke picks an optimistic unchoke
+	unchoked := 0
+
+	for i := 0; i < 6; i++ {
+		c, err := client.NewClient(peer, session.Torrent().InfoHash, [20]byte{byte(10 + i)}, len(session.Torrent().PiecesHash), mse.Disabled)
+		require.NoError(t, err)
+
+		require.NoError(t, c.SendInterested())
+
+		if waitUnchoke(c) {
+			unchoked++
+		}
+	}
+
+	assert.Equal(t, 4, unchoked)
+}
+
+func TestServer_RejectsUnknownTorrent(t *testing.T) {
+	server, _ := newSeedingServer(t)
+
+	peer := client.Peer{IP: net.IPv4(127, 0, 0, 1).To4(), Port: server.Port()}
+
+	_, err := client.NewClient(peer, [20]byte{6, 6, 6}, [20]byte{2}, 1, mse.Disabled)
+	assert.Error(t, err)
+}
+
+// Connects to the server as a plain peer, the handshake done
+func dialSession(t *testing.T, server *client.Server, session *client.Session) net.Conn {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(server.Port()))))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write(client.NewHandshake([20]byte{3}, session.Torrent().InfoHash).Serialize())
+	require.NoError(t, err)
+
+	_, err = client.ReadResponse(conn)
+	require.NoError(t, err)
+
+	return conn
+}
+
+// Reads until the server closes the connection, failing when it is left open
+func assertClosed(t *testing.T, conn net.Conn) {
+	var err error
+
+	for {
+		if _, err = client.ReadMessage(conn); err != nil {
+			break
+		}
+	}
+
+	var netErr net.Error
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection left open")
+}
+
+func TestServer_ClosesOnInvalidBitfield(t *testing.T) {
+	server, session := newSeedingServer(t)
+	pieces := len(session.Torrent().PiecesHash)
+
+	conn := dialSession(t, server, session)
+
+	// Every bit of the last byte is set, the ones past the last piece too
+	bitfield := client.NewBitfield(pieces)
+	bitfield[len(bitfield)-1] = 0xff
+
+	_, err := conn.Write((&client.Message{ID: client.MessageBitfield, Payload: bitfield}).Serialize())
+	require.NoError(t, err)
+
+	assertClosed(t, conn)
+}
+
+func TestServer_ClosesOnHaveForUnknownPiece(t *testing.T) {
+	server, session := newSeedingServer(t)
+	pieces := len(session.Torrent().PiecesHash)
+	require.NotZero(t, pieces%8, "the last byte of the bitfield needs spare bits")
+
+	conn := dialSession(t, server, session)
+
+	// The index fits the last byte of the bitfield, past the last piece
+	_, err := conn.Write(client.NewHaveMessage(pieces).Serialize())
+	require.NoError(t, err)
+
+	assertClosed(t, conn)
+}
+
+func TestServer_LimitsInboundPeers(t *testing.T) {
+	to := storageTorrent()
+	to.InfoHash = [20]byte{9, 8, 7}
+
+	store, err := storage.NewStorage(to, t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	completed := client.NewBitfield(len(to.PiecesHash))
+	completed.SetPiece(0)
+
+	session := client.NewSession(to, store, completed, [20]byte{1})
+	session.MaxInboundPeers = 1
+
+	server, err := client.NewServer(0)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	server.AddSession(session)
+
+	// Served, our pieces are its first message
+	first := dialSession(t, server, session)
+
+	message, err := client.ReadMessage(first)
+	require.NoError(t, err)
+	assert.Equal(t, client.MessageBitfield, message.ID)
+
+	// Over the limit, dropped right after the handshake
+	assertClosed(t, dialSession(t, server, session))
+
+	// The slot is free again once the first peer is gone
+	require.NoError(t, first.Close())
+
+	assert.Eventually(t, func() bool {
+		conn := dialSession(t, server, session)
+		defer conn.Close()
+
+		message, err := client.ReadMessage(conn)
+		return err == nil && message.ID == client.MessageBitfield
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestParseRequest(t *testing.T) {
+	index, begin, length, err := client.ParseRequest(*client.NewRequestMessage(4, 16384, 512))
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 16384, 512}, []int{index, begin, length})
+
+	_, _, _, err = client.ParseRequest(*client.NewHaveMessage(1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"Torrent-Client/storage"
+	"Torrent-Client/torrent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func storageTorrent() *torrent.TorrentFile {
+	return &torrent.TorrentFile{
+		Name:        "album",
+		PieceLength: 8,
+		Length:      20,
+		PiecesHash:  make([][20]byte, 3),
+		Files: []torrent.File{
+			{Path: []string{"album", "a.txt"}, Length: 5, Offset: 0},
+			{Path: []string{"album", "empty"}, Length: 0, Offset: 5},
+			{Path: []string{"album", "disc", "b.txt"}, Length: 15, Offset: 5},
+		},
+	}
+}
+
+func TestStorage_WritePiece(t *testing.T) {
+	dir := t.TempDir()
+	to := storageTorrent()
+
+	store, err := storage.NewStorage(to, dir)
+	require.NoError(t, err)
+
+	// Files are created with their final size before any piece arrives
+	for _, file := range to.Files {
+		info, err := os.Stat(file.LocalPath(dir))
+		require.NoError(t, err)
+		assert.Equal(t, file.Length, info.Size())
+	}
+
+	// Pieces are written out of order and across file boundaries
+	require.NoError(t, store.WritePiece(2, []byte("QRST")))
+	require.NoError(t, store.WritePiece(0, []byte("ABCDEFGH")))
+	require.NoError(t, store.WritePiece(1, []byte("IJKLMNOP")))
+	assert.Error(t, store.WritePiece(1, []byte("short")))
+
+	piece, err := store.ReadPiece(1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("IJKLMNOP"), piece)
+
+	require.NoError(t, store.Close())
+
+	a, err := os.ReadFile(filepath.Join(dir, "album", "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "ABCDE", string(a))
+
+	b, err := os.ReadFile(filepath.Join(dir, "album", "disc", "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "FGHIJKLMNOPQRST", string(b))
+}
+
+func TestStorage_KeepsExistingData(t *testing.T) {
+	dir := t.TempDir()
+	to := storageTorrent()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "album"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "album", "a.txt"), []byte("ABC"), 0644))
+
+	store, err := storage.NewStorage(to, dir)
+	require.NoError(t, err)
+
+	defer store.Close()
+
+	data := make([]byte, 5)
+	_, err = store.ReadAt(data, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{'A', 'B', 'C', 0, 0}, data)
+
+	_, err = store.ReadAt(make([]byte, 4), 18)
+	assert.Error(t, err)
+}
@@ -3,8 +3,12 @@ package tests
 import (
 	"Torrent-Client/bencode"
 	"Torrent-Client/torrent"
+	"encoding/hex"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -35,7 +39,7 @@ func TestWithoutParse(t *testing.T) {
 						Dict: map[string]bencode.BencodeValue{
 							"pieces":       {Str: "1234567890abcdefghijabcdefghij1234567890", Type: bencode.StringType},
 							"piece length": {Int: 262144, Type: bencode.IntegerType},
-							"length":       {Int: 351272960, Type: bencode.IntegerType},
+							"length":       {Int: 524288, Type: bencode.IntegerType},
 							"name":         {Str: "debian-10.2.0-amd64-netinst.iso", Type: bencode.StringType},
 						},
 						Type: bencode.DictType,
@@ -48,14 +52,18 @@ func TestWithoutParse(t *testing.T) {
 				Announce:     "http://bttracker.debian.org:6969/announce",
 				CreatedBy:    "mktorrent 1.1",
 				CreationDate: 1731156219,
-				InfoHash:     [20]byte{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+				InfoHash:     [20]byte{210, 229, 189, 255, 135, 250, 44, 208, 221, 15, 87, 153, 60, 121, 168, 235, 54, 125, 23, 198},
 				PiecesHash: [][20]byte{
 					{49, 50, 51, 52, 53, 54, 55, 56, 57, 48, 97, 98, 99, 100, 101, 102, 103, 104, 105, 106},
 					{97, 98, 99, 100, 101, 102, 103, 104, 105, 106, 49, 50, 51, 52, 53, 54, 55, 56, 57, 48},
 				},
 				PieceLength: 262144,
-				Length:      351272960,
+				Length:      524288,
 				Name:        "debian-10.2.0-amd64-netinst.iso",
+				Files: []torrent.File{
+					{Path: []string{"debian-10.2.0-amd64-netinst.iso"}, Length: 524288, Offset: 0},
+				},
+				Info: []byte("d6:lengthi524288e4:name31:debian-10.2.0-amd64-netinst.iso12:piece lengthi262144e6:pieces40:1234567890abcdefghijabcdefghij1234567890e"),
 			},
 			fails: false,
 		},
@@ -73,3 +81,168 @@ func TestWithoutParse(t *testing.T) {
 		assert.Equal(t, test.output, to)
 	}
 }
+
+func multiFileInfo(files ...bencode.BencodeValue) bencode.BencodeValue {
+	return bencode.BencodeValue{
+		Dict: map[string]bencode.BencodeValue{
+			"announce": {Str: "http://tracker.example.com/announce", Type: bencode.StringType},
+			"info": {
+				Dict: map[string]bencode.BencodeValue{
+					"pieces":       {Str: strings.Repeat("1234567890abcdefghij", 3), Type: bencode.StringType},
+					"piece length": {Int: 16, Type: bencode.IntegerType},
+					"name":         {Str: "album", Type: bencode.StringType},
+					"files":        {List: files, Type: bencode.ListType},
+				},
+				Type: bencode.DictType,
+			},
+		},
+		Type: bencode.DictType,
+	}
+}
+
+// Replaces the name of the info dictionary
+func withName(input bencode.BencodeValue, name string) bencode.BencodeValue {
+	input.Dict["info"].Dict["name"] = bencode.BencodeValue{Str: name, Type: bencode.StringType}
+	return input
+}
+
+func fileEntry(length int64, path ...string) bencode.BencodeValue {
+	components := make([]bencode.BencodeValue, len(path))
+
+	for i, component := range path {
+		components[i] = bencode.BencodeValue{Str: component, Type: bencode.StringType}
+	}
+
+	return bencode.BencodeValue{
+		Dict: map[string]bencode.BencodeValue{
+			"length": {Int: length, Type: bencode.IntegerType},
+			"path":   {List: components, Type: bencode.ListType},
+		},
+		Type: bencode.DictType,
+	}
+}
+
+func TestMultiFileTorrent(t *testing.T) {
+	input := multiFileInfo(
+		fileEntry(10, "cover.jpg"),
+		fileEntry(0, "empty.txt"),
+		fileEntry(25, "disc 1", "track01.flac"),
+	)
+
+	to, err := torrent.BencodeToTorrentFile(input, torrent.BencodeToTorrentFileOpts{From: "test"})
+
+	require.NoError(t, err)
+	assert.Equal(t, int64(35), to.Length)
+	assert.Equal(t, []torrent.File{
+		{Path: []string{"album", "cover.jpg"}, Length: 10, Offset: 0},
+		{Path: []string{"album", "empty.txt"}, Length: 0, Offset: 10},
+		{Path: []string{"album", "disc 1", "track01.flac"}, Length: 25, Offset: 10},
+	}, to.Files)
+
+	// The first piece covers the whole first file and the beginning of the last one, the empty file holds no data
+	segments := to.FileSegments(to.CalculateBoundsForPiece(0))
+
+	assert.Equal(t, []torrent.FileSegment{
+		{Index: 0, File: to.Files[0], Offset: 0, Length: 10},
+		{Index: 2, File: to.Files[2], Offset: 0, Length: 6},
+	}, segments)
+
+	segments = to.FileSegments(to.CalculateBoundsForPiece(2))
+
+	assert.Equal(t, []torrent.FileSegment{
+		{Index: 2, File: to.Files[2], Offset: 22, Length: 3},
+	}, segments)
+}
+
+// A multi-file info dictionary whose second file is empty
+const emptyFileInfo = "d5:filesld6:lengthi10e4:pathl9:cover.jpgeed6:lengthi0e4:pathl9:empty.txteed6:lengthi25e4:pathl6:disc 1" +
+	"12:track01.flaceee4:name5:album12:piece lengthi16e6:pieces60:" +
+	"1234567890abcdefghij1234567890abcdefghij1234567890abcdefghije"
+
+func TestMultiFileTorrent_InfoHashCoversEmptyFiles(t *testing.T) {
+	info := emptyFileInfo
+
+	path := filepath.Join(t.TempDir(), "album.torrent")
+	require.NoError(t, os.WriteFile(path, []byte("d8:announce35:http://tracker.example.com/announce4:info"+info+"e"), 0o644))
+
+	to, err := torrent.NewTorrentFrom(path)
+	require.NoError(t, err)
+
+	require.Len(t, to.Files, 3)
+	assert.Equal(t, int64(0), to.Files[1].Length)
+	assert.Equal(t, "da02a4eff749e08b7af742014b90d5b10e2ac90f", hex.EncodeToString(to.InfoHash[:]))
+
+	// The metadata served to peers is the dictionary as read, it hashes to the info hash
+	assert.Equal(t, info, string(to.Info))
+}
+
+func TestMultiFileTorrentRejectsUnsafePaths(t *testing.T) {
+	tests := map[string]bencode.BencodeValue{
+		"parent directory": multiFileInfo(fileEntry(10, "..", "passwd")),
+		"separator":        multiFileInfo(fileEntry(10, "a/b")),
+		"empty component":  multiFileInfo(fileEntry(10, "")),
+		"empty path":       multiFileInfo(fileEntry(10)),
+		"negative length":  multiFileInfo(fileEntry(-1, "file")),
+		"no files":         multiFileInfo(),
+		"parent name":      withName(multiFileInfo(fileEntry(10, "file")), ".."),
+		"escaping name":    withName(multiFileInfo(fileEntry(10, "file")), "a/../../b"),
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := torrent.BencodeToTorrentFile(input, torrent.BencodeToTorrentFileOpts{From: "test"})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTorrentRejectsInvalidPieces(t *testing.T) {
+	// Replaces a field of the info dictionary, a zero value removes it
+	withInfo := func(key string, value bencode.BencodeValue) bencode.BencodeValue {
+		input := multiFileInfo(fileEntry(10, "cover.jpg"), fileEntry(25, "track01.flac"))
+
+		if value.Type == bencode.StringType && value.Str == "" {
+			delete(input.Dict["info"].Dict, key)
+		} else {
+			input.Dict["info"].Dict[key] = value
+		}
+
+		return input
+	}
+
+	_, err := torrent.BencodeToTorrentFile(withInfo("name", bencode.BencodeValue{Str: "album", Type: bencode.StringType}), torrent.BencodeToTorrentFileOpts{From: "test"})
+	require.NoError(t, err)
+
+	tests := map[string]bencode.BencodeValue{
+		"zero piece length":     withInfo("piece length", bencode.BencodeValue{Int: 0, Type: bencode.IntegerType}),
+		"negative piece length": withInfo("piece length", bencode.BencodeValue{Int: -16, Type: bencode.IntegerType}),
+		"huge piece length":     withInfo("piece length", bencode.BencodeValue{Int: 1 << 40, Type: bencode.IntegerType}),
+		"missing pieces":        withInfo("pieces", bencode.BencodeValue{Type: bencode.StringType}),
+		"too few hashes":        withInfo("pieces", bencode.BencodeValue{Str: strings.Repeat("1234567890abcdefghij", 2), Type: bencode.StringType}),
+		"too many hashes":       withInfo("pieces", bencode.BencodeValue{Str: strings.Repeat("1234567890abcdefghij", 4), Type: bencode.StringType}),
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := torrent.BencodeToTorrentFile(input, torrent.BencodeToTorrentFileOpts{From: "test"})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBencodeToTorrentFile_EncodesInfoWithEmptyValues(t *testing.T) {
+	info, err := bencode.Parse(strings.NewReader(emptyFileInfo))
+	require.NoError(t, err)
+
+	input := bencode.BencodeValue{Type: bencode.DictType, Dict: map[string]bencode.BencodeValue{
+		"announce": {Type: bencode.StringType, Str: "http://tracker.example.com/announce"},
+		"info":     info,
+	}}
+
+	// Without the bytes as read the parsed dictionary is encoded again, the zero length of the empty file included
+	to, err := torrent.BencodeToTorrentFile(input, torrent.BencodeToTorrentFileOpts{From: "test"})
+	require.NoError(t, err)
+
+	assert.Equal(t, emptyFileInfo, string(to.Info))
+	assert.Equal(t, "da02a4eff749e08b7af742014b90d5b10e2ac90f", hex.EncodeToString(to.InfoHash[:]))
+}
@@ -1,11 +1,19 @@
 package tests
 
 import (
+	"Torrent-Client/bencode"
 	torrent2 "Torrent-Client/torrent"
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +63,154 @@ func TestBuildTrackerUrl(t *testing.T) {
 	assert.Nil(t, err, "Failed to build tracker URL")
 	assert.Equal(t, expected, trackerURL, "Unexpected tracker URL")
 }
+
+func TestBencodeToTrackerResponse(t *testing.T) {
+	str := func(s string) bencode.BencodeValue { return bencode.BencodeValue{Type: bencode.StringType, Str: s} }
+	integer := func(i int64) bencode.BencodeValue { return bencode.BencodeValue{Type: bencode.IntegerType, Int: i} }
+	dict := func(entries map[string]bencode.BencodeValue) bencode.BencodeValue {
+		return bencode.BencodeValue{Type: bencode.DictType, Dict: entries}
+	}
+
+	t.Run("compact peers and counters", func(t *testing.T) {
+		response, err := torrent2.BencodeToTrackerResponse(dict(map[string]bencode.BencodeValue{
+			"interval":        integer(1800),
+			"min interval":    integer(60),
+			"complete":        integer(12),
+			"incomplete":      integer(3),
+			"tracker id":      str("abc"),
+			"warning message": str("slow down"),
+			"peers":           str("\x0a\x00\x00\x01\x1a\xe1"),
+		}), torrent2.BencodeToTrackerResponseOpts{})
+
+		require.NoError(t, err)
+		assert.Equal(t, 1800, response.Interval)
+		assert.Equal(t, 60, response.MinInterval)
+		assert.Equal(t, 12, response.Complete)
+		assert.Equal(t, 3, response.Incomplete)
+		assert.Equal(t, "abc", response.TrackerID)
+		assert.Equal(t, "slow down", response.Warning)
+		require.Len(t, response.Peers, 1)
+		assert.Equal(t, "10.0.0.1:6881", response.Peers[0].Address())
+	})
+
+	t.Run("dictionary peers", func(t *testing.T) {
+		response, err := torrent2.BencodeToTrackerResponse(dict(map[string]bencode.BencodeValue{
+			"interval": integer(1800),
+			"peers": {Type: bencode.ListType, List: []bencode.BencodeValue{
+				dict(map[string]bencode.BencodeValue{"ip": str("10.0.0.2"), "port": integer(51413), "peer id": str("-TR3000-abcdefghijkl")}),
+				dict(map[string]bencode.BencodeValue{"ip": str("2001:db8::1"), "port": integer(6881)}),
+				dict(map[string]bencode.BencodeValue{"ip": str("not an address"), "port": integer(6881)}),
+				dict(map[string]bencode.BencodeValue{"ip": str("10.0.0.3"), "port": integer(70000)}),
+			}},
+		}), torrent2.BencodeToTrackerResponseOpts{})
+
+		require.NoError(t, err)
+		require.Len(t, response.Peers, 2, "invalid entries are skipped")
+		assert.Equal(t, "10.0.0.2:51413", response.Peers[0].Address())
+		assert.Equal(t, "[2001:db8::1]:6881", response.Peers[1].Address())
+	})
+
+	t.Run("IPv6 peers", func(t *testing.T) {
+		response, err := torrent2.BencodeToTrackerResponse(dict(map[string]bencode.BencodeValue{
+			"interval": integer(1800),
+			"peers":    str("\x0a\x00\x00\x01\x1a\xe1"),
+			"peers6":   str("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"),
+		}), torrent2.BencodeToTrackerResponseOpts{})
+
+		require.NoError(t, err)
+		require.Len(t, response.Peers, 2)
+		assert.Equal(t, "10.0.0.1:6881", response.Peers[0].Address())
+		assert.Equal(t, "[2001:db8::1]:6881", response.Peers[1].Address())
+	})
+
+	t.Run("failure reason", func(t *testing.T) {
+		_, err := torrent2.BencodeToTrackerResponse(dict(map[string]bencode.BencodeValue{
+			"failure reason": str("unregistered torrent"),
+		}), torrent2.BencodeToTrackerResponseOpts{})
+
+		var failure *torrent2.TrackerFailure
+		require.ErrorAs(t, err, &failure)
+		assert.Equal(t, "unregistered torrent", failure.Reason)
+	})
+
+	t.Run("missing interval", func(t *testing.T) {
+		_, err := torrent2.BencodeToTrackerResponse(dict(map[string]bencode.BencodeValue{
+			"peers": str(""),
+		}), torrent2.BencodeToTrackerResponseOpts{})
+
+		assert.Error(t, err)
+	})
+}
+
+func TestHTTPTracker_SendsTrackerID(t *testing.T) {
+	trackerIDs := make(chan string, 2)
+
+	response := bencode.BencodeValue{Type: bencode.DictType, Dict: map[string]bencode.BencodeValue{
+		"interval":   {Type: bencode.IntegerType, Int: 1800},
+		"tracker id": {Type: bencode.StringType, Str: "session 42"},
+		"peers":      {Type: bencode.StringType, Str: ""},
+	}}
+
+	buffer := bytes.Buffer{}
+	require.NoError(t, response.Encode(&buffer))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackerIDs <- r.URL.Query().Get("trackerid")
+		w.Write(buffer.Bytes())
+	}))
+	defer server.Close()
+
+	tracker := torrent2.NewHTTPTracker(server.URL)
+	defer tracker.Close()
+
+	_, err := tracker.Announce(context.Background(), torrent2.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+	assert.Equal(t, "", <-trackerIDs)
+
+	_, err = tracker.Announce(context.Background(), torrent2.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+	assert.Equal(t, "session 42", <-trackerIDs)
+}
+
+func TestHTTPTracker_RejectsOversizedResponses(t *testing.T) {
+	bodies := []string{
+		// A string declared far larger than the body
+		"d8:intervali1800e5:peers9999999999999:e",
+		// A body past the size allowed for a response
+		"d8:intervali1800e5:peers4200000:" + strings.Repeat("a", 4200000) + "e",
+	}
+
+	for _, body := range bodies {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+
+		tracker := torrent2.NewHTTPTracker(server.URL)
+
+		_, err := tracker.Announce(context.Background(), torrent2.AnnounceRequest{Port: 6881})
+		assert.Error(t, err)
+
+		tracker.Close()
+		server.Close()
+	}
+}
+
+func TestBuildAnnounceUrl_AdvertisesIPv6(t *testing.T) {
+	announceUrl, err := torrent2.BuildAnnounceUrl("http://tracker.example.com/announce", torrent2.AnnounceRequest{
+		Port:  6881,
+		Event: torrent2.EventStarted,
+		IPv6:  net.ParseIP("2001:db8::10"),
+	})
+	require.NoError(t, err)
+
+	parsed, err := url.Parse(announceUrl)
+	require.NoError(t, err)
+
+	assert.Equal(t, "2001:db8::10", parsed.Query().Get("ipv6"))
+	assert.Equal(t, "started", parsed.Query().Get("event"))
+
+	// IPv4 addresses are never advertised as ipv6
+	announceUrl, err = torrent2.BuildAnnounceUrl("http://tracker.example.com/announce", torrent2.AnnounceRequest{IPv6: net.ParseIP("10.0.0.1")})
+	require.NoError(t, err)
+	assert.NotContains(t, announceUrl, "ipv6")
+}
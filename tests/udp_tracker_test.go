@@ -0,0 +1,346 @@
+package tests
+
+import (
+	"Torrent-Client/torrent"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is a local stand-in for a UDP tracker
+type fakeUDPTracker struct {
+	conn net.PacketConn
+
+	mutex     sync.Mutex
+	connects  int
+	announces []torrent.AnnounceRequest
+	fakeUDPTrackerConfig
+}
+
+// fakeUDPTrackerConfig says how the fake answers, it is set before the fake starts serving
+type fakeUDPTrackerConfig struct {
+	// drop is how many packets are ignored before answering
+	drop int
+	// staleFirst sends a response with a wrong transaction ID before each real one
+	staleFirst bool
+	// failure is sent back as an error action when set
+	failure string
+	peers   []byte
+}
+
+const fakeConnectionID uint64 = 0x1122334455667788
+
+func newFakeUDPTracker(t *testing.T, config fakeUDPTrackerConfig) *fakeUDPTracker {
+	return newFakeUDPTrackerOn(t, "udp4", "127.0.0.1:0", config)
+}
+
+func newFakeUDPTrackerOn(t *testing.T, network string, address string, config fakeUDPTrackerConfig) *fakeUDPTracker {
+	conn, err := net.ListenPacket(network, address)
+
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", address, err)
+	}
+
+	tracker := &fakeUDPTracker{conn: conn, fakeUDPTrackerConfig: config}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go tracker.serve()
+
+	return tracker
+}
+
+func (f *fakeUDPTracker) url() string {
+	return fmt.Sprintf("udp://%s/announce", f.conn.LocalAddr().String())
+}
+
+func (f *fakeUDPTracker) serve() {
+	buffer := make([]byte, 2048)
+
+	for {
+		n, addr, err := f.conn.ReadFrom(buffer)
+
+		if err != nil {
+			return
+		}
+
+		if response := f.handle(buffer[:n]); response != nil {
+			f.mutex.Lock()
+			stale := f.staleFirst
+			f.mutex.Unlock()
+
+			if stale {
+				bogus := append([]byte{}, response...)
+				binary.BigEndian.PutUint32(bogus[4:8], binary.BigEndian.Uint32(bogus[4:8])+1)
+				f.conn.WriteTo(bogus, addr)
+			}
+
+			f.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (f *fakeUDPTracker) handle(packet []byte) []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.drop > 0 {
+		f.drop--
+		return nil
+	}
+
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := binary.BigEndian.Uint32(packet[12:16])
+
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = binary.BigEndian.AppendUint32(response, transactionID)
+
+	if action == 0 {
+		f.connects++
+		return binary.BigEndian.AppendUint64(response, fakeConnectionID)
+	}
+
+	if binary.BigEndian.Uint64(packet[0:8]) != fakeConnectionID {
+		return nil
+	}
+
+	if f.failure != "" {
+		response = binary.BigEndian.AppendUint32(nil, 3)
+		response = binary.BigEndian.AppendUint32(response, transactionID)
+		return append(response, f.failure...)
+	}
+
+	switch action {
+	case 1:
+		request := torrent.AnnounceRequest{
+			InfoHash:   [20]byte(packet[16:36]),
+			PeerID:     [20]byte(packet[36:56]),
+			Downloaded: int64(binary.BigEndian.Uint64(packet[56:64])),
+			Left:       int64(binary.BigEndian.Uint64(packet[64:72])),
+			Uploaded:   int64(binary.BigEndian.Uint64(packet[72:80])),
+			Event:      torrent.AnnounceEvent(binary.BigEndian.Uint32(packet[80:84])),
+			Key:        binary.BigEndian.Uint32(packet[88:92]),
+			Port:       binary.BigEndian.Uint16(packet[96:98]),
+		}
+		f.announces = append(f.announces, request)
+
+		response = binary.BigEndian.AppendUint32(response, 1800) // interval
+		response = binary.BigEndian.AppendUint32(response, 3)    // leechers
+		response = binary.BigEndian.AppendUint32(response, 7)    // seeders
+		return append(response, f.peers...)
+	case 2:
+		for i := 16; i+20 <= len(packet); i += 20 {
+			response = binary.BigEndian.AppendUint32(response, 10)
+			response = binary.BigEndian.AppendUint32(response, 20)
+			response = binary.BigEndian.AppendUint32(response, 30)
+		}
+		return response
+	}
+
+	return nil
+}
+
+func newTestUDPTracker(t *testing.T, url string) *torrent.UDPTracker {
+	tracker, err := torrent.NewUDPTracker(url)
+	require.NoError(t, err)
+
+	tracker.Timeout = 50 * time.Millisecond
+	tracker.Retries = 3
+
+	t.Cleanup(func() { tracker.Close() })
+
+	return tracker
+}
+
+func TestUDPTracker_Announce(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{
+		peers: []byte{192, 168, 1, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2},
+	})
+
+	tracker := newTestUDPTracker(t, fake.url())
+
+	request := torrent.AnnounceRequest{
+		InfoHash:   [20]byte{1, 2, 3},
+		PeerID:     [20]byte{4, 5, 6},
+		Port:       6881,
+		Downloaded: 100,
+		Left:       200,
+		Uploaded:   50,
+		Event:      torrent.EventStarted,
+		Key:        42,
+	}
+
+	response, err := tracker.Announce(context.Background(), request)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1800, response.Interval)
+	assert.Equal(t, 7, response.Complete)
+	assert.Equal(t, 3, response.Incomplete)
+
+	require.Len(t, response.Peers, 2)
+	assert.Equal(t, "192.168.1.1:6881", response.Peers[0].Address())
+
+	// The connection ID is cached, the second announce does not connect again
+	_, err = tracker.Announce(context.Background(), request)
+	require.NoError(t, err)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	assert.Equal(t, 1, fake.connects)
+	require.Len(t, fake.announces, 2)
+	assert.Equal(t, request, fake.announces[0])
+}
+
+func TestUDPTracker_Retransmits(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{drop: 2})
+
+	tracker := newTestUDPTracker(t, fake.url())
+
+	_, err := tracker.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+}
+
+func TestUDPTracker_IgnoresUnexpectedTransactionID(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{staleFirst: true})
+
+	tracker := newTestUDPTracker(t, fake.url())
+
+	response, err := tracker.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+	assert.Equal(t, 1800, response.Interval)
+}
+
+func TestUDPTracker_Error(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{failure: "torrent not registered"})
+
+	tracker := newTestUDPTracker(t, fake.url())
+
+	_, err := tracker.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+
+	var trackerFailure *torrent.TrackerFailure
+	require.ErrorAs(t, err, &trackerFailure)
+	assert.Equal(t, "torrent not registered", trackerFailure.Reason)
+}
+
+func TestUDPTracker_Timeout(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{drop: 100})
+
+	tracker := newTestUDPTracker(t, fake.url())
+	tracker.Timeout = 10 * time.Millisecond
+	tracker.Retries = 1
+
+	_, err := tracker.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	assert.Error(t, err)
+}
+
+func TestUDPTracker_AnnounceCancelled(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{drop: 100})
+
+	tracker := newTestUDPTracker(t, fake.url())
+	tracker.Timeout = time.Second
+	tracker.Retries = 8
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := tracker.Announce(ctx, torrent.AnnounceRequest{Port: 6881})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestUDPTracker_CloseDuringAnnounce(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{drop: 100})
+
+	tracker := newTestUDPTracker(t, fake.url())
+	tracker.Timeout = time.Second
+	tracker.Retries = 8
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := tracker.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Close does not wait for the announce, which fails on the closed socket
+	closed := make(chan struct{})
+
+	go func() {
+		tracker.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close waited for the announce")
+	}
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("announce did not fail after close")
+	}
+}
+
+func TestUDPTracker_Scrape(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{})
+
+	tracker := newTestUDPTracker(t, fake.url())
+
+	results, err := tracker.Scrape(context.Background(), [20]byte{1}, [20]byte{2})
+	require.NoError(t, err)
+
+	assert.Equal(t, []torrent.ScrapeResult{
+		{Seeders: 10, Completed: 20, Leechers: 30},
+		{Seeders: 10, Completed: 20, Leechers: 30},
+	}, results)
+}
+
+func TestRequestPeers_SelectsTrackerByScheme(t *testing.T) {
+	fake := newFakeUDPTracker(t, fakeUDPTrackerConfig{peers: []byte{127, 0, 0, 1, 0x1a, 0xe1}})
+
+	to := torrent.TorrentFile{Announce: fake.url(), Length: 10}
+
+	peers, err := to.RequestPeers([20]byte{1}, 6881)
+	require.NoError(t, err)
+	require.Len(t, peers, 1)
+	assert.Equal(t, "127.0.0.1:6881", peers[0].Address())
+
+	_, err = torrent.NewTracker("wss://tracker.example.com/announce")
+	assert.Error(t, err)
+
+	tracker, err := torrent.NewTracker("https://tracker.example.com/announce")
+	require.NoError(t, err)
+	assert.IsType(t, &torrent.HTTPTracker{}, tracker)
+}
+
+func TestUDPTracker_AnnounceOverIPv6(t *testing.T) {
+	fake := newFakeUDPTrackerOn(t, "udp6", "[::1]:0", fakeUDPTrackerConfig{
+		peers: []byte{
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, 1, 0x1a, 0xe2,
+		},
+	})
+
+	tracker := newTestUDPTracker(t, fake.url())
+
+	response, err := tracker.Announce(context.Background(), torrent.AnnounceRequest{Port: 6881})
+	require.NoError(t, err)
+
+	require.Len(t, response.Peers, 2)
+	assert.Equal(t, "[2001:db8::1]:6881", response.Peers[0].Address())
+	assert.Equal(t, "10.0.0.1:6882", response.Peers[1].Address())
+}
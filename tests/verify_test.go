@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"Torrent-Client/client"
+	"Torrent-Client/torrent"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("ABCDEFGHIJKLMNOPQRST")
+
+	to := storageTorrent()
+	to.PiecesHash = [][20]byte{
+		sha1.Sum(content[0:8]),
+		sha1.Sum(content[8:16]),
+		sha1.Sum(content[16:20]),
+	}
+
+	// Nothing on disk yet
+	report, err := client.Verify(to, dir)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Valid)
+	assert.False(t, report.Complete())
+
+	_, err = os.Stat(filepath.Join(dir, "album"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "verify must not create files")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "album", "disc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "album", "a.txt"), content[0:5], 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "album", "disc", "b.txt"), []byte("FGHIJKLMNOPQRSx"), 0644))
+
+	report, err = client.Verify(to, dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Valid)
+	assert.True(t, report.Bitfield.HasPiece(0))
+	assert.True(t, report.Bitfield.HasPiece(1))
+	assert.False(t, report.Bitfield.HasPiece(2))
+
+	require.Len(t, report.Files, 3)
+
+	// a.txt only overlaps the first piece
+	assert.Equal(t, 1, report.Files[0].Pieces)
+	assert.True(t, report.Files[0].Complete())
+
+	// The empty file holds no piece, so it is always complete
+	assert.Equal(t, 0, report.Files[1].Pieces)
+	assert.True(t, report.Files[1].Complete())
+
+	// b.txt overlaps every piece and the last one is corrupted
+	assert.Equal(t, 3, report.Files[2].Pieces)
+	assert.Equal(t, 2, report.Files[2].CompletePieces)
+	assert.False(t, report.Files[2].Complete())
+}
+
+func TestVerify_ShortFile(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("ABCDEFGHIJKLMNOPQRST")
+
+	to := &torrent.TorrentFile{
+		Name:        "single",
+		PieceLength: 8,
+		Length:      20,
+		PiecesHash:  [][20]byte{sha1.Sum(content[0:8]), sha1.Sum(content[8:16]), sha1.Sum(content[16:20])},
+		Files:       []torrent.File{{Path: []string{"single"}, Length: 20}},
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "single"), content[:12], 0644))
+
+	report, err := client.Verify(to, dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Valid)
+	assert.True(t, report.Bitfield.HasPiece(0))
+	assert.InDelta(t, 33.33, report.Files[0].Percent(), 0.01)
+}
@@ -0,0 +1,359 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Used when the trackers do not ask for an interval, it is also the longest wait between retries
+const defaultAnnounceInterval = 30 * time.Minute
+
+// First wait after a failed announce, doubled on every consecutive failure
+const announceRetryInterval = 15 * time.Second
+
+// How long the stopped announce may delay the shutdown
+const stoppedAnnounceTimeout = 5 * time.Second
+
+// Announcer announces to the tiers of trackers of a torrent (BEP 12)
+// Trackers are shuffled inside their tier, tried in order and the first one answering is moved to the front of its tier
+// Every tier is announced to, in parallel, and the peers they return are merged
+type Announcer struct {
+	mutex    sync.Mutex
+	tiers    [][]string
+	trackers map[string]Tracker
+
+	completed    chan struct{}
+	completeOnce sync.Once
+}
+
+// TransferStats are the counters reported to the trackers on every announce
+type TransferStats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// AnnounceResult merges the responses of the trackers that answered
+// Interval is the shortest interval asked by those trackers and MinInterval the longest minimum they impose
+type AnnounceResult struct {
+	Peers       []Peer
+	Interval    time.Duration
+	MinInterval time.Duration
+	Trackers    int
+}
+
+func NewAnnouncer(tiers [][]string) *Announcer {
+
+	announcer := &Announcer{
+		tiers:     make([][]string, len(tiers)),
+		trackers:  make(map[string]Tracker),
+		completed: make(chan struct{}),
+	}
+
+	for i, tier := range tiers {
+		shuffled := append([]string{}, tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		announcer.tiers[i] = shuffled
+	}
+
+	return announcer
+}
+
+// Tiers returns the current order of the trackers in each tier
+func (a *Announcer) Tiers() [][]string {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	tiers := make([][]string, len(a.tiers))
+
+	for i, tier := range a.tiers {
+		tiers[i] = append([]string{}, tier...)
+	}
+
+	return tiers
+}
+
+// Announce sends the request to one tracker of every tier and merges the peers they return
+// It only fails when no tracker of any tier answered, the trackers are given up once the context is done
+func (a *Announcer) Announce(ctx context.Context, request AnnounceRequest) (AnnounceResult, error) {
+
+	if len(a.tiers) == 0 {
+		return AnnounceResult{}, fmt.Errorf("no trackers to announce to")
+	}
+
+	responses := make([]*TrackerResponse, len(a.tiers))
+	waitGroup := sync.WaitGroup{}
+
+	for i := range a.tiers {
+		waitGroup.Add(1)
+
+		go func(tier int) {
+			defer waitGroup.Done()
+			responses[tier] = a.announceTier(ctx, tier, request)
+		}(i)
+	}
+
+	waitGroup.Wait()
+
+	result := AnnounceResult{}
+	seen := make(map[string]bool)
+
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+
+		result.Trackers++
+
+		interval := time.Duration(response.Interval) * time.Second
+
+		if result.Interval == 0 || (interval > 0 && interval < result.Interval) {
+			result.Interval = interval
+		}
+
+		result.MinInterval = max(result.MinInterval, time.Duration(response.MinInterval)*time.Second)
+
+		for _, peer := range response.Peers {
+			if !seen[peer.Address()] {
+				seen[peer.Address()] = true
+				result.Peers = append(result.Peers, peer)
+			}
+		}
+	}
+
+	if result.Trackers == 0 {
+		log.Error().Msg("no tracker answered the announce")
+		return result, fmt.Errorf("no tracker answered the announce")
+	}
+
+	log.Debug().Int("trackers", result.Trackers).Int("peers", len(result.Peers)).Msg("announced to trackers")
+
+	return result, nil
+}
+
+// Complete tells the running loop that the last piece was verified, the completed event is sent right away
+func (a *Announcer) Complete() {
+	a.completeOnce.Do(func() {
+		close(a.completed)
+	})
+}
+
+func (a *Announcer) isComplete() bool {
+	select {
+	case <-a.completed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run announces until the context is cancelled
+// The first announce carries the started event, the following ones are sent at the interval asked by the trackers,
+// never sooner than their min interval, with the counters returned by stats
+// The completed event is sent once Complete is called and the stopped event on shutdown
+// Failed announces are retried with a growing delay, keeping their event
+// Peers returned by the trackers are sent to the peers channel
+func (a *Announcer) Run(ctx context.Context, request AnnounceRequest, stats func() TransferStats, peers chan<- []Peer) {
+
+	event := EventStarted
+	wait := time.Duration(0)
+	retry := announceRetryInterval
+	completed := a.completed
+	started := false
+	completedSent := false
+
+	for {
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			a.stop(request, stats, started, !completedSent && a.isComplete())
+			return
+		case <-completed:
+			timer.Stop()
+			completed = nil
+
+			// Trackers that never saw us started learn we are seeding from the left counter
+			if started {
+				event = EventCompleted
+			}
+		case <-timer.C:
+		}
+
+		result, err := a.Announce(ctx, withStats(request, event, stats))
+
+		if err != nil {
+			log.Warn().Err(err).Str("event", event.String()).Dur("retry", retry).Msg("announce failed")
+			wait = retry
+			retry = min(retry*2, defaultAnnounceInterval)
+			continue
+		}
+
+		switch event {
+		case EventStarted:
+			started = true
+		case EventCompleted:
+			completedSent = true
+		}
+
+		event = EventNone
+		retry = announceRetryInterval
+		wait = result.Interval
+
+		if wait <= 0 {
+			wait = defaultAnnounceInterval
+		}
+
+		wait = max(wait, result.MinInterval)
+
+		log.Debug().Int("peers", len(result.Peers)).Dur("next", wait).Msg("announce succeeded")
+
+		if len(result.Peers) > 0 && peers != nil {
+			select {
+			case peers <- result.Peers:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// Sends the events owed to the trackers before shutting down, giving up after a short timeout
+func (a *Announcer) stop(request AnnounceRequest, stats func() TransferStats, started bool, completedPending bool) {
+
+	if !started {
+		return
+	}
+
+	// The context of the run is already done, the trackers get a fresh one bounded by the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+
+	if completedPending {
+		if _, err := a.Announce(ctx, withStats(request, EventCompleted, stats)); err != nil {
+			log.Warn().Err(err).Msg("failed to announce completed")
+		}
+	}
+
+	if _, err := a.Announce(ctx, withStats(request, EventStopped, stats)); err != nil {
+		log.Warn().Err(err).Msg("failed to announce stopped")
+	}
+
+	if ctx.Err() != nil {
+		log.Warn().Msg("trackers did not answer the stopped announce in time")
+	}
+}
+
+func withStats(request AnnounceRequest, event AnnounceEvent, stats func() TransferStats) AnnounceRequest {
+
+	request.Event = event
+
+	if stats != nil {
+		current := stats()
+		request.Uploaded = current.Uploaded
+		request.Downloaded = current.Downloaded
+		request.Left = current.Left
+	}
+
+	return request
+}
+
+// Tries the trackers of the tier in order, the first one answering is promoted to the front of the tier
+func (a *Announcer) announceTier(ctx context.Context, tier int, request AnnounceRequest) *TrackerResponse {
+
+	for _, announce := range a.tierTrackers(tier) {
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		tracker, err := a.tracker(announce)
+
+		if err != nil {
+			continue
+		}
+
+		response, err := tracker.Announce(ctx, request)
+
+		if err != nil {
+			log.Warn().Err(err).Str("announce", announce).Msg("tracker failed, trying the next one")
+			continue
+		}
+
+		a.promote(tier, announce)
+
+		return &response
+	}
+
+	return nil
+}
+
+func (a *Announcer) tierTrackers(tier int) []string {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return append([]string{}, a.tiers[tier]...)
+}
+
+// Moves the tracker to the front of its tier, keeping the order of the others
+func (a *Announcer) promote(tier int, announce string) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	trackers := a.tiers[tier]
+
+	for i, tracker := range trackers {
+		if tracker == announce {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = announce
+			return
+		}
+	}
+}
+
+// Returns the client of the tracker, creating it on first use so UDP connection IDs are reused
+func (a *Announcer) tracker(announce string) (Tracker, error) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if tracker, ok := a.trackers[announce]; ok {
+		return tracker, nil
+	}
+
+	tracker, err := NewTracker(announce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.trackers[announce] = tracker
+
+	return tracker, nil
+}
+
+// Close releases the clients of every tracker
+func (a *Announcer) Close() error {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var result error
+
+	for announce, tracker := range a.trackers {
+		if err := tracker.Close(); err != nil && result == nil {
+			result = err
+		}
+
+		delete(a.trackers, announce)
+	}
+
+	return result
+}
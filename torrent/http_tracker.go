@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"Torrent-Client/bencode"
+	"context"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// Responses hold a few counters and a peer list, a body larger than this is cut short and fails to parse
+const maxHTTPResponseSize = 2 * 1024 * 1024
+
+// HTTPTracker announces to a tracker over HTTP, the response is a bencoded dictionary
+// The tracker id handed out by the tracker is kept and sent back on the next announces
+type HTTPTracker struct {
+	announce string
+	client   *http.Client
+
+	mutex     sync.Mutex
+	trackerID string
+}
+
+func NewHTTPTracker(announce string) *HTTPTracker {
+	return &HTTPTracker{
+		announce: announce,
+		client:   &http.Client{Timeout: defaultTrackerTimeout},
+	}
+}
+
+func (t *HTTPTracker) URL() string {
+	return t.announce
+}
+
+func (t *HTTPTracker) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// BuildAnnounceUrl adds the announce parameters to the query of the tracker URL
+func BuildAnnounceUrl(announce string, request AnnounceRequest) (string, error) {
+
+	log.Debug().Msg("building tracker URL")
+
+	base, err := url.Parse(announce)
+
+	if err != nil {
+		log.Error().Err(err).Str("announce", announce).Msg("failed to parse announce URL")
+		return "", err
+	}
+
+	params := url.Values{
+
+		// The tracker will use this to figure out which peers to show us
+		// The info hash is a SHA1 hash of the bencoded info key from the metainfo file
+		"info_hash": []string{string(request.InfoHash[:])},
+
+		// The peer ID is a 20-byte string used as a unique ID for the client
+		// This is used to identify the client to the tracker
+		"peer_id": []string{string(request.PeerID[:])},
+
+		"port":       []string{strconv.Itoa(int(request.Port))},
+		"uploaded":   []string{strconv.FormatInt(request.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(request.Downloaded, 10)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.FormatInt(request.Left, 10)},
+	}
+
+	if request.Event != EventNone {
+		params.Set("event", request.Event.String())
+	}
+
+	if request.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(int(request.NumWant)))
+	}
+
+	if request.IPv6 != nil && request.IPv6.To4() == nil {
+		params.Set("ipv6", request.IPv6.String())
+	}
+
+	if request.Key != 0 {
+		params.Set("key", strconv.FormatUint(uint64(request.Key), 16))
+	}
+
+	base.RawQuery = params.Encode()
+
+	log.Debug().Str("url", base.String()).Msg("tracker URL")
+
+	return base.String(), nil
+}
+
+// Announce sends an HTTP GET request to the tracker and decodes the bencoded response
+func (t *HTTPTracker) Announce(ctx context.Context, request AnnounceRequest) (TrackerResponse, error) {
+
+	announceUrl, err := BuildAnnounceUrl(t.announce, request)
+
+	if err != nil {
+		log.Error().Err(err).Msg("could not build tracker URL to request peers")
+		return TrackerResponse{}, err
+	}
+
+	t.mutex.Lock()
+	trackerID := t.trackerID
+	t.mutex.Unlock()
+
+	if trackerID != "" {
+		announceUrl += "&trackerid=" + url.QueryEscape(trackerID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announceUrl, nil)
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create tracker request")
+		return TrackerResponse{}, err
+	}
+
+	resp, err := t.client.Do(req)
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to send GET request to tracker")
+		return TrackerResponse{}, err
+	}
+
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to close response body")
+		}
+	}(resp.Body)
+
+	result, err := bencode.Parse(io.LimitReader(resp.Body, maxHTTPResponseSize))
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to parse tracker response")
+		return TrackerResponse{}, err
+	}
+
+	trackerResponse, err := BencodeToTrackerResponse(result, BencodeToTrackerResponseOpts{from: announceUrl})
+
+	if err != nil {
+		log.Error().Err(err).Msg("failed to convert tracker response")
+		return TrackerResponse{}, err
+	}
+
+	if trackerResponse.TrackerID != "" {
+		t.mutex.Lock()
+		t.trackerID = trackerResponse.TrackerID
+		t.mutex.Unlock()
+	}
+
+	return trackerResponse, nil
+}
@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"Torrent-Client/bencode"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet links name a torrent by its info hash (BEP 9), the info dictionary is fetched from the peers
+// The info hash is given by the xt parameter as urn:btih: followed by 40 hex or 32 base32 characters
+const btihPrefix = "urn:btih:"
+
+// Magnet is a parsed magnet link
+type Magnet struct {
+	InfoHash [20]byte
+	// Name is the display name of the torrent (dn), empty when missing
+	Name string
+	// Trackers are the tracker URLs of the link (tr)
+	Trackers []string
+	// Peers are the addresses of peers that have the torrent (x.pe)
+	Peers []Peer
+}
+
+// IsMagnet tells whether the string looks like a magnet link rather than a path
+func IsMagnet(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), "magnet:")
+}
+
+// ParseMagnet parses a magnet link, it must carry a BitTorrent info hash
+// Peers given by host name are skipped, only IP addresses are kept
+func ParseMagnet(uri string) (Magnet, error) {
+
+	base, err := url.Parse(uri)
+
+	if err != nil {
+		log.Error().Err(err).Str("magnet", uri).Msg("failed to parse magnet link")
+		return Magnet{}, err
+	}
+
+	if base.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("not a magnet link %q", uri)
+	}
+
+	query, err := url.ParseQuery(base.RawQuery)
+
+	if err != nil {
+		log.Error().Err(err).Str("magnet", uri).Msg("failed to parse magnet parameters")
+		return Magnet{}, err
+	}
+
+	magnet := Magnet{Name: query.Get("dn")}
+	found := false
+
+	for _, topic := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(topic), btihPrefix) {
+			continue
+		}
+
+		magnet.InfoHash, err = decodeInfoHash(topic[len(btihPrefix):])
+
+		if err != nil {
+			log.Error().Err(err).Str("magnet", uri).Msg("invalid info hash")
+			return Magnet{}, err
+		}
+
+		found = true
+		break
+	}
+
+	if !found {
+		return Magnet{}, fmt.Errorf("magnet link without btih info hash")
+	}
+
+	seen := make(map[string]bool)
+
+	for _, tracker := range query["tr"] {
+		if tracker != "" && !seen[tracker] {
+			seen[tracker] = true
+			magnet.Trackers = append(magnet.Trackers, tracker)
+		}
+	}
+
+	for _, address := range query["x.pe"] {
+		peer, err := parsePeerAddress(address)
+
+		if err != nil {
+			log.Debug().Err(err).Str("peer", address).Msg("skipping magnet peer")
+			continue
+		}
+
+		magnet.Peers = append(magnet.Peers, peer)
+	}
+
+	return magnet, nil
+}
+
+// Decodes an info hash given as 40 hex characters or 32 base32 characters
+func decodeInfoHash(encoded string) ([20]byte, error) {
+
+	var infoHash [20]byte
+	var decoded []byte
+	var err error
+
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("info hash has %d characters, expected 40 or 32", len(encoded))
+	}
+
+	if err != nil {
+		return infoHash, err
+	}
+
+	copy(infoHash[:], decoded)
+
+	return infoHash, nil
+}
+
+// Parses an ip:port or [ipv6]:port peer address
+func parsePeerAddress(address string) (Peer, error) {
+
+	host, port, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return Peer{}, err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return Peer{}, fmt.Errorf("peer host %q is not an IP address", host)
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil || number == 0 {
+		return Peer{}, fmt.Errorf("invalid peer port %q", port)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return Peer{IP: ip, Port: uint16(number)}, nil
+}
+
+// AnnounceTiers returns the trackers of the link, they have no tiers so each one is a tier of its own
+func (m *Magnet) AnnounceTiers() [][]string {
+
+	tiers := make([][]string, 0, len(m.Trackers))
+
+	for _, tracker := range m.Trackers {
+		tiers = append(tiers, []string{tracker})
+	}
+
+	return tiers
+}
+
+// NewTorrentFromMetadata builds the torrent of the magnet link from the info dictionary fetched from the peers
+// The metadata must hash to the info hash of the link, the trackers of the link are announced to
+func NewTorrentFromMetadata(metadata []byte, magnet Magnet) (TorrentFile, error) {
+
+	if sha1.Sum(metadata) != magnet.InfoHash {
+		log.Error().Str("magnet", magnet.Name).Msg("metadata does not match the info hash")
+		return TorrentFile{}, fmt.Errorf("metadata does not match the info hash")
+	}
+
+	info, err := bencode.Parse(bytes.NewReader(metadata))
+
+	if err != nil {
+		log.Error().Err(err).Str("magnet", magnet.Name).Msg("failed to parse metadata")
+		return TorrentFile{}, err
+	}
+
+	if info.Type != bencode.DictType {
+		log.Error().Str("magnet", magnet.Name).Msg("info is not a dictionary")
+		return TorrentFile{}, fmt.Errorf("info is not a dictionary")
+	}
+
+	torrent, err := decodeInfo(info, BencodeToTorrentFileOpts{From: "magnet:" + hex.EncodeToString(magnet.InfoHash[:]), RawInfo: metadata})
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	torrent.AnnounceList = magnet.AnnounceTiers()
+
+	if len(magnet.Trackers) > 0 {
+		torrent.Announce = magnet.Trackers[0]
+	}
+
+	return torrent, nil
+}
@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const peerSize = 6
+
+// Compact IPv6 peers hold 16 bytes for the address and 2 for the port (BEP 7)
+const peer6Size = 18
+
+type Peer struct {
+	IP   net.IP
+	Port uint16
+}
+
+func DecodePeers(bytes []byte) ([]Peer, error) {
+
+	if len(bytes) == 0 {
+		return nil, fmt.Errorf("received empty peers")
+	}
+
+	numPeers := len(bytes) / peerSize
+
+	if len(bytes)%peerSize != 0 {
+		return nil, fmt.Errorf("received malformed peers")
+	}
+
+	peers := make([]Peer, numPeers)
+
+	for i := 0; i < numPeers; i++ {
+		offset := i * peerSize
+		peers[i] = Peer{
+			IP:   net.IP(bytes[offset : offset+4]),
+			Port: binary.BigEndian.Uint16(bytes[offset+4 : offset+6]),
+		}
+	}
+
+	return peers, nil
+}
+
+// DecodePeers6 decodes a compact list of IPv6 peers, as found in the peers6 key of tracker responses
+// IPv4-mapped addresses are turned back into their 4 byte form
+func DecodePeers6(bytes []byte) ([]Peer, error) {
+
+	if len(bytes) == 0 {
+		return nil, fmt.Errorf("received empty peers")
+	}
+
+	if len(bytes)%peer6Size != 0 {
+		return nil, fmt.Errorf("received malformed peers")
+	}
+
+	numPeers := len(bytes) / peer6Size
+	peers := make([]Peer, numPeers)
+
+	for i := 0; i < numPeers; i++ {
+		offset := i * peer6Size
+		ip := net.IP(bytes[offset : offset+16])
+
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+
+		peers[i] = Peer{
+			IP:   ip,
+			Port: binary.BigEndian.Uint16(bytes[offset+16 : offset+18]),
+		}
+	}
+
+	return peers, nil
+}
+
+// Network returns the network to dial the peer on, tcp4 or tcp6 depending on its address
+func (p Peer) Network() string {
+
+	if p.IP.To4() != nil {
+		return "tcp4"
+	}
+
+	return "tcp6"
+}
+
+func (p Peer) Address() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
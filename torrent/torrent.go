@@ -8,12 +8,19 @@ import (
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// Longest piece accepted, pieces are held in memory while they are downloaded and verified
+const maxPieceLength = 128 * 1024 * 1024
+
 type TorrentFile struct {
 	Name         string
 	Announce     string
+	AnnounceList [][]string
 	Comment      string
 	CreatedBy    string
 	CreationDate int64
@@ -21,10 +28,36 @@ type TorrentFile struct {
 	PiecesHash   [][20]byte
 	PieceLength  int64
 	Length       int64
+	Files        []File
+
+	// Info is the bencoded info dictionary, its SHA-1 is the info hash
+	Info []byte
+}
+
+// File is a single file of the torrent
+// Path holds the path components relative to the output directory, starting with the torrent name
+// Single file torrents have one file whose path is just the torrent name
+// Offset is where the file begins in the stream made by concatenating every piece
+type File struct {
+	Path   []string
+	Length int64
+	Offset int64
+}
+
+// FileSegment is the part of a file covered by a range of the piece stream
+// Index is the position of the file in Files and Offset is relative to the beginning of the file
+type FileSegment struct {
+	Index  int
+	File   File
+	Offset int64
+	Length int64
 }
 
 type BencodeToTorrentFileOpts struct {
 	From string
+	// RawInfo is the info dictionary as read, its SHA-1 is the info hash and it is the metadata served to peers
+	// Without it the parsed dictionary is encoded again, which need not reproduce the bytes the torrent was hashed from
+	RawInfo []byte
 }
 
 func NewTorrentFrom(path string) (TorrentFile, error) {
@@ -49,7 +82,10 @@ func NewTorrentFrom(path string) (TorrentFile, error) {
 		return TorrentFile{}, err
 	}
 
-	return BencodeToTorrentFile(result, BencodeToTorrentFileOpts{From: path})
+	// A missing info dictionary is reported by the conversion
+	rawInfo, _ := bencode.DictValueBytes(data, "info")
+
+	return BencodeToTorrentFile(result, BencodeToTorrentFileOpts{From: path, RawInfo: rawInfo})
 }
 
 func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFileOpts) (TorrentFile, error) {
@@ -59,12 +95,21 @@ func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFile
 		return TorrentFile{}, fmt.Errorf("expected DictType, got %v", result.Type)
 	}
 
-	// Check the announce URL
+	// Check the announce list, it takes precedence over the announce URL when present
+	announceList, err := decodeAnnounceList(result, opts)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	// Check the announce URL, it is only optional when there is an announce list
 	announce, ok := result.Dict["announce"]
 
-	if !ok {
+	if !ok && len(announceList) == 0 {
 		log.Error().Str("from", opts.From).Msg("missing announce URL")
 		return TorrentFile{}, fmt.Errorf("missing announce URL")
+	} else if !ok {
+		log.Debug().Str("from", opts.From).Msg("missing announce URL, using announce list")
 	} else if announce.Type != bencode.StringType {
 		log.Error().Str("from", opts.From).Msg("announce URL is not a string")
 		return TorrentFile{}, fmt.Errorf("announce URL is not a string")
@@ -120,6 +165,24 @@ func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFile
 		log.Debug().Str("from", opts.From).Msg("info dictionary")
 	}
 
+	torrent, err := decodeInfo(info, opts)
+
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	torrent.Announce = announce.Str
+	torrent.AnnounceList = announceList
+	torrent.Comment = comment.Str
+	torrent.CreatedBy = createdBy.Str
+	torrent.CreationDate = creationDate.Int
+
+	return torrent, nil
+}
+
+// Decodes the info dictionary, the part of the metadata the info hash covers
+func decodeInfo(info bencode.BencodeValue, opts BencodeToTorrentFileOpts) (TorrentFile, error) {
+
 	// Check the name field in the info dictionary
 	name, ok := info.Dict["name"]
 
@@ -129,19 +192,25 @@ func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFile
 	} else if name.Type != bencode.StringType {
 		log.Error().Str("from", opts.From).Msg("name is not a string")
 		return TorrentFile{}, fmt.Errorf("name is not a string")
+	} else if !isSafePathComponent(name.Str) {
+		// The name is the file or the directory the content is written to, and names the resume file
+		log.Error().Str("from", opts.From).Str("name", name.Str).Msg("invalid name")
+		return TorrentFile{}, fmt.Errorf("invalid name %q", name.Str)
 	} else {
 		log.Debug().Str("from", opts.From).Str("name", name.Str).Msg("name")
 	}
 
-	length, ok := info.Dict["length"]
+	// Multi file torrents have a files list instead of a length
+	files, err := decodeFiles(info, name.Str, opts)
 
-	if !ok {
-		log.Error().Str("from", opts.From).Msg("missing length")
-	} else if length.Type != bencode.IntegerType {
-		log.Error().Str("from", opts.From).Msg("length is not an integer")
-		return TorrentFile{}, fmt.Errorf("length is not an integer")
-	} else {
-		log.Debug().Str("from", opts.From).Int64("length", length.Int).Msg("length")
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	totalLength := int64(0)
+
+	for _, file := range files {
+		totalLength += file.Length
 	}
 
 	// Check the piece length
@@ -153,6 +222,9 @@ func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFile
 	} else if pieceLength.Type != bencode.IntegerType {
 		log.Error().Str("from", opts.From).Msg("piece length is not an integer")
 		return TorrentFile{}, fmt.Errorf("piece length is not an integer")
+	} else if pieceLength.Int <= 0 || pieceLength.Int > maxPieceLength {
+		log.Error().Str("from", opts.From).Int64("piece length", pieceLength.Int).Msg("invalid piece length")
+		return TorrentFile{}, fmt.Errorf("invalid piece length %d", pieceLength.Int)
 	} else {
 		log.Debug().Str("from", opts.From).Int64("piece length", pieceLength.Int).Msg("piece length")
 	}
@@ -162,6 +234,7 @@ func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFile
 
 	if !ok {
 		log.Error().Str("from", opts.From).Msg("missing pieces")
+		return TorrentFile{}, fmt.Errorf("missing pieces")
 	} else if pieces.Type != bencode.StringType {
 		log.Error().Str("from", opts.From).Msg("pieces is not a string")
 		return TorrentFile{}, fmt.Errorf("pieces is not a string")
@@ -176,29 +249,192 @@ func BencodeToTorrentFile(result bencode.BencodeValue, opts BencodeToTorrentFile
 		return TorrentFile{}, err
 	}
 
-	infoHash, err := hashInfo(info)
+	// Every piece has a hash, the last one may be shorter than the piece length
+	expectedPieces := (totalLength + pieceLength.Int - 1) / pieceLength.Int
 
-	if err != nil {
-		log.Error().Err(err).Str("from", opts.From).Msg("failed to hash info")
-		return TorrentFile{}, err
+	if int64(len(piecesHashes)) != expectedPieces {
+		log.Error().Str("from", opts.From).Int("hashes", len(piecesHashes)).Int64("pieces", expectedPieces).Msg("pieces do not match the length")
+		return TorrentFile{}, fmt.Errorf("%d piece hashes for %d pieces", len(piecesHashes), expectedPieces)
+	}
+
+	// Peers fetching the metadata check it against the info hash, they get the bytes that were hashed
+	encoded := opts.RawInfo
+
+	if len(encoded) == 0 {
+		encoded, err = encodeInfo(info)
+
+		if err != nil {
+			log.Error().Err(err).Str("from", opts.From).Msg("failed to hash info")
+			return TorrentFile{}, err
+		}
 	}
 
 	torrent := TorrentFile{
-		Name:         name.Str,
-		Announce:     announce.Str,
-		Comment:      comment.Str,
-		CreatedBy:    createdBy.Str,
-		CreationDate: creationDate.Int,
-		PieceLength:  pieceLength.Int,
-		Length:       length.Int,
-		PiecesHash:   piecesHashes,
-		InfoHash:     infoHash,
+		Name:        name.Str,
+		PieceLength: pieceLength.Int,
+		Length:      totalLength,
+		PiecesHash:  piecesHashes,
+		InfoHash:    sha1.Sum(encoded),
+		Files:       files,
+		Info:        encoded,
 	}
 
 	return torrent, nil
 }
 
-func hashInfo(info bencode.BencodeValue) ([20]byte, error) {
+// Decodes the tiers of trackers of the announce list (BEP 12)
+// Invalid entries are skipped rather than rejecting the whole torrent, empty tiers are dropped
+func decodeAnnounceList(result bencode.BencodeValue, opts BencodeToTorrentFileOpts) ([][]string, error) {
+
+	announceList, ok := result.Dict["announce-list"]
+
+	if !ok {
+		log.Debug().Str("from", opts.From).Msg("missing announce list")
+		return nil, nil
+	}
+
+	if announceList.Type != bencode.ListType {
+		log.Error().Str("from", opts.From).Msg("announce list is not a list")
+		return nil, fmt.Errorf("announce list is not a list")
+	}
+
+	tiers := make([][]string, 0, len(announceList.List))
+
+	for _, tier := range announceList.List {
+
+		if tier.Type != bencode.ListType {
+			log.Warn().Str("from", opts.From).Msg("announce list tier is not a list")
+			continue
+		}
+
+		trackers := make([]string, 0, len(tier.List))
+
+		for _, tracker := range tier.List {
+			if tracker.Type != bencode.StringType || tracker.Str == "" {
+				log.Warn().Str("from", opts.From).Msg("announce list tracker is not a string")
+				continue
+			}
+
+			trackers = append(trackers, tracker.Str)
+		}
+
+		if len(trackers) > 0 {
+			tiers = append(tiers, trackers)
+		}
+	}
+
+	log.Debug().Str("from", opts.From).Int("tiers", len(tiers)).Msg("announce list")
+
+	return tiers, nil
+}
+
+// AnnounceTiers returns the tiers of trackers to announce to
+// The announce list is used when present, otherwise the announce URL makes a single tier
+func (t *TorrentFile) AnnounceTiers() [][]string {
+
+	if len(t.AnnounceList) > 0 {
+		tiers := make([][]string, len(t.AnnounceList))
+
+		for i, tier := range t.AnnounceList {
+			tiers[i] = append([]string{}, tier...)
+		}
+
+		return tiers
+	}
+
+	if t.Announce != "" {
+		return [][]string{{t.Announce}}
+	}
+
+	return nil
+}
+
+// Decodes the files of the info dictionary
+// Single file torrents carry a length, multi file torrents a list of files with length and path
+func decodeFiles(info bencode.BencodeValue, name string, opts BencodeToTorrentFileOpts) ([]File, error) {
+
+	filesList, ok := info.Dict["files"]
+
+	if !ok {
+		length, ok := info.Dict["length"]
+
+		if !ok {
+			log.Error().Str("from", opts.From).Msg("missing length")
+			return nil, fmt.Errorf("missing length")
+		} else if length.Type != bencode.IntegerType {
+			log.Error().Str("from", opts.From).Msg("length is not an integer")
+			return nil, fmt.Errorf("length is not an integer")
+		} else if length.Int < 0 {
+			log.Error().Str("from", opts.From).Int64("length", length.Int).Msg("negative length")
+			return nil, fmt.Errorf("negative length")
+		} else {
+			log.Debug().Str("from", opts.From).Int64("length", length.Int).Msg("length")
+		}
+
+		return []File{{Path: []string{name}, Length: length.Int}}, nil
+	}
+
+	if filesList.Type != bencode.ListType {
+		log.Error().Str("from", opts.From).Msg("files is not a list")
+		return nil, fmt.Errorf("files is not a list")
+	}
+
+	if len(filesList.List) == 0 {
+		log.Error().Str("from", opts.From).Msg("files is empty")
+		return nil, fmt.Errorf("files is empty")
+	}
+
+	files := make([]File, 0, len(filesList.List))
+	offset := int64(0)
+
+	for i, entry := range filesList.List {
+
+		if entry.Type != bencode.DictType {
+			log.Error().Str("from", opts.From).Int("file", i).Msg("file is not a dictionary")
+			return nil, fmt.Errorf("file %d is not a dictionary", i)
+		}
+
+		length, ok := entry.Dict["length"]
+
+		// The lengths add up to the offsets, they must not overflow
+		if !ok || length.Type != bencode.IntegerType || length.Int < 0 || length.Int > math.MaxInt64-offset {
+			log.Error().Str("from", opts.From).Int("file", i).Msg("file length is missing or invalid")
+			return nil, fmt.Errorf("file %d has an invalid length", i)
+		}
+
+		path, ok := entry.Dict["path"]
+
+		if !ok || path.Type != bencode.ListType || len(path.List) == 0 {
+			log.Error().Str("from", opts.From).Int("file", i).Msg("file path is missing or invalid")
+			return nil, fmt.Errorf("file %d has an invalid path", i)
+		}
+
+		components := []string{name}
+
+		for _, component := range path.List {
+			if component.Type != bencode.StringType || !isSafePathComponent(component.Str) {
+				log.Error().Str("from", opts.From).Int("file", i).Str("component", component.Str).Msg("invalid file path component")
+				return nil, fmt.Errorf("file %d has an invalid path component %q", i, component.Str)
+			}
+
+			components = append(components, component.Str)
+		}
+
+		log.Debug().Str("from", opts.From).Strs("path", components).Int64("length", length.Int).Msg("file")
+
+		files = append(files, File{Path: components, Length: length.Int, Offset: offset})
+		offset += length.Int
+	}
+
+	return files, nil
+}
+
+// Path components come from untrusted metadata, they must not escape the output directory
+func isSafePathComponent(component string) bool {
+	return component != "" && component != "." && component != ".." && !strings.ContainsAny(component, "/\\\x00")
+}
+
+func encodeInfo(info bencode.BencodeValue) ([]byte, error) {
 
 	buffer := bytes.Buffer{}
 
@@ -206,12 +442,10 @@ func hashInfo(info bencode.BencodeValue) ([20]byte, error) {
 
 	if err != nil {
 		log.Error().Err(err).Msg("failed to encode info")
-		return [20]byte{}, err
+		return nil, err
 	}
 
-	hash := sha1.Sum(buffer.Bytes())
-
-	return hash, nil
+	return buffer.Bytes(), nil
 }
 
 func splitPiecesInHashes(pieces bencode.BencodeValue) ([][20]byte, error) {
@@ -253,3 +487,35 @@ func (t *TorrentFile) CalculatePieceSize(index int) int64 {
 	start, end := t.CalculateBoundsForPiece(index)
 	return end - start
 }
+
+// FileSegments maps the range [begin, end) of the piece stream to the files it covers
+// Zero length files never hold data, so they are not part of any segment
+func (t *TorrentFile) FileSegments(begin, end int64) []FileSegment {
+
+	segments := make([]FileSegment, 0, 1)
+
+	for i, file := range t.Files {
+		fileEnd := file.Offset + file.Length
+
+		if file.Length == 0 || fileEnd <= begin || file.Offset >= end {
+			continue
+		}
+
+		segmentBegin := max(begin, file.Offset)
+		segmentEnd := min(end, fileEnd)
+
+		segments = append(segments, FileSegment{
+			Index:  i,
+			File:   file,
+			Offset: segmentBegin - file.Offset,
+			Length: segmentEnd - segmentBegin,
+		})
+	}
+
+	return segments
+}
+
+// LocalPath returns where the file is stored inside the output directory
+func (f File) LocalPath(dir string) string {
+	return filepath.Join(append([]string{dir}, f.Path...)...)
+}
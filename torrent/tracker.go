@@ -2,110 +2,149 @@ package torrent
 
 import (
 	"Torrent-Client/bencode"
-	"Torrent-Client/client"
+	"context"
 	"fmt"
 	"github.com/rs/zerolog/log"
-	"io"
-	"net/http"
+	"net"
 	"net/url"
-	"strconv"
 	"time"
 )
 
 const defaultTrackerTimeout = 30 * time.Second
 
 type TrackerResponse struct {
-	Interval int
-	Peers    string
+	Interval    int
+	MinInterval int
+	Peers       []Peer
+	Complete    int
+	Incomplete  int
+	TrackerID   string
+	Warning     string
 }
 
-type BencodeToTrackerResponseOpts struct {
-	from string
+// TrackerFailure is returned when the tracker rejects the announce, Reason is the message it sent
+type TrackerFailure struct {
+	Reason string
 }
 
-// Builds the tracker URL for the torrent file
-func (t *TorrentFile) BuildTrackerUrl(peerID [20]byte, port uint16) (string, error) {
-
-	log.Debug().Msg("building tracker URL")
-
-	base, err := url.Parse(t.Announce)
-
-	if err != nil {
-		log.Error().Err(err).Str("announce", t.Announce).Msg("failed to parse announce URL")
-		return "", err
-	}
+func (e *TrackerFailure) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
+}
 
-	params := url.Values{
+type BencodeToTrackerResponseOpts struct {
+	from string
+}
 
-		// The tracker will use this to figure out which peers to show us
-		// The info hash is a SHA1 hash of the bencoded info key from the metainfo file
-		"info_hash": []string{string(t.InfoHash[:])},
+// AnnounceEvent tells the tracker why we are announcing, the values follow the UDP tracker protocol
+type AnnounceEvent int32
 
-		// The peer ID is a 20-byte string used as a unique ID for the client
-		// This is used to identify the client to the tracker
-		"peer_id": []string{string(peerID[:])},
+const (
+	EventNone      AnnounceEvent = iota // Regular announce made at the interval requested by the tracker
+	EventCompleted                      // Sent once when the download finishes
+	EventStarted                        // Sent on the first announce
+	EventStopped                        // Sent when the client shuts down gracefully
+)
 
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(int(t.Length))},
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
 	}
+}
 
-	base.RawQuery = params.Encode()
-
-	log.Debug().Str("url", base.String()).Msg("tracker URL")
+// AnnounceRequest holds everything sent to a tracker when announcing
+// NumWant is how many peers we would like, zero lets the tracker decide
+// IPv6 is our global IPv6 address, advertised to HTTP trackers so dual-stack peers can reach us (BEP 7)
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      AnnounceEvent
+	NumWant    int32
+	Key        uint32
+	IPv6       net.IP
+}
 
-	return base.String(), nil
+// Tracker is a client for a single announce URL
+// Announce gives up when the context is done
+type Tracker interface {
+	Announce(ctx context.Context, request AnnounceRequest) (TrackerResponse, error)
+	URL() string
+	Close() error
 }
 
-// Peers is a list of peers that the client can connect to
-// First, its required to send an HTTP GET request to the tracker
-// The tracker will respond with a bencoded dictionary
-// The dictionary will contain a list of peers
-// Each peer is a dictionary containing the IP address and port number
-// It's made of 6 bytes for the IP address and 2 bytes for the port number
-// Big-endian notation is used for both the IP address and port number
-func (t *TorrentFile) RequestPeers(peerID [20]byte, port uint16) ([]client.Peer, error) {
+// NewTracker creates the tracker client matching the scheme of the announce URL
+func NewTracker(announce string) (Tracker, error) {
 
-	url, err := t.BuildTrackerUrl(peerID, port)
+	base, err := url.Parse(announce)
 
 	if err != nil {
-		log.Error().Err(err).Msg("could not build tracker URL to request peers")
+		log.Error().Err(err).Str("announce", announce).Msg("failed to parse announce URL")
 		return nil, err
 	}
 
-	c := &http.Client{Timeout: defaultTrackerTimeout}
+	switch base.Scheme {
+	case "http", "https":
+		return NewHTTPTracker(announce), nil
+	case "udp":
+		return NewUDPTracker(announce)
+	default:
+		log.Error().Str("announce", announce).Str("scheme", base.Scheme).Msg("unsupported tracker scheme")
+		return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+	}
+}
 
-	resp, err := c.Get(url)
+// Builds the tracker URL for the torrent file
+func (t *TorrentFile) BuildTrackerUrl(peerID [20]byte, port uint16) (string, error) {
+	return BuildAnnounceUrl(t.Announce, t.newAnnounceRequest(peerID, port))
+}
 
-	if err != nil {
-		log.Error().Err(err).Msg("failed to send GET request to tracker")
-		return nil, err
+// Builds the first announce of a download, nothing was transferred yet
+func (t *TorrentFile) newAnnounceRequest(peerID [20]byte, port uint16) AnnounceRequest {
+	return AnnounceRequest{
+		InfoHash: t.InfoHash,
+		PeerID:   peerID,
+		Port:     port,
+		Left:     t.Length,
 	}
+}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Error().Err(err).Msg("failed to close response body")
+// Peers is a list of peers that the client can connect to
+// First, its required to announce to the trackers, using HTTP or UDP depending on the announce URL
+// Every tier of the announce list is asked and the peers they return are merged
+// Each peer is made of 4 bytes for the IP address and 2 bytes for the port number
+// Big-endian notation is used for both the IP address and port number
+func (t *TorrentFile) RequestPeers(peerID [20]byte, port uint16) ([]Peer, error) {
+
+	announcer := NewAnnouncer(t.AnnounceTiers())
+
+	defer func(announcer *Announcer) {
+		if err := announcer.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close trackers")
 		}
-	}(resp.Body)
+	}(announcer)
 
-	result, err := bencode.Parse(resp.Body)
+	result, err := announcer.Announce(context.Background(), t.newAnnounceRequest(peerID, port))
 
 	if err != nil {
-		log.Error().Err(err).Msg("failed to parse tracker response")
+		log.Error().Err(err).Msg("failed to announce to trackers")
 		return nil, err
 	}
 
-	trackerResponse, err := BencodeToTrackerResponse(result, BencodeToTrackerResponseOpts{from: url})
-
-	if err != nil {
-		log.Error().Err(err).Msg("failed to convert tracker response")
-		return nil, err
+	if len(result.Peers) == 0 {
+		return nil, fmt.Errorf("received empty peers")
 	}
 
-	return client.DecodePeers([]byte(trackerResponse.Peers))
+	return result.Peers, nil
 }
 
 func BencodeToTrackerResponse(result bencode.BencodeValue, opts BencodeToTrackerResponseOpts) (TrackerResponse, error) {
@@ -116,6 +155,26 @@ func BencodeToTrackerResponse(result bencode.BencodeValue, opts BencodeToTracker
 		return TrackerResponse{}, fmt.Errorf("expected DictType, got %v", result.Type)
 	}
 
+	// A failure reason means the announce was rejected, the other fields may be missing
+	failure, ok := result.Dict["failure reason"]
+
+	if ok {
+		log.Warn().Str("from", opts.from).Str("failure reason", failure.Str).Msg("tracker rejected the announce")
+		return TrackerResponse{}, &TrackerFailure{Reason: failure.Str}
+	}
+
+	// Check the warning message, the response is still processed normally
+	warning, ok := result.Dict["warning message"]
+
+	if !ok {
+		log.Debug().Str("from", opts.from).Msg("missing warning message")
+	} else if warning.Type != bencode.StringType {
+		log.Error().Str("from", opts.from).Msg("warning message is not a string")
+		return TrackerResponse{}, fmt.Errorf("warning message is not a string")
+	} else {
+		log.Warn().Str("from", opts.from).Str("warning message", warning.Str).Msg("tracker warning")
+	}
+
 	// Check the interval field
 	interval, ok := result.Dict["interval"]
 
@@ -129,21 +188,164 @@ func BencodeToTrackerResponse(result bencode.BencodeValue, opts BencodeToTracker
 		log.Debug().Str("from", opts.from).Int64("interval", interval.Int).Msg("interval")
 	}
 
-	// Check the peers field
-	peers, ok := result.Dict["peers"]
+	// Check the min interval field, trackers use it to ask clients not to announce more often
+	minInterval, ok := result.Dict["min interval"]
+
+	if !ok {
+		log.Debug().Str("from", opts.from).Msg("missing min interval")
+	} else if minInterval.Type != bencode.IntegerType {
+		log.Error().Str("from", opts.from).Msg("min interval is not an integer")
+		return TrackerResponse{}, fmt.Errorf("min interval is not an integer")
+	} else {
+		log.Debug().Str("from", opts.from).Int64("min interval", minInterval.Int).Msg("min interval")
+	}
+
+	// Check the swarm counters, seeders are complete and leechers incomplete
+	complete, ok := result.Dict["complete"]
+
+	if !ok {
+		log.Debug().Str("from", opts.from).Msg("missing complete")
+	} else if complete.Type != bencode.IntegerType {
+		log.Error().Str("from", opts.from).Msg("complete is not an integer")
+		return TrackerResponse{}, fmt.Errorf("complete is not an integer")
+	} else {
+		log.Debug().Str("from", opts.from).Int64("complete", complete.Int).Msg("complete")
+	}
+
+	incomplete, ok := result.Dict["incomplete"]
 
 	if !ok {
-		log.Error().Str("from", opts.from).Msg("missing peers")
-		return TrackerResponse{}, fmt.Errorf("missing peers")
-	} else if peers.Type != bencode.StringType {
-		log.Error().Str("from", opts.from).Msg("peers is not a string")
-		return TrackerResponse{}, fmt.Errorf("peers is not a string")
+		log.Debug().Str("from", opts.from).Msg("missing incomplete")
+	} else if incomplete.Type != bencode.IntegerType {
+		log.Error().Str("from", opts.from).Msg("incomplete is not an integer")
+		return TrackerResponse{}, fmt.Errorf("incomplete is not an integer")
 	} else {
-		log.Debug().Str("from", opts.from).Str("peers", peers.Str).Msg("peers")
+		log.Debug().Str("from", opts.from).Int64("incomplete", incomplete.Int).Msg("incomplete")
+	}
+
+	// Check the tracker id, it must be sent back on the next announces
+	trackerID, ok := result.Dict["tracker id"]
+
+	if !ok {
+		log.Debug().Str("from", opts.from).Msg("missing tracker id")
+	} else if trackerID.Type != bencode.StringType {
+		log.Error().Str("from", opts.from).Msg("tracker id is not a string")
+		return TrackerResponse{}, fmt.Errorf("tracker id is not a string")
+	} else {
+		log.Debug().Str("from", opts.from).Str("tracker id", trackerID.Str).Msg("tracker id")
+	}
+
+	// Check the peers field, it is either a compact string or a list of dictionaries
+	peers, err := decodeTrackerPeers(result, opts)
+
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+
+	// Check the peers6 field, it holds the compact IPv6 peers (BEP 7)
+	peers6, ok := result.Dict["peers6"]
+
+	if !ok {
+		log.Debug().Str("from", opts.from).Msg("missing peers6")
+	} else if peers6.Type != bencode.StringType {
+		log.Error().Str("from", opts.from).Msg("peers6 is not a string")
+		return TrackerResponse{}, fmt.Errorf("peers6 is not a string")
+	} else if len(peers6.Str) > 0 {
+		log.Debug().Str("from", opts.from).Int("length", len(peers6.Str)).Msg("compact IPv6 peers")
+
+		decoded, err := DecodePeers6([]byte(peers6.Str))
+
+		if err != nil {
+			log.Error().Err(err).Str("from", opts.from).Msg("failed to decode peers6")
+			return TrackerResponse{}, err
+		}
+
+		peers = append(peers, decoded...)
 	}
 
 	return TrackerResponse{
-		Interval: int(interval.Int),
-		Peers:    peers.Str,
+		Interval:    int(interval.Int),
+		MinInterval: int(minInterval.Int),
+		Peers:       peers,
+		Complete:    int(complete.Int),
+		Incomplete:  int(incomplete.Int),
+		TrackerID:   trackerID.Str,
+		Warning:     warning.Str,
 	}, nil
 }
+
+// Decodes the peers of the tracker response
+// Compact responses hold 6 bytes per peer, the original format is a list of dictionaries with ip, port and peer id
+func decodeTrackerPeers(result bencode.BencodeValue, opts BencodeToTrackerResponseOpts) ([]Peer, error) {
+
+	peers, ok := result.Dict["peers"]
+
+	if !ok {
+		log.Debug().Str("from", opts.from).Msg("missing peers")
+		return nil, nil
+	}
+
+	switch peers.Type {
+	case bencode.StringType:
+		log.Debug().Str("from", opts.from).Int("length", len(peers.Str)).Msg("compact peers")
+
+		if len(peers.Str) == 0 {
+			return nil, nil
+		}
+
+		return DecodePeers([]byte(peers.Str))
+	case bencode.ListType:
+		log.Debug().Str("from", opts.from).Int("length", len(peers.List)).Msg("dictionary peers")
+
+		decoded := make([]Peer, 0, len(peers.List))
+
+		for _, entry := range peers.List {
+			peer, err := decodePeerDict(entry)
+
+			if err != nil {
+				log.Debug().Err(err).Str("from", opts.from).Msg("skipping invalid peer")
+				continue
+			}
+
+			decoded = append(decoded, peer)
+		}
+
+		return decoded, nil
+	default:
+		log.Error().Str("from", opts.from).Msg("peers is neither a string nor a list")
+		return nil, fmt.Errorf("peers is neither a string nor a list")
+	}
+}
+
+// Decodes a single peer of a non-compact response, host names are not resolved
+func decodePeerDict(entry bencode.BencodeValue) (Peer, error) {
+
+	if entry.Type != bencode.DictType {
+		return Peer{}, fmt.Errorf("peer is not a dictionary")
+	}
+
+	ip, ok := entry.Dict["ip"]
+
+	if !ok || ip.Type != bencode.StringType {
+		return Peer{}, fmt.Errorf("peer ip is missing or not a string")
+	}
+
+	port, ok := entry.Dict["port"]
+
+	if !ok || port.Type != bencode.IntegerType || port.Int <= 0 || port.Int > 65535 {
+		return Peer{}, fmt.Errorf("peer port is missing or invalid")
+	}
+
+	address := net.ParseIP(ip.Str)
+
+	if address == nil {
+		return Peer{}, fmt.Errorf("peer ip %q is not an address", ip.Str)
+	}
+
+	// Prefer the 4 byte form so IPv4 peers compare equal whatever their origin
+	if v4 := address.To4(); v4 != nil {
+		address = v4
+	}
+
+	return Peer{IP: address, Port: uint16(port.Int)}, nil
+}
@@ -0,0 +1,405 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+// Every exchange starts with a connect request that hands out a connection ID valid for one minute
+// Requests are retransmitted with a timeout of 15 * 2 ^ n seconds, the transaction ID pairs responses with requests
+// The specification retries up to eight times, over an hour for a dead tracker, we give up after a few minutes
+const udpProtocolID uint64 = 0x41727101980
+
+const udpConnectionIDLifetime = time.Minute
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+const defaultUDPTimeout = 15 * time.Second
+const defaultUDPRetries = 2
+
+// Longest wait for a response, the doubling of the timeout stops there
+const maxUDPTimeout = time.Minute
+const udpMaxPacketSize = 65536
+
+// UDPTracker announces to a tracker using the UDP tracker protocol
+// The socket and the connection ID are kept between requests, Close releases the socket
+// Requests are sent one at a time, Close does not wait for the one in flight and makes it fail
+type UDPTracker struct {
+	// Timeout is how long the first attempt waits for a response, each retransmission doubles it up to a minute
+	Timeout time.Duration
+	// Retries is how many times a request is retransmitted before giving up
+	Retries int
+
+	announce string
+	host     string
+
+	// Held for a whole request, guards the connection ID
+	mutex        sync.Mutex
+	connectionID uint64
+	connectedAt  time.Time
+
+	// Guards the socket only, so Close never waits for a request
+	connMutex sync.Mutex
+	conn      net.Conn
+}
+
+// ScrapeResult holds the swarm statistics of a single info hash
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+var errUDPTimeout = errors.New("udp tracker did not respond")
+
+func NewUDPTracker(announce string) (*UDPTracker, error) {
+
+	base, err := url.Parse(announce)
+
+	if err != nil {
+		log.Error().Err(err).Str("announce", announce).Msg("failed to parse announce URL")
+		return nil, err
+	}
+
+	if base.Scheme != "udp" || base.Port() == "" {
+		log.Error().Str("announce", announce).Msg("invalid udp tracker URL")
+		return nil, fmt.Errorf("invalid udp tracker URL %q", announce)
+	}
+
+	return &UDPTracker{
+		Timeout:  defaultUDPTimeout,
+		Retries:  defaultUDPRetries,
+		announce: announce,
+		host:     base.Host,
+	}, nil
+}
+
+func (t *UDPTracker) URL() string {
+	return t.announce
+}
+
+// Close releases the socket, a request in flight fails right away and the next one opens a new socket
+func (t *UDPTracker) Close() error {
+
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+	t.conn = nil
+
+	return err
+}
+
+// Announce sends the announce request and decodes the compact peer list of the response
+// The retransmissions stop when the context is done
+func (t *UDPTracker) Announce(ctx context.Context, request AnnounceRequest) (TrackerResponse, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	conn, err := t.socket(ctx)
+
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+
+	numWant := request.NumWant
+
+	// Minus one lets the tracker decide
+	if numWant <= 0 {
+		numWant = -1
+	}
+
+	response, err := t.exchange(ctx, conn, udpActionAnnounce, func(packet []byte) []byte {
+		packet = append(packet, request.InfoHash[:]...)
+		packet = append(packet, request.PeerID[:]...)
+		packet = binary.BigEndian.AppendUint64(packet, uint64(request.Downloaded))
+		packet = binary.BigEndian.AppendUint64(packet, uint64(request.Left))
+		packet = binary.BigEndian.AppendUint64(packet, uint64(request.Uploaded))
+		packet = binary.BigEndian.AppendUint32(packet, uint32(request.Event))
+		packet = binary.BigEndian.AppendUint32(packet, 0) // IP address, zero means the sender address
+		packet = binary.BigEndian.AppendUint32(packet, request.Key)
+		packet = binary.BigEndian.AppendUint32(packet, uint32(numWant))
+		packet = binary.BigEndian.AppendUint16(packet, request.Port)
+		return packet
+	})
+
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+
+	// Action, transaction ID, interval, leechers and seeders, then the peers
+	if len(response) < 20 {
+		log.Error().Str("announce", t.announce).Int("length", len(response)).Msg("announce response too short")
+		return TrackerResponse{}, fmt.Errorf("announce response too short")
+	}
+
+	trackerResponse := TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(response[8:12])),
+		Incomplete: int(binary.BigEndian.Uint32(response[12:16])),
+		Complete:   int(binary.BigEndian.Uint32(response[16:20])),
+	}
+
+	// Announces sent over IPv6 get 18 byte IPv6 peers back (BEP 15)
+	decode := DecodePeers
+
+	if address, ok := conn.RemoteAddr().(*net.UDPAddr); ok && address.IP.To4() == nil {
+		decode = DecodePeers6
+	}
+
+	if len(response) > 20 {
+		trackerResponse.Peers, err = decode(response[20:])
+
+		if err != nil {
+			log.Error().Err(err).Str("announce", t.announce).Msg("failed to decode peers")
+			return TrackerResponse{}, err
+		}
+	}
+
+	log.Debug().Str("announce", t.announce).Int("interval", trackerResponse.Interval).Int("peers", len(trackerResponse.Peers)).Msg("announce response")
+
+	return trackerResponse, nil
+}
+
+// Scrape asks the tracker for the swarm statistics of the info hashes
+func (t *UDPTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	conn, err := t.socket(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.exchange(ctx, conn, udpActionScrape, func(packet []byte) []byte {
+		for _, infoHash := range infoHashes {
+			packet = append(packet, infoHash[:]...)
+		}
+		return packet
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response) < 8+12*len(infoHashes) {
+		log.Error().Str("announce", t.announce).Int("length", len(response)).Msg("scrape response too short")
+		return nil, fmt.Errorf("scrape response too short")
+	}
+
+	results := make([]ScrapeResult, len(infoHashes))
+
+	for i := range results {
+		offset := 8 + i*12
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(response[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(response[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(response[offset+8 : offset+12])),
+		}
+	}
+
+	return results, nil
+}
+
+// Returns the socket, opening it when there is none
+// The connection ID was handed out to the previous socket, a new one asks for another
+func (t *UDPTracker) socket(ctx context.Context) (net.Conn, error) {
+
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+
+	if t.conn != nil {
+		return t.conn, nil
+	}
+
+	dialer := net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "udp", t.host)
+
+	if err != nil {
+		log.Error().Err(err).Str("announce", t.announce).Msg("failed to open udp socket")
+		return nil, err
+	}
+
+	t.conn = conn
+	t.connectionID = 0
+
+	return conn, nil
+}
+
+// Sends a request that needs a connection ID, connecting first when the cached one expired
+// The body function appends the action specific fields after the header
+func (t *UDPTracker) exchange(ctx context.Context, conn net.Conn, action uint32, body func([]byte) []byte) ([]byte, error) {
+
+	if t.connectionID == 0 || time.Since(t.connectedAt) > udpConnectionIDLifetime {
+		if err := t.connect(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	transactionID := newTransactionID()
+
+	packet := make([]byte, 0, 128)
+	packet = binary.BigEndian.AppendUint64(packet, t.connectionID)
+	packet = binary.BigEndian.AppendUint32(packet, action)
+	packet = binary.BigEndian.AppendUint32(packet, transactionID)
+	packet = body(packet)
+
+	response, err := t.roundTrip(ctx, conn, packet, action, transactionID)
+
+	// The tracker may have forgotten the connection ID before it expired on our side
+	var trackerFailure *TrackerFailure
+
+	if errors.As(err, &trackerFailure) {
+		t.connectionID = 0
+	}
+
+	return response, err
+}
+
+// Obtains a new connection ID from the tracker
+func (t *UDPTracker) connect(ctx context.Context, conn net.Conn) error {
+
+	transactionID := newTransactionID()
+
+	packet := make([]byte, 0, 16)
+	packet = binary.BigEndian.AppendUint64(packet, udpProtocolID)
+	packet = binary.BigEndian.AppendUint32(packet, udpActionConnect)
+	packet = binary.BigEndian.AppendUint32(packet, transactionID)
+
+	response, err := t.roundTrip(ctx, conn, packet, udpActionConnect, transactionID)
+
+	if err != nil {
+		log.Error().Err(err).Str("announce", t.announce).Msg("failed to connect to udp tracker")
+		return err
+	}
+
+	if len(response) < 16 {
+		log.Error().Str("announce", t.announce).Int("length", len(response)).Msg("connect response too short")
+		return fmt.Errorf("connect response too short")
+	}
+
+	t.connectionID = binary.BigEndian.Uint64(response[8:16])
+	t.connectedAt = time.Now()
+
+	log.Debug().Str("announce", t.announce).Uint64("connection", t.connectionID).Msg("connected to udp tracker")
+
+	return nil
+}
+
+// Sends the packet and waits for the response with the same transaction ID, retransmitting on timeouts
+// Packets with another transaction ID are stale responses and are skipped
+// A done context interrupts the read waiting for the response
+func (t *UDPTracker) roundTrip(ctx context.Context, conn net.Conn, packet []byte, action uint32, transactionID uint32) ([]byte, error) {
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+
+	defer stop()
+
+	buffer := make([]byte, udpMaxPacketSize)
+	timeout := t.Timeout
+
+	for attempt := 0; attempt <= t.Retries; attempt++ {
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		_, err := conn.Write(packet)
+
+		if err != nil {
+			log.Error().Err(err).Str("announce", t.announce).Msg("failed to write udp packet")
+			return nil, err
+		}
+
+		err = conn.SetReadDeadline(time.Now().Add(timeout))
+
+		if err != nil {
+			log.Error().Err(err).Str("announce", t.announce).Msg("failed to set deadline")
+			return nil, err
+		}
+
+		for {
+			n, err := conn.Read(buffer)
+
+			if ctx.Err() != nil {
+				log.Debug().Str("announce", t.announce).Msg("udp tracker request cancelled")
+				return nil, ctx.Err()
+			}
+
+			var netError net.Error
+
+			if errors.As(err, &netError) && netError.Timeout() {
+				log.Debug().Str("announce", t.announce).Int("attempt", attempt).Dur("timeout", timeout).Msg("udp tracker timed out, retransmitting")
+				timeout = max(min(timeout*2, maxUDPTimeout), t.Timeout)
+				break
+			}
+
+			if err != nil {
+				log.Error().Err(err).Str("announce", t.announce).Msg("failed to read udp packet")
+				return nil, err
+			}
+
+			if n < 8 {
+				log.Debug().Str("announce", t.announce).Int("length", n).Msg("ignoring short udp packet")
+				continue
+			}
+
+			responseAction := binary.BigEndian.Uint32(buffer[0:4])
+			responseTransactionID := binary.BigEndian.Uint32(buffer[4:8])
+
+			if responseTransactionID != transactionID {
+				log.Debug().Str("announce", t.announce).Uint32("transaction", responseTransactionID).Uint32("expected", transactionID).Msg("ignoring udp packet with unexpected transaction ID")
+				continue
+			}
+
+			if responseAction == udpActionError {
+				return nil, &TrackerFailure{Reason: string(buffer[8:n])}
+			}
+
+			if responseAction != action {
+				log.Error().Str("announce", t.announce).Uint32("action", responseAction).Uint32("expected", action).Msg("unexpected udp tracker action")
+				return nil, fmt.Errorf("unexpected action %d, expected %d", responseAction, action)
+			}
+
+			response := make([]byte, n)
+			copy(response, buffer[:n])
+
+			return response, nil
+		}
+	}
+
+	return nil, errUDPTimeout
+}
+
+func newTransactionID() uint32 {
+
+	buffer := make([]byte, 4)
+
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(buffer)
+
+	return binary.BigEndian.Uint32(buffer)
+}